@@ -35,7 +35,7 @@ func CreateAPIKey(opts *Options) error {
 	ctx := context.Background()
 
 	debugPrint(log.Printf, levelDebug, "connect db\n")
-	db, err := OpenDB(ctx, opts.Cfg.DB.DSN)
+	db, err := OpenDB(ctx, opts.Cfg.DB)
 
 	if err != nil {
 		return err
@@ -95,6 +95,16 @@ func cryptString(message string, recipientPubKey []byte) (string, error) {
 	return base64.StdEncoding.EncodeToString(blob), nil
 }
 
+// looksEncrypted tells whether s has the form of a cryptString result,
+// without a key to decrypt it.
+func looksEncrypted(s string) bool {
+	blob, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return false
+	}
+	return len(blob) >= 1+x25519PubSize+saltSize+nonceSize+16 && blob[0] == versionByte
+}
+
 func decryptString(artifactB64 string, recipientPrivKey []byte) (string, error) {
 	if len(recipientPrivKey) != x25519PubSize {
 		return "", fmt.Errorf("recipient private key must be %d bytes (raw X25519)", x25519PubSize)
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// A backup is a gzip compressed tar of two files: manifest.json, then the
+// events of the tenant as NDJSON in seq order. The manifest describes the
+// archive and holds the checksum of the events.
+const (
+	backupFormat   = "hc-backup"
+	backupVersion  = 1
+	backupManifest = "manifest.json"
+	backupEvents   = "events.ndjson"
+)
+
+type backupInfo struct {
+	Format    string     `json:"format"`
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	HCVersion string     `json:"hc_version"`
+	Tenant    tenantMeta `json:"tenant"`
+	Tags      []TagCount `json:"tags"`
+	Events    struct {
+		File   string `json:"file"`
+		Count  int64  `json:"count"`
+		MaxSeq int64  `json:"max_seq"`
+		SHA256 string `json:"sha256"`
+	} `json:"events"`
+}
+
+// writeBackup writes the archive of the tenant to out. The events are
+// spooled to a temporary file first, the manifest needs their checksum.
+func writeBackup(ctx context.Context, db DBInterface, tenantID, version string, out io.Writer) (backupInfo, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %s\n", ctx, tenantID)
+
+	info := backupInfo{Format: backupFormat, Version: backupVersion, CreatedAt: time.Now().UTC(), HCVersion: version}
+	info.Events.File = backupEvents
+	var err error
+	if info.Tenant, err = db.ReadTenantMeta(ctx, tenantID); err != nil {
+		return info, err
+	}
+	if info.Tags, err = db.ListTags(ctx, tenantID); err != nil {
+		return info, fmt.Errorf("read tags: %w", err)
+	}
+
+	tmp, err := os.CreateTemp("", "hc-backup-*.ndjson")
+	if err != nil {
+		return info, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sum := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(tmp, sum))
+	enc := json.NewEncoder(w)
+	err = db.ScanEventRecords(ctx, tenantID, 0, func(r eventRecord) error {
+		info.Events.Count++
+		info.Events.MaxSeq = r.Seq
+		return enc.Encode(r)
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return info, fmt.Errorf("write events: %w", err)
+	}
+	info.Events.SHA256 = hex.EncodeToString(sum.Sum(nil))
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return info, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return info, err
+	}
+	manifest, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return info, err
+	}
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	hdr := &tar.Header{Name: backupManifest, Mode: 0o600, Size: int64(len(manifest)), ModTime: info.CreatedAt}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return info, err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return info, err
+	}
+	hdr = &tar.Header{Name: backupEvents, Mode: 0o600, Size: size, ModTime: info.CreatedAt}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return info, err
+	}
+	if _, err := io.Copy(tw, tmp); err != nil {
+		return info, err
+	}
+	if err := tw.Close(); err != nil {
+		return info, err
+	}
+	return info, gz.Close()
+}
+
+// backupReader reads an archive: the manifest, then the events.
+type backupReader struct {
+	f    *os.File
+	gz   *gzip.Reader
+	tr   *tar.Reader
+	info backupInfo
+}
+
+func openBackup(path string) (*backupReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	br := &backupReader{f: f}
+	if err := br.readManifest(); err != nil {
+		br.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return br, nil
+}
+
+func (br *backupReader) readManifest() error {
+	var err error
+	if br.gz, err = gzip.NewReader(br.f); err != nil {
+		return err
+	}
+	br.tr = tar.NewReader(br.gz)
+	hdr, err := br.tr.Next()
+	if err != nil {
+		return err
+	}
+	if hdr.Name != backupManifest {
+		return fmt.Errorf("not an hc backup, first entry %q", hdr.Name)
+	}
+	if err := json.NewDecoder(br.tr).Decode(&br.info); err != nil {
+		return fmt.Errorf("manifest: %w", err)
+	}
+	if br.info.Format != backupFormat {
+		return fmt.Errorf("not an hc backup, format %q", br.info.Format)
+	}
+	if br.info.Version != backupVersion {
+		return fmt.Errorf("backup version %d is not supported", br.info.Version)
+	}
+	return nil
+}
+
+// events positions the reader on the events, sum receives their bytes.
+func (br *backupReader) events(sum hash.Hash) (*json.Decoder, error) {
+	for {
+		hdr, err := br.tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("backup without %s", br.info.Events.File)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == br.info.Events.File {
+			return json.NewDecoder(io.TeeReader(br.tr, sum)), nil
+		}
+	}
+}
+
+func (br *backupReader) Close() error {
+	if br.gz != nil {
+		_ = br.gz.Close()
+	}
+	return br.f.Close()
+}
+
+// verifyBackup reads the whole archive at path and checks the events
+// against the manifest.
+func verifyBackup(path string) (backupInfo, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%s\n", path)
+
+	br, err := openBackup(path)
+	if err != nil {
+		return backupInfo{}, err
+	}
+	defer br.Close()
+
+	sum := sha256.New()
+	dec, err := br.events(sum)
+	if err != nil {
+		return br.info, err
+	}
+	var n, last int64
+	for {
+		var r eventRecord
+		err := dec.Decode(&r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return br.info, fmt.Errorf("event %d: %w", n+1, err)
+		}
+		if r.Seq <= last {
+			return br.info, fmt.Errorf("event %d: seq %d out of order", n+1, r.Seq)
+		}
+		n, last = n+1, r.Seq
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != br.info.Events.SHA256 {
+		return br.info, fmt.Errorf("checksum mismatch: %s, manifest %s", got, br.info.Events.SHA256)
+	}
+	if n != br.info.Events.Count || last != br.info.Events.MaxSeq {
+		return br.info, fmt.Errorf("%d events up to seq %d, manifest %d up to %d", n, last, br.info.Events.Count, br.info.Events.MaxSeq)
+	}
+	return br.info, nil
+}
+
+// restoreBackup writes the archive at path to db in batches of
+// copyBatchRows. The seqs present already are skipped, an interrupted
+// restore is run again.
+func restoreBackup(ctx context.Context, db DBInterface, path string) (restored, skipped int64, err error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %s\n", ctx, path)
+
+	br, err := openBackup(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer br.Close()
+
+	tenantID := br.info.Tenant.Tenant.ID
+	if err := db.WriteTenantMeta(ctx, br.info.Tenant); err != nil {
+		return 0, 0, err
+	}
+	dec, err := br.events(sha256.New())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	batch := make([]eventRecord, 0, copyBatchRows)
+	flush := func() error {
+		n, err := db.WriteEventRecords(ctx, tenantID, batch)
+		if err != nil {
+			return fmt.Errorf("restore seq %d..%d: %w", batch[0].Seq, batch[len(batch)-1].Seq, err)
+		}
+		restored += int64(n)
+		skipped += int64(len(batch) - n)
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		var r eventRecord
+		err := dec.Decode(&r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return restored, skipped, err
+		}
+		batch = append(batch, r)
+		if len(batch) == copyBatchRows {
+			if err := flush(); err != nil {
+				return restored, skipped, err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return restored, skipped, err
+		}
+	}
+	return restored, skipped, nil
+}
+
+func doBackup(version string, args []string) {
+	debugPrint(log.Printf, levelCrazy, "Args=%s, %v\n", version, args)
+	opts, err := getRuntimeConf(version, args)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	tenantID := opts.Import.Tenant
+	if tenantID == "" {
+		tenantID = opts.Cfg.Globals.DefaultTenantID
+	}
+	if tenantID == "" || len(opts.Args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: hc backup [-config file] -tenant <uuid> <archive>")
+		os.Exit(2)
+	}
+	path := opts.Args[0]
+
+	ctx := context.Background()
+	debugPrint(log.Printf, levelDebug, "connecting db\n")
+	db, err := OpenDB(ctx, opts.Cfg.DB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	// a failed backup leaves no archive behind
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	info, err := writeBackup(ctx, db, tenantID, opts.Verstr, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Backup of tenant %s (%s): %d events up to seq %d, %d users, %d api keys\n",
+		info.Tenant.Tenant.ID, info.Tenant.Tenant.Name, info.Events.Count, info.Events.MaxSeq,
+		len(info.Tenant.Users), len(info.Tenant.APIKeys))
+}
+
+func doRestore(version string, args []string) {
+	debugPrint(log.Printf, levelCrazy, "Args=%s, %v\n", version, args)
+	opts, err := getRuntimeConf(version, args)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if len(opts.Args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: hc restore [-config file] <archive>")
+		os.Exit(2)
+	}
+	path := opts.Args[0]
+
+	debugPrint(log.Printf, levelDebug, "verifying %s\n", path)
+	info, err := verifyBackup(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if opts.Import.Tenant != "" && opts.Import.Tenant != info.Tenant.Tenant.ID {
+		fmt.Fprintf(os.Stderr, "archive is for tenant %s\n", info.Tenant.Tenant.ID)
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	debugPrint(log.Printf, levelDebug, "connecting db\n")
+	db, err := OpenDB(ctx, opts.Cfg.DB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	restored, skipped, err := restoreBackup(ctx, db, path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	maxSeq, err := db.MaxSeq(ctx, info.Tenant.Tenant.ID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Restore of tenant %s (%s): restored=%d skipped=%d max seq=%d\n",
+		info.Tenant.Tenant.ID, info.Tenant.Tenant.Name, restored, skipped, maxSeq)
+	if maxSeq < info.Events.MaxSeq {
+		fmt.Fprintf(os.Stderr, "max seq %d is below the %d of the archive\n", maxSeq, info.Events.MaxSeq)
+		os.Exit(1)
+	}
+}
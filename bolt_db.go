@@ -0,0 +1,1337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltDB is the embedded backend: a single bbolt file, pure Go, for the
+// static builds of small devices. Everything SQL does with queries is done
+// here with ordered keys:
+//
+//	tenants      id -> tenantRecord
+//	app_users    id -> userRecord
+//	api_keys     id -> apiKeyRecord
+//	api_key_ids  key_id -> id
+//	events/<tenant id>
+//	  seq        seq -> eventRecord, tags and notes included
+//	  dedup      dedup_key -> seq
+//	  session    session_id \0 host_fqdn \0 seq
+//	  host       host_fqdn \0 seq
+//	  time       coalesce(ts_client, ts_ingested) seq
+//	  client     ts_client seq
+//	  noclient   seq, the events without ts_client
+//	  ingest     ts_ingested seq
+//	  tag        tag \0 seq
+//
+// seq is 8 bytes big endian, times are boltTimeKey.
+type BoltDB struct {
+	DB *bolt.DB
+}
+
+var (
+	boltTenants   = []byte("tenants")
+	boltUsers     = []byte("app_users")
+	boltAPIKeys   = []byte("api_keys")
+	boltAPIKeyIDs = []byte("api_key_ids")
+	boltEvents    = []byte("events")
+
+	boltTenantBuckets = []string{"seq", "dedup", "session", "host", "time", "client", "noclient", "ingest", "tag"}
+)
+
+func init() {
+	registerDBDriver("bolt", func(ctx context.Context, cfg DBConfig) (DBInterface, error) {
+		return OpenBoltDB(ctx, cfg)
+	}, "bolt", "bbolt")
+}
+
+// OpenBoltDB opens the file of cfg.DSN, creating it when missing. bbolt
+// locks the file: a second hc on the same file waits 5s then fails.
+func OpenBoltDB(ctx context.Context, cfg DBConfig) (*BoltDB, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", ctx, cfg)
+
+	path := strings.TrimPrefix(cfg.DSN, "file:")
+	if path == "" {
+		return nil, errors.New("bolt: empty dsn, the database file is needed")
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("bolt open %s: locked by another process", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bolt open %s: %w", path, err)
+	}
+
+	d := &BoltDB{DB: db}
+	if err := d.EnsureSchema(ctx); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *BoltDB) Ping(ctx context.Context) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", ctx)
+	return d.DB.View(func(*bolt.Tx) error { return nil })
+}
+
+func (d *BoltDB) Close() error {
+	debugPrint(log.Printf, levelCrazy, "Args=none\n")
+	if d == nil || d.DB == nil {
+		return nil
+	}
+	return d.DB.Close()
+}
+
+// EnsureSchema creates the top level buckets, the tenant ones are created
+// with the first event.
+func (d *BoltDB) EnsureSchema(ctx context.Context) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", ctx)
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltTenants, boltUsers, boltAPIKeys, boltAPIKeyIDs, boltEvents} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("ensure schema failed on %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// UpgradeSchema adds the buckets a newer hc needs, the events ones have
+// no columns to upgrade.
+func (d *BoltDB) UpgradeSchema(ctx context.Context) error {
+	return d.EnsureSchema(ctx)
+}
+
+func boltSeqKey(seq int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(seq))
+	return k
+}
+
+// boltKeySeq returns the seq ending an index key.
+func boltKeySeq(k []byte) int64 {
+	return int64(binary.BigEndian.Uint64(k[len(k)-8:]))
+}
+
+// boltTimeKey orders like t: seconds with the sign bit flipped, then
+// nanoseconds.
+func boltTimeKey(t time.Time) []byte {
+	k := make([]byte, 12)
+	binary.BigEndian.PutUint64(k, uint64(t.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(k[8:], uint32(t.Nanosecond()))
+	return k
+}
+
+// boltKey joins the parts of an index key in a new slice, bbolt keeps the
+// slices given to Put until the commit.
+func boltKey(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func boltTextKey(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// boltTenant is the bucket set of a tenant, by name.
+type boltTenant map[string]*bolt.Bucket
+
+// boltTenantOf returns the buckets of tenantID, nil when the tenant has
+// no events and create is false.
+func boltTenantOf(tx *bolt.Tx, tenantID string, create bool) (boltTenant, error) {
+	events := tx.Bucket(boltEvents)
+	id := []byte(strings.ToLower(tenantID))
+	tb := events.Bucket(id)
+	if tb == nil {
+		if !create {
+			return nil, nil
+		}
+		var err error
+		if tb, err = events.CreateBucket(id); err != nil {
+			return nil, err
+		}
+		for _, name := range boltTenantBuckets {
+			if _, err := tb.CreateBucket([]byte(name)); err != nil {
+				return nil, err
+			}
+		}
+		if err := boltTouchTenant(tx, tenantID); err != nil {
+			return nil, err
+		}
+	}
+	t := make(boltTenant, len(boltTenantBuckets))
+	for _, name := range boltTenantBuckets {
+		t[name] = tb.Bucket([]byte(name))
+	}
+	return t, nil
+}
+
+// boltTouchTenant adds the tenant record of an event's tenant when
+// missing, named after its id. There is no foreign key to refuse the
+// event and no SQL console to add the tenant first.
+func boltTouchTenant(tx *bolt.Tx, tenantID string) error {
+	b := tx.Bucket(boltTenants)
+	id := strings.ToLower(tenantID)
+	if b.Get([]byte(id)) != nil {
+		return nil
+	}
+	return boltPutJSON(b, []byte(id), tenantRecord{ID: id, Name: id, CreatedAt: time.Now().UTC()})
+}
+
+// boltNamedTenant reports whether the tenant record v has a name of its
+// own. The ones added by boltTouchTenant give way to a named one.
+func boltNamedTenant(v []byte) bool {
+	var t tenantRecord
+	return v != nil && (json.Unmarshal(v, &t) != nil || t.Name != t.ID)
+}
+
+func boltPutJSON(b *bolt.Bucket, key []byte, v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, buf)
+}
+
+func (t boltTenant) get(seq int64) (eventRecord, bool, error) {
+	var r eventRecord
+	v := t["seq"].Get(boltSeqKey(seq))
+	if v == nil {
+		return r, false, nil
+	}
+	if err := json.Unmarshal(v, &r); err != nil {
+		return r, false, fmt.Errorf("event %d: %w", seq, err)
+	}
+	return r, true, nil
+}
+
+// insert stores r and its index entries unless its seq or its dedup key
+// is taken, it reports whether r was new.
+func (t boltTenant) insert(r eventRecord) (bool, error) {
+	seq := boltSeqKey(r.Seq)
+	if t["seq"].Get(seq) != nil {
+		return false, nil
+	}
+	if r.DedupKey != nil {
+		if t["dedup"].Get([]byte(*r.DedupKey)) != nil {
+			return false, nil
+		}
+		if err := t["dedup"].Put([]byte(*r.DedupKey), seq); err != nil {
+			return false, err
+		}
+	}
+	if err := boltPutJSON(t["seq"], seq, r); err != nil {
+		return false, err
+	}
+
+	at := r.TSIngested
+	if r.TSClient != nil {
+		at = *r.TSClient
+	}
+	keys := map[string][]byte{
+		"session": boltKey(boltTextKey(r.SessionID), boltTextKey(r.HostFQDN), seq),
+		"host":    boltKey(boltTextKey(r.HostFQDN), seq),
+		"time":    boltKey(boltTimeKey(at), seq),
+		"ingest":  boltKey(boltTimeKey(r.TSIngested), seq),
+	}
+	if r.TSClient != nil {
+		keys["client"] = boltKey(boltTimeKey(*r.TSClient), seq)
+	} else {
+		keys["noclient"] = boltKey(seq)
+	}
+	for name, k := range keys {
+		if err := t[name].Put(k, []byte{}); err != nil {
+			return false, err
+		}
+	}
+	for _, tag := range r.Tags {
+		if err := t["tag"].Put(boltKey(boltTextKey(tag), seq), []byte{}); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// boltEventRecord is the stored form of an event arriving from ingestion.
+func boltEventRecord(ev Event, seq int64) eventRecord {
+	r := eventRecord{
+		Seq:        seq,
+		TSClient:   ev.TSClient,
+		SessionID:  ev.SessionID,
+		HostFQDN:   ev.HostFQDN,
+		CWD:        ev.CWD,
+		Cmd:        ev.Cmd,
+		TSIngested: time.Now().UTC(),
+		SrcIP:      ev.SrcIP,
+		Transport:  ev.Transport,
+		ParseOK:    ev.ParseOK,
+		RawLine:    ev.RawLine,
+	}
+	if ev.DedupKey != "" {
+		key := ev.DedupKey
+		r.DedupKey = &key
+	}
+	if ev.ChainHash != "" {
+		hash := ev.ChainHash
+		r.ChainHash = &hash
+	}
+	if len(ev.Tags) > 0 {
+		r.Tags = slices.Compact(slices.Sorted(slices.Values(ev.Tags)))
+	}
+	return r
+}
+
+func (d *BoltDB) EnsureTenant(ctx context.Context, tenantID, name string) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %s, %s\n", ctx, tenantID, name)
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTenants)
+		id := strings.ToLower(tenantID)
+		if boltNamedTenant(b.Get([]byte(id))) {
+			return nil
+		}
+		if err := boltPutJSON(b, []byte(id), tenantRecord{ID: id, Name: name, CreatedAt: time.Now().UTC()}); err != nil {
+			return fmt.Errorf("ensure tenant: %w", err)
+		}
+		return nil
+	})
+}
+
+func (d *BoltDB) tenant(tx *bolt.Tx, tenantID string) (tenantRecord, bool, error) {
+	var t tenantRecord
+	v := tx.Bucket(boltTenants).Get([]byte(strings.ToLower(tenantID)))
+	if v == nil {
+		return t, false, nil
+	}
+	if err := json.Unmarshal(v, &t); err != nil {
+		return t, false, fmt.Errorf("tenant %s: %w", tenantID, err)
+	}
+	return t, true, nil
+}
+
+func (d *BoltDB) GetTenantName(ctx context.Context, tenantID string) (string, bool, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %s\n", ctx, tenantID)
+	var t tenantRecord
+	var ok bool
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		t, ok, err = d.tenant(tx, tenantID)
+		return err
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("get tenant: %w", err)
+	}
+	return t.Name, ok, nil
+}
+
+func (d *BoltDB) RequireTenantExists(ctx context.Context, tenantID uuid.UUID) error {
+	_, ok, err := d.GetTenantName(ctx, tenantID.String())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("tenant %s not found in tenants table", tenantID.String())
+	}
+	return nil
+}
+
+func (d *BoltDB) MaxSeq(ctx context.Context, tenantID string) (int64, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s\n", ctx, tenantID)
+
+	var seq int64
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		t, err := boltTenantOf(tx, tenantID, false)
+		if t == nil || err != nil {
+			return err
+		}
+		if k, _ := t["seq"].Cursor().Last(); k != nil {
+			seq = boltKeySeq(k)
+		}
+		return nil
+	})
+	return seq, err
+}
+
+func (d *BoltDB) CountEventsSince(ctx context.Context, tenantID string, since time.Time) (int64, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v\n", ctx, tenantID, since)
+
+	var n int64
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		t, err := boltTenantOf(tx, tenantID, false)
+		if t == nil || err != nil {
+			return err
+		}
+		c := t["ingest"].Cursor()
+		for k, _ := c.Seek(boltTimeKey(since)); k != nil; k, _ = c.Next() {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (d *BoltDB) InsertEventWithSeq(ctx context.Context, ev Event, seq int64) error {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %v, %d\n", ctx, ev, seq)
+
+	if _, err := uuid.Parse(ev.TenantID); err != nil {
+		return err
+	}
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		t, err := boltTenantOf(tx, ev.TenantID, true)
+		if err != nil {
+			return err
+		}
+		stored, err := t.insert(boltEventRecord(ev, seq))
+		if err != nil {
+			return err
+		}
+		if !stored && ev.DedupKey != "" {
+			return errDuplicateEvent
+		}
+		return nil
+	})
+}
+
+func (d *BoltDB) InsertEventBatch(ctx context.Context, batch []seqEvent) ([]bool, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %d rows\n", ctx, len(batch))
+
+	inserted := make([]bool, len(batch))
+	err := d.DB.Update(func(tx *bolt.Tx) error {
+		for i, r := range batch {
+			if _, err := uuid.Parse(r.Ev.TenantID); err != nil {
+				return err
+			}
+			t, err := boltTenantOf(tx, r.Ev.TenantID, true)
+			if err != nil {
+				return err
+			}
+			if inserted[i], err = t.insert(boltEventRecord(r.Ev, r.Seq)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
+
+func (d *BoltDB) lookupTenantByUsername(username string) (string, bool) {
+	var tenantID string
+	_ = d.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsers).ForEach(func(_, v []byte) error {
+			var u userRecord
+			if json.Unmarshal(v, &u) == nil && u.Username == username {
+				tenantID = u.TenantID
+				return errStopScan
+			}
+			return nil
+		})
+	})
+	return tenantID, tenantID != ""
+}
+
+// errStopScan ends a ForEach early, it never leaves the backend.
+var errStopScan = errors.New("stop scan")
+
+func (d *BoltDB) insertAPIKey(ctx context.Context, id uuid.UUID, tenant uuid.UUID, user *uuid.UUID, keyID, keyHash string) error {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %s, %s\n", ctx, id.String(), tenant.String(), keyID)
+
+	k := apiKeyRecord{
+		ID:        id.String(),
+		TenantID:  tenant.String(),
+		KeyID:     keyID,
+		KeyHash:   keyHash,
+		CreatedAt: time.Now().UTC(),
+	}
+	if user != nil && *user != uuid.Nil {
+		u := user.String()
+		k.UserID = &u
+	}
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltAPIKeyIDs).Get([]byte(keyID)) != nil {
+			// the wording isUniqueViolation looks for
+			return fmt.Errorf("api key %s: unique constraint on key_id", keyID)
+		}
+		return boltPutAPIKey(tx, k)
+	})
+}
+
+func boltPutAPIKey(tx *bolt.Tx, k apiKeyRecord) error {
+	if err := boltPutJSON(tx.Bucket(boltAPIKeys), []byte(k.ID), k); err != nil {
+		return err
+	}
+	return tx.Bucket(boltAPIKeyIDs).Put([]byte(k.KeyID), []byte(k.ID))
+}
+
+func (d *BoltDB) GetAPIKeyByKeyID(ctx context.Context, keyID string) (APIKeyRecord, bool, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s\n", ctx, keyID)
+
+	var k apiKeyRecord
+	var found bool
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(boltAPIKeyIDs).Get([]byte(keyID))
+		if id == nil {
+			return nil
+		}
+		v := tx.Bucket(boltAPIKeys).Get(id)
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &k)
+	})
+	if err != nil || !found {
+		return APIKeyRecord{}, false, err
+	}
+
+	info := APIKeyRecord{TenantID: k.TenantID, KeyHash: k.KeyHash}
+	if k.RevokedAt != nil {
+		info.Revoked = sql.NullTime{Time: *k.RevokedAt, Valid: true}
+	}
+	return info, true, nil
+}
+
+// boltFilter selects events the way the where clauses of the SQL backends
+// do, the time is coalesce(ts_client, ts_ingested).
+type boltFilter struct {
+	Session string
+	Host    string
+	From    time.Time
+	To      time.Time
+}
+
+func boltEventTime(r eventRecord) time.Time {
+	if r.TSClient != nil {
+		return r.TSClient.UTC()
+	}
+	return r.TSIngested.UTC()
+}
+
+func (f boltFilter) match(r eventRecord) bool {
+	at := boltEventTime(r)
+	return (f.Session == "" || r.SessionID == f.Session) &&
+		(f.Host == "" || r.HostFQDN == f.Host) &&
+		(f.From.IsZero() || !at.Before(f.From)) &&
+		(f.To.IsZero() || at.Before(f.To))
+}
+
+// scan calls fn for the events of t matching f, walking the narrowest
+// index: session, time range, host, else every event.
+func (f boltFilter) scan(ctx context.Context, t boltTenant, fn func(eventRecord) error) error {
+	var b *bolt.Bucket
+	var first, stop []byte
+	switch {
+	case f.Session != "":
+		b, first = t["session"], boltTextKey(f.Session)
+		if f.Host != "" {
+			first = boltKey(first, boltTextKey(f.Host))
+		}
+	case !f.From.IsZero() || !f.To.IsZero():
+		b = t["time"]
+		if !f.From.IsZero() {
+			first = boltTimeKey(f.From)
+		}
+		if !f.To.IsZero() {
+			stop = boltTimeKey(f.To)
+		}
+	case f.Host != "":
+		b, first = t["host"], boltTextKey(f.Host)
+	default:
+		b = t["seq"]
+	}
+
+	prefix := first
+	if b == t["time"] {
+		prefix = nil
+	}
+	c := b.Cursor()
+	k, _ := c.First()
+	if first != nil {
+		k, _ = c.Seek(first)
+	}
+	for ; k != nil; k, _ = c.Next() {
+		if prefix != nil && !bytes.HasPrefix(k, prefix) {
+			break
+		}
+		if stop != nil && bytes.Compare(k, stop) >= 0 {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r, ok, err := t.get(boltKeySeq(k))
+		if err != nil {
+			return err
+		}
+		if !ok || !f.match(r) {
+			continue
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltSegment is an ordered part of an export: the seq bucket for the
+// ingest order; the client time index and the events without client time
+// for the client order, NULLs in their own segment.
+type boltSegment struct {
+	name string
+	desc bool
+}
+
+// boltExportSegments returns the segments of sort in order.
+func boltExportSegments(s exportSort) []boltSegment {
+	if s.KeyCol == "" {
+		return []boltSegment{{"seq", s.Desc}}
+	}
+	client, nulls := boltSegment{"client", s.Desc}, boltSegment{"noclient", s.Desc}
+	if s.NullsFirst {
+		return []boltSegment{nulls, client}
+	}
+	return []boltSegment{client, nulls}
+}
+
+// boltExportPosition is the segment and key of r in the export order.
+func boltExportPosition(segs []boltSegment, r eventRecord) (int, []byte) {
+	name, key := "seq", boltSeqKey(r.Seq)
+	if len(segs) > 1 {
+		if r.TSClient != nil {
+			name, key = "client", boltKey(boltTimeKey(*r.TSClient), key)
+		} else {
+			name = "noclient"
+		}
+	}
+	for i, s := range segs {
+		if s.name == name {
+			return i, key
+		}
+	}
+	return 0, key
+}
+
+// boltCursorPosition is the segment and key of the event c points to.
+func boltCursorPosition(segs []boltSegment, c exportCursor) (int, []byte, error) {
+	r := eventRecord{Seq: c.ID}
+	if c.Key != nil {
+		ts, err := time.Parse(time.RFC3339Nano, *c.Key)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid cursor")
+		}
+		r.TSClient = &ts
+	}
+	i, key := boltExportPosition(segs, r)
+	return i, key, nil
+}
+
+// boltClientKey is the cursor key of the client order.
+func boltClientKey(r eventRecord) *string {
+	if r.TSClient == nil {
+		return nil
+	}
+	s := r.TSClient.UTC().Format(time.RFC3339Nano)
+	return &s
+}
+
+func (db *BoltDB) ExportLines(ctx context.Context, tenantID string, q exportQuery) (exportPage, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v\n", ctx, tenantID, q)
+
+	sort, err := exportOrderBolt(q.Order)
+	if err != nil {
+		return exportPage{}, err
+	}
+	cursor, reversed := q.After, false
+	if q.Before != nil {
+		cursor, reversed = q.Before, true
+		sort = sort.reversed()
+	}
+	if cursor != nil && cursor.Order != q.Order {
+		return exportPage{}, fmt.Errorf("cursor was issued for order=%s", cursor.Order)
+	}
+	pipe, err := CompileGrepPipeline(q.Greps, "")
+	if err != nil {
+		return exportPage{}, err
+	}
+
+	segs := boltExportSegments(sort)
+	curSeg, curKey := 0, []byte(nil)
+	if cursor != nil {
+		if curSeg, curKey, err = boltCursorPosition(segs, *cursor); err != nil {
+			return exportPage{}, err
+		}
+	}
+
+	page := exportPage{Lines: make([]string, 0, minInt(q.Limit, 256))}
+	// emit adds r to the page when it passes the filters, false once the
+	// page is full.
+	emit := func(r eventRecord) bool {
+		if (q.Host != "" && r.HostFQDN != q.Host) || !hasAllTags(r.Tags, q.Tags) || !pipe.Match(r.RawLine) {
+			return true
+		}
+		var key *string
+		if sort.KeyCol != "" {
+			key = boltClientKey(r)
+		}
+		cur := newExportCursor(q.Order, key, r.Seq)
+		if page.First == nil {
+			page.First = cur
+		}
+		page.Last = cur
+		page.Lines = append(page.Lines, r.RawLine)
+		return q.Limit <= 0 || len(page.Lines) < q.Limit
+	}
+
+	err = db.DB.View(func(tx *bolt.Tx) error {
+		t, err := boltTenantOf(tx, tenantID, false)
+		if t == nil || err != nil {
+			return err
+		}
+		if q.Session != "" {
+			return boltExportSession(ctx, t, q.Session, segs, curSeg, curKey, cursor != nil, emit)
+		}
+
+		for i, seg := range segs {
+			if cursor != nil && i < curSeg {
+				continue
+			}
+			var after []byte
+			if cursor != nil && i == curSeg {
+				after = curKey
+			}
+			more := true
+			err := boltWalk(t[seg.name], seg.desc, after, func(k []byte) (bool, error) {
+				if err := ctx.Err(); err != nil {
+					return false, err
+				}
+				r, ok, err := t.get(boltKeySeq(k))
+				if err != nil || !ok {
+					return err == nil, err
+				}
+				more = emit(r)
+				return more, nil
+			})
+			if err != nil || !more {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return exportPage{}, err
+	}
+
+	if reversed {
+		reverseStrings(page.Lines)
+		page.First, page.Last = page.Last, page.First
+	}
+	return page, nil
+}
+
+// boltExportSession is the export of a session: its events come from the
+// session index and are sorted in memory.
+func boltExportSession(ctx context.Context, t boltTenant, session string, segs []boltSegment, curSeg int, curKey []byte, hasCursor bool, emit func(eventRecord) bool) error {
+	type positioned struct {
+		seg int
+		key []byte
+		r   eventRecord
+	}
+	var evs []positioned
+	err := boltFilter{Session: session}.scan(ctx, t, func(r eventRecord) error {
+		seg, key := boltExportPosition(segs, r)
+		if hasCursor {
+			cmp := bytes.Compare(key, curKey)
+			if segs[seg].desc {
+				cmp = -cmp
+			}
+			if seg < curSeg || (seg == curSeg && cmp <= 0) {
+				return nil
+			}
+		}
+		evs = append(evs, positioned{seg, key, r})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(evs, func(i, j int) bool {
+		if evs[i].seg != evs[j].seg {
+			return evs[i].seg < evs[j].seg
+		}
+		cmp := bytes.Compare(evs[i].key, evs[j].key)
+		if segs[evs[i].seg].desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+	for _, ev := range evs {
+		if !emit(ev.r) {
+			break
+		}
+	}
+	return nil
+}
+
+// boltWalk calls fn for the keys of b in order, starting after the key
+// after when given, until fn returns false.
+func boltWalk(b *bolt.Bucket, desc bool, after []byte, fn func(k []byte) (bool, error)) error {
+	c := b.Cursor()
+	var k []byte
+	switch {
+	case after == nil && !desc:
+		k, _ = c.First()
+	case after == nil:
+		k, _ = c.Last()
+	case !desc:
+		if k, _ = c.Seek(after); k != nil && bytes.Equal(k, after) {
+			k, _ = c.Next()
+		}
+	default:
+		// the last key before after
+		if k, _ = c.Seek(after); k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+	}
+
+	for k != nil {
+		more, err := fn(k)
+		if err != nil || !more {
+			return err
+		}
+		if desc {
+			k, _ = c.Prev()
+		} else {
+			k, _ = c.Next()
+		}
+	}
+	return nil
+}
+
+func exportOrderBolt(order string) (exportSort, error) {
+	switch order {
+	case "ingest_asc":
+		return exportSort{}, nil
+	case "ingest_desc":
+		return exportSort{Desc: true}, nil
+	case "client_asc":
+		return exportSort{KeyCol: "ts_client"}, nil
+	case "client_desc":
+		return exportSort{KeyCol: "ts_client", Desc: true}, nil
+	default:
+		return exportSort{}, fmt.Errorf("invalid order=%q (use ingest_desc|ingest_asc|client_desc|client_asc)", order)
+	}
+}
+
+func (db *BoltDB) ListSessions(ctx context.Context, tenantID string, q sessionQuery) ([]SessionInfo, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v\n", ctx, tenantID, q)
+
+	type sessionKey struct{ session, host string }
+	sessions := map[sessionKey]*SessionInfo{}
+	cwds := map[sessionKey]map[string]bool{}
+
+	err := db.DB.View(func(tx *bolt.Tx) error {
+		t, err := boltTenantOf(tx, tenantID, false)
+		if t == nil || err != nil {
+			return err
+		}
+		f := boltFilter{Session: q.Session, Host: q.Host, From: q.From, To: q.To}
+		return f.scan(ctx, t, func(r eventRecord) error {
+			sk := sessionKey{r.SessionID, r.HostFQDN}
+			at := boltEventTime(r)
+			si := sessions[sk]
+			if si == nil {
+				si = &SessionInfo{SessionID: r.SessionID, Host: r.HostFQDN, First: at, Last: at}
+				sessions[sk] = si
+				cwds[sk] = map[string]bool{}
+			}
+			si.Commands++
+			if at.Before(si.First) {
+				si.First = at
+			}
+			if at.After(si.Last) {
+				si.Last = at
+			}
+			if r.CWD != nil {
+				cwds[sk][*r.CWD] = true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]SessionInfo, 0, len(sessions))
+	for sk, si := range sessions {
+		si.Cwds = make([]string, 0, len(cwds[sk]))
+		for cwd := range cwds[sk] {
+			si.Cwds = append(si.Cwds, cwd)
+		}
+		sort.Strings(si.Cwds)
+		out = append(out, *si)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Last.After(out[j].Last) })
+	if q.Limit >= 0 && len(out) > q.Limit {
+		out = out[:q.Limit]
+	}
+	return out, nil
+}
+
+func (db *BoltDB) SessionEvents(ctx context.Context, tenantID, sessionID, host string) ([]SessionEvent, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %s, %s\n", ctx, tenantID, sessionID, host)
+
+	out := []SessionEvent{}
+	err := db.DB.View(func(tx *bolt.Tx) error {
+		t, err := boltTenantOf(tx, tenantID, false)
+		if t == nil || err != nil {
+			return err
+		}
+		return boltFilter{Session: sessionID, Host: host}.scan(ctx, t, func(r eventRecord) error {
+			ev := SessionEvent{Seq: r.Seq, Time: boltEventTime(r), RawLine: r.RawLine}
+			if r.CWD != nil {
+				ev.Cwd = *r.CWD
+			}
+			out = append(out, ev)
+			return nil
+		})
+	})
+	// the index returns them in seq order
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, err
+}
+
+// boltCounts is a group by with count(*).
+type boltCounts map[string]int64
+
+// top is "order by 2 desc, 1 limit n".
+func (c boltCounts) top(n int) []statCount {
+	out := c.sorted()
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Count > out[j].Count })
+	if n >= 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// sorted is "order by 1".
+func (c boltCounts) sorted() []statCount {
+	out := make([]statCount, 0, len(c))
+	for k, n := range c {
+		out = append(out, statCount{Key: k, Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func (db *BoltDB) CommandStats(ctx context.Context, tenantID string, q statsQuery) (CmdStats, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v\n", ctx, tenantID, q)
+
+	var st CmdStats
+	hosts, sessions, hours, days := boltCounts{}, boltCounts{}, boltCounts{}, boltCounts{}
+	commands, full := boltCounts{}, boltCounts{}
+
+	err := db.DB.View(func(tx *bolt.Tx) error {
+		t, err := boltTenantOf(tx, tenantID, false)
+		if t == nil || err != nil {
+			return err
+		}
+		f := boltFilter{Host: q.Host, From: q.From, To: q.To}
+		return f.scan(ctx, t, func(r eventRecord) error {
+			st.Total++
+			if !r.ParseOK {
+				st.ParseFailed++
+			}
+			at := boltEventTime(r)
+			hosts[r.HostFQDN]++
+			sessions[r.SessionID+"@"+r.HostFQDN]++
+			hours[at.Format("15")]++
+			days[at.Format("2006-01-02")]++
+
+			if q.NoCommands || r.Cmd == nil {
+				return nil
+			}
+			// the whitespace folding of the SQL backends
+			words := strings.Fields(*r.Cmd)
+			if len(words) > 0 {
+				commands[words[0]]++
+				full[strings.Join(words, " ")]++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return st, fmt.Errorf("stats: %w", err)
+	}
+
+	if st.Total > 0 {
+		st.ParseFailRate = float64(st.ParseFailed) / float64(st.Total)
+	}
+	st.Sessions = int64(len(sessions))
+	st.TopHosts = hosts.top(q.Top)
+	st.TopSessions = sessions.top(q.Top)
+	st.PerHour = hours.sorted()
+	st.PerDay = days.sorted()
+	if !q.NoCommands {
+		st.TopCommands = commands.top(q.Top)
+		st.TopFull = full.top(q.Top)
+	}
+	return st, nil
+}
+
+// boltTargetSeqs returns the seqs of the events selected by target.
+func boltTargetSeqs(ctx context.Context, t boltTenant, target tagTarget) ([]int64, error) {
+	if target.Seq > 0 {
+		if t["seq"].Get(boltSeqKey(target.Seq)) == nil {
+			return nil, nil
+		}
+		return []int64{target.Seq}, nil
+	}
+	var seqs []int64
+	err := boltFilter{Session: target.Session, Host: target.Host}.scan(ctx, t, func(r eventRecord) error {
+		seqs = append(seqs, r.Seq)
+		return nil
+	})
+	return seqs, err
+}
+
+// changeTags adds or removes tags on the events of target and returns how
+// many tags changed.
+func (db *BoltDB) changeTags(ctx context.Context, tenantID string, target tagTarget, tags []string, remove bool) (int64, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v, %v, %t\n", ctx, tenantID, target, tags, remove)
+
+	var total int64
+	err := db.DB.Update(func(tx *bolt.Tx) error {
+		t, err := boltTenantOf(tx, tenantID, false)
+		if t == nil || err != nil {
+			return err
+		}
+		seqs, err := boltTargetSeqs(ctx, t, target)
+		if err != nil {
+			return err
+		}
+		for _, seq := range seqs {
+			r, _, err := t.get(seq)
+			if err != nil {
+				return err
+			}
+			changed := false
+			for _, tag := range tags {
+				has := slices.Contains(r.Tags, tag)
+				key := boltKey(boltTextKey(tag), boltSeqKey(seq))
+				switch {
+				case remove && has:
+					r.Tags = slices.DeleteFunc(r.Tags, func(s string) bool { return s == tag })
+					err = t["tag"].Delete(key)
+				case !remove && !has:
+					r.Tags = append(r.Tags, tag)
+					err = t["tag"].Put(key, []byte{})
+				default:
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				changed = true
+				total++
+			}
+			if changed {
+				sort.Strings(r.Tags)
+				if err := boltPutJSON(t["seq"], boltSeqKey(seq), r); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return total, err
+}
+
+func (db *BoltDB) TagEvents(ctx context.Context, tenantID string, t tagTarget, tags []string) (int64, error) {
+	return db.changeTags(ctx, tenantID, t, tags, false)
+}
+
+func (db *BoltDB) UntagEvents(ctx context.Context, tenantID string, t tagTarget, tags []string) (int64, error) {
+	return db.changeTags(ctx, tenantID, t, tags, true)
+}
+
+func (db *BoltDB) ListTags(ctx context.Context, tenantID string) ([]TagCount, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s\n", ctx, tenantID)
+
+	counts := boltCounts{}
+	err := db.DB.View(func(tx *bolt.Tx) error {
+		t, err := boltTenantOf(tx, tenantID, false)
+		if t == nil || err != nil {
+			return err
+		}
+		return t["tag"].ForEach(func(k, _ []byte) error {
+			counts[string(k[:bytes.IndexByte(k, 0)])]++
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := []TagCount{}
+	for _, c := range counts.top(-1) {
+		out = append(out, TagCount{Tag: c.Key, Count: c.Count})
+	}
+	return out, nil
+}
+
+func (db *BoltDB) AddNote(ctx context.Context, tenantID string, seq int64, note string) error {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %d, %s\n", ctx, tenantID, seq, note)
+
+	return db.DB.Update(func(tx *bolt.Tx) error {
+		t, err := boltTenantOf(tx, tenantID, false)
+		if t == nil || err != nil {
+			if err == nil {
+				err = errEventNotFound
+			}
+			return err
+		}
+		r, ok, err := t.get(seq)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errEventNotFound
+		}
+		r.Notes = append(r.Notes, noteRecord{Note: note, CreatedAt: time.Now().UTC()})
+		return boltPutJSON(t["seq"], boltSeqKey(seq), r)
+	})
+}
+
+func (db *BoltDB) GetEvent(ctx context.Context, tenantID string, seq int64) (EventDetail, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %d\n", ctx, tenantID, seq)
+
+	ev := EventDetail{Seq: seq, Tags: []string{}, Notes: []EventNote{}}
+	err := db.DB.View(func(tx *bolt.Tx) error {
+		t, err := boltTenantOf(tx, tenantID, false)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			return errEventNotFound
+		}
+		r, ok, err := t.get(seq)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errEventNotFound
+		}
+		ev.RawLine = r.RawLine
+		ev.Tags = append(ev.Tags, r.Tags...)
+		for _, n := range r.Notes {
+			ev.Notes = append(ev.Notes, EventNote{Time: n.CreatedAt, Note: n.Note})
+		}
+		return nil
+	})
+	return ev, err
+}
+
+func (db *BoltDB) ScanEventPayloads(ctx context.Context, tenantID string, fn func(eventPayload) error) error {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s\n", ctx, tenantID)
+
+	return db.ScanEventRecords(ctx, tenantID, 0, func(r eventRecord) error {
+		p := eventPayload{Seq: r.Seq, RawLine: r.RawLine}
+		if r.Cmd != nil {
+			p.Cmd = sql.NullString{String: *r.Cmd, Valid: true}
+		}
+		return fn(p)
+	})
+}
+
+func (db *BoltDB) ListTenants(ctx context.Context) ([]tenantRecord, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v\n", ctx)
+
+	var out []tenantRecord
+	err := db.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTenants).ForEach(func(_, v []byte) error {
+			var t tenantRecord
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			out = append(out, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list tenants: %w", err)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (db *BoltDB) ReadTenantMeta(ctx context.Context, tenantID string) (tenantMeta, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s\n", ctx, tenantID)
+
+	var m tenantMeta
+	err := db.DB.View(func(tx *bolt.Tx) error {
+		t, ok, err := db.tenant(tx, tenantID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("tenant %s not found", tenantID)
+		}
+		m.Tenant = t
+
+		err = tx.Bucket(boltUsers).ForEach(func(_, v []byte) error {
+			var u userRecord
+			if err := json.Unmarshal(v, &u); err != nil {
+				return fmt.Errorf("read users: %w", err)
+			}
+			if u.TenantID == t.ID {
+				m.Users = append(m.Users, u)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltAPIKeys).ForEach(func(_, v []byte) error {
+			var k apiKeyRecord
+			if err := json.Unmarshal(v, &k); err != nil {
+				return fmt.Errorf("read api keys: %w", err)
+			}
+			if k.TenantID == t.ID {
+				m.APIKeys = append(m.APIKeys, k)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return m, err
+	}
+
+	sort.Slice(m.Users, func(i, j int) bool {
+		a, b := m.Users[i], m.Users[j]
+		return a.CreatedAt.Before(b.CreatedAt) || (a.CreatedAt.Equal(b.CreatedAt) && a.ID < b.ID)
+	})
+	sort.Slice(m.APIKeys, func(i, j int) bool {
+		a, b := m.APIKeys[i], m.APIKeys[j]
+		return a.CreatedAt.Before(b.CreatedAt) || (a.CreatedAt.Equal(b.CreatedAt) && a.ID < b.ID)
+	})
+	return m, nil
+}
+
+// WriteTenantMeta stores m, the records already present are kept.
+func (db *BoltDB) WriteTenantMeta(ctx context.Context, m tenantMeta) error {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s\n", ctx, m.Tenant.ID)
+
+	return db.DB.Update(func(tx *bolt.Tx) error {
+		tenants := tx.Bucket(boltTenants)
+		id := []byte(strings.ToLower(m.Tenant.ID))
+		if !boltNamedTenant(tenants.Get(id)) {
+			m.Tenant.ID = string(id)
+			if err := boltPutJSON(tenants, id, m.Tenant); err != nil {
+				return fmt.Errorf("write tenant: %w", err)
+			}
+		}
+		users := tx.Bucket(boltUsers)
+		for _, u := range m.Users {
+			if users.Get([]byte(u.ID)) != nil {
+				continue
+			}
+			if err := boltPutJSON(users, []byte(u.ID), u); err != nil {
+				return fmt.Errorf("write user %s: %w", u.Username, err)
+			}
+		}
+		keys := tx.Bucket(boltAPIKeys)
+		for _, k := range m.APIKeys {
+			if keys.Get([]byte(k.ID)) != nil {
+				continue
+			}
+			if err := boltPutAPIKey(tx, k); err != nil {
+				return fmt.Errorf("write api key %s: %w", k.KeyID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// ScanEventRecords reads copyBatchRows events per transaction, fn runs
+// outside of them.
+func (db *BoltDB) ScanEventRecords(ctx context.Context, tenantID string, afterSeq int64, fn func(eventRecord) error) error {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %d\n", ctx, tenantID, afterSeq)
+
+	for {
+		page := make([]eventRecord, 0, copyBatchRows)
+		err := db.DB.View(func(tx *bolt.Tx) error {
+			t, err := boltTenantOf(tx, tenantID, false)
+			if t == nil || err != nil {
+				return err
+			}
+			return boltWalk(t["seq"], false, boltSeqKey(afterSeq), func(k []byte) (bool, error) {
+				r, _, err := t.get(boltKeySeq(k))
+				if err != nil {
+					return false, fmt.Errorf("read events: %w", err)
+				}
+				page = append(page, r)
+				return len(page) < copyBatchRows, nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		for _, r := range page {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		if len(page) < copyBatchRows {
+			return nil
+		}
+		afterSeq = page[len(page)-1].Seq
+	}
+}
+
+// WriteEventRecords stores recs in one transaction and returns how many
+// were new, the seqs and dedup keys present already are left alone.
+func (db *BoltDB) WriteEventRecords(ctx context.Context, tenantID string, recs []eventRecord) (int, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %d rows\n", ctx, tenantID, len(recs))
+
+	if len(recs) == 0 {
+		return 0, nil
+	}
+	n := 0
+	err := db.DB.Update(func(tx *bolt.Tx) error {
+		t, err := boltTenantOf(tx, tenantID, true)
+		if err != nil {
+			return err
+		}
+		for _, r := range recs {
+			stored, err := t.insert(r)
+			if err != nil {
+				return fmt.Errorf("write events: %w", err)
+			}
+			if stored {
+				n++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
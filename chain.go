@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The hash chain links the events of a tenant in seq order: the hash of an
+// event covers the hash of the previous one, so that an edited, deleted or
+// inserted row breaks the chain. It is computed by the spooler, which
+// assigns the seqs, and stored in cmd_events.chain_hash.
+//
+// The spooler keeps the head of each chain, its last seq and hash, in
+// <spool_dir>/<tenant>.chain and appends the signed checkpoints to
+// <spool_dir>/<tenant>.checkpoints.
+
+// chainGenesis is the previous hash of the first event of a chain.
+const chainGenesis = ""
+
+const checkpointPayloadTag = "hc-chain-checkpoint"
+
+// chainHash returns the hex hash of the event seq of the tenant, line is
+// the raw line as stored, encrypted for crypt tenants, or its spool text.
+// Both hash the same: the line is hashed as it is written to the spool.
+func chainHash(prev, tenantID string, seq int64, line string) string {
+	h := sha256.New()
+	io.WriteString(h, prev+"\n"+tenantID+"\n"+strconv.FormatInt(seq, 10)+"\n")
+	io.WriteString(h, sanitizeUTF8(spoolText(line)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// chainHashArg is the chain_hash column of a row, null when the chain is
+// disabled.
+func chainHashArg(h string) sql.NullString {
+	return sql.NullString{String: h, Valid: h != ""}
+}
+
+// tenantChain is the head of the chain of one tenant, owned by the
+// spooler.
+type tenantChain struct {
+	tenantID  string
+	head      *os.File
+	ckptPath  string
+	seq       int64
+	hash      string
+	unchecked int // chained events since the last checkpoint
+}
+
+// openTenantChain opens the head file of the tenant. A head behind the
+// spool, the spooler stopped between the two writes, is caught up with the
+// spool lines. Without a head file the chain starts at the genesis.
+func openTenantChain(dir, tenantID, spoolPath string) (*tenantChain, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%s, %s, %s\n", dir, tenantID, spoolPath)
+
+	path := filepath.Join(dir, tenantID+".chain")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	c := &tenantChain{
+		tenantID: tenantID,
+		head:     f,
+		ckptPath: filepath.Join(dir, tenantID+".checkpoints"),
+	}
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if len(b) == 0 {
+		debugPrint(log.Printf, levelInfo, "new hash chain for tenant %s\n", tenantID)
+		return c, nil
+	}
+	seqStr, hash, ok := strings.Cut(strings.TrimSpace(string(b)), "\t")
+	if c.seq, err = strconv.ParseInt(seqStr, 10, 64); !ok || err != nil || len(hash) != sha256.Size*2 {
+		f.Close()
+		return nil, fmt.Errorf("chain head %s: bad record", path)
+	}
+	c.hash = hash
+
+	if last, err := readLastSeqFromSpoolTail(spoolPath); err == nil && last > c.seq {
+		if err := c.replay(spoolPath); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("chain head %s: replay: %w", path, err)
+		}
+		debugPrint(log.Printf, levelInfo, "hash chain of tenant %s caught up to seq %d\n", tenantID, c.seq)
+		if err := c.writeHead(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// replay chains the spool lines after the head.
+func (c *tenantChain) replay(spoolPath string) error {
+	sr, err := openSpoolReader(spoolPath)
+	if err != nil {
+		return err
+	}
+	defer sr.close()
+
+	for {
+		if err := sr.next(); err != nil {
+			return err
+		}
+		if !sr.ok {
+			return nil
+		}
+		if sr.seq > c.seq {
+			c.hash = chainHash(c.hash, c.tenantID, sr.seq, sr.line)
+			c.seq = sr.seq
+		}
+	}
+}
+
+// writeHead overwrites the head record, fixed width so that it never
+// leaves a tail.
+func (c *tenantChain) writeHead() error {
+	_, err := c.head.WriteAt([]byte(fmt.Sprintf("%020d\t%s\n", c.seq, c.hash)), 0)
+	return err
+}
+
+// chainSpooled advances the chain of sp over the event seq, once it is in
+// the spool, and writes a checkpoint every ChainCheckpoint events.
+func (s *IngestService) chainSpooled(sp *tenantSpool, seq int64, hash string) {
+	c := sp.chain
+	c.seq, c.hash = seq, hash
+	if err := c.writeHead(); err != nil {
+		debugPrint(log.Printf, levelWarning, "chain head write failed tenant=%s: %v", c.tenantID, err)
+	}
+
+	cfg := s.conf()
+	if cfg.ChainCheckpoint <= 0 || cfg.ChainSigner == nil {
+		return
+	}
+	c.unchecked++
+	if c.unchecked >= cfg.ChainCheckpoint {
+		s.checkpointChain(c)
+	}
+}
+
+// checkpointChain signs the head of c with the server identity key.
+func (s *IngestService) checkpointChain(c *tenantChain) {
+	cp := chainCheckpoint{
+		Tenant: c.tenantID,
+		Seq:    c.seq,
+		Hash:   c.hash,
+		Time:   time.Now().UTC(),
+	}
+	if err := cp.sign(s.conf().ChainSigner); err != nil {
+		debugPrint(log.Printf, levelWarning, "chain checkpoint failed tenant=%s: %v", c.tenantID, err)
+		return
+	}
+	if err := appendCheckpoint(c.ckptPath, cp); err != nil {
+		debugPrint(log.Printf, levelWarning, "chain checkpoint failed tenant=%s: %v", c.tenantID, err)
+		return
+	}
+	debugPrint(log.Printf, levelDebug, "chain checkpoint tenant=%s seq=%d\n", c.tenantID, c.seq)
+	c.unchecked = 0
+}
+
+// closeChain checkpoints the events chained since the last checkpoint and
+// closes the head.
+func (s *IngestService) closeChain(c *tenantChain) {
+	if c.unchecked > 0 && s.conf().ChainSigner != nil {
+		s.checkpointChain(c)
+	}
+	_ = c.head.Sync()
+	_ = c.head.Close()
+}
+
+// chainCheckpoint is one line of the checkpoints file: the chain head at
+// Seq, signed by the server.
+type chainCheckpoint struct {
+	Tenant string    `json:"tenant"`
+	Seq    int64     `json:"seq"`
+	Hash   string    `json:"hash"`
+	Time   time.Time `json:"time"`
+	Sig    []byte    `json:"sig"`
+}
+
+func (cp chainCheckpoint) payload() []byte {
+	return []byte(checkpointPayloadTag + "\n" + cp.Tenant + "\n" + strconv.FormatInt(cp.Seq, 10) + "\n" +
+		cp.Hash + "\n" + cp.Time.UTC().Format(time.RFC3339Nano))
+}
+
+// sign fills Sig. Ed25519 signs the payload, RSA (PKCS#1 v1.5) and ECDSA
+// its SHA-256 digest, what x509.Certificate.CheckSignature verifies.
+func (cp *chainCheckpoint) sign(signer crypto.Signer) error {
+	msg := cp.payload()
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	} else {
+		sum := sha256.Sum256(msg)
+		msg = sum[:]
+	}
+	sig, err := signer.Sign(rand.Reader, msg, opts)
+	if err != nil {
+		return err
+	}
+	cp.Sig = sig
+	return nil
+}
+
+// verify checks Sig with the public key of cert.
+func (cp chainCheckpoint) verify(cert *x509.Certificate) error {
+	var algo x509.SignatureAlgorithm
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		algo = x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		algo = x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		algo = x509.PureEd25519
+	default:
+		return fmt.Errorf("unsupported public key %T", cert.PublicKey)
+	}
+	return cert.CheckSignature(algo, cp.payload(), cp.Sig)
+}
+
+func appendCheckpoint(path string, cp chainCheckpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readCheckpoints returns the checkpoints of path, none when it does not
+// exist.
+func readCheckpoints(path string) ([]chainCheckpoint, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cps []chainCheckpoint
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var cp chainCheckpoint
+		if err := json.Unmarshal(sc.Bytes(), &cp); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, n, err)
+		}
+		cps = append(cps, cp)
+	}
+	return cps, sc.Err()
+}
+
+// chainSigner returns the identity key signing the checkpoints.
+func chainSigner(certFile, keyFile string) (crypto.Signer, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("identity key %T cannot sign", pair.PrivateKey)
+	}
+	return signer, nil
+}
+
+// loadIdentityCert returns the first certificate of certFile, enough to
+// verify the checkpoints without the private key.
+func loadIdentityCert(certFile string) (*x509.Certificate, error) {
+	b, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no certificate", certFile)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// spoolReader reads the records of a spool file in order.
+type spoolReader struct {
+	f    *os.File
+	r    *bufio.Reader
+	ok   bool // seq and line hold a record
+	seq  int64
+	line string
+}
+
+func openSpoolReader(path string) (*spoolReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &spoolReader{f: f, r: bufio.NewReader(f)}, nil
+}
+
+// next reads the following record, ok is false at the end of the file.
+// Malformed lines, a torn last write, are skipped.
+func (sr *spoolReader) next() error {
+	for {
+		s, err := sr.r.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if s == "" && err != nil {
+			sr.ok = false
+			return nil
+		}
+		seqStr, line, found := strings.Cut(strings.TrimRight(s, "\n"), "\t")
+		seq, perr := strconv.ParseInt(seqStr, 10, 64)
+		if found && perr == nil {
+			sr.ok, sr.seq, sr.line = true, seq, line
+			return nil
+		}
+		if err != nil {
+			sr.ok = false
+			return nil
+		}
+	}
+}
+
+func (sr *spoolReader) close() {
+	_ = sr.f.Close()
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const chainCheckListMax = 20
+
+// chainIssue is one finding of the chain check.
+type chainIssue struct {
+	Seq    int64
+	Kind   string // edited, missing, restart, unchained, spool or checkpoint
+	Detail string
+}
+
+// chainReport is the chain check of one tenant.
+type chainReport struct {
+	TenantID    string
+	Rows        int64
+	Chained     int64
+	Unchained   int64 // rows without hash, stored before the chain was enabled
+	Imported    int64 // rows without hash written by hc import, never chained
+	Unverified  int64 // crypt rows and spool lines, no key to decrypt them
+	UnusedSeqs  int64 // seqs never stored, the spool write failed
+	Duplicates  int64 // spool lines dropped by the database as duplicates
+	Gaps        int64 // seqs missing from the chain, without the spool to explain them
+	SpoolAhead  int64 // spool lines after the last row, not stored yet
+	Checkpoints int
+	Problems    int64
+	Issues      []chainIssue // first problems, up to chainCheckListMax
+}
+
+func (r *chainReport) issue(seq int64, kind, format string, args ...any) {
+	r.Problems++
+	if len(r.Issues) < chainCheckListMax {
+		r.Issues = append(r.Issues, chainIssue{Seq: seq, Kind: kind, Detail: fmt.Sprintf(format, args...)})
+	}
+}
+
+// chainCheck walks the rows of a tenant in seq order and recomputes their
+// hashes. The spool, when given, explains the seqs missing from the
+// database and holds the checkpoints.
+type chainCheck struct {
+	r       chainReport
+	crypt   bool
+	key     []byte // crypt tenants, nil without -key
+	prev    string // hash of the event prevSeq
+	prevSeq int64
+	chained bool // prev is set, a chained row was seen
+
+	spool      *spoolReader
+	spoolFirst int64
+	dedupLines map[[sha256.Size]byte]bool // rows with a dedup key
+	cps        map[int64]chainCheckpoint
+}
+
+// plain returns the stored line and command of r, decrypted for the
+// crypt tenants, ok is false without the key.
+func (c *chainCheck) plain(r eventRecord) (line string, cmd *string, ok bool, err error) {
+	if !c.crypt {
+		return r.RawLine, r.Cmd, true, nil
+	}
+	if c.key == nil {
+		return "", nil, false, nil
+	}
+	if line, err = decryptString(r.RawLine, c.key); err != nil {
+		return "", nil, false, err
+	}
+	if r.Cmd != nil {
+		dec, err := decryptString(*r.Cmd, c.key)
+		if err != nil {
+			return "", nil, false, err
+		}
+		cmd = &dec
+	}
+	return line, cmd, true, nil
+}
+
+// spoolPlain returns the clear spool line, ok is false without the key:
+// the spool of a chained crypt tenant holds the stored ciphertext.
+func (c *chainCheck) spoolPlain(line string) (plain string, ok bool) {
+	if !c.crypt {
+		return line, true
+	}
+	if c.key == nil {
+		return "", false
+	}
+	plain, err := decryptString(line, c.key)
+	if err != nil {
+		// spooled in clear text, before the chain was enabled
+		return line, true
+	}
+	return plain, true
+}
+
+// advance moves the chain over the event seq.
+func (c *chainCheck) advance(seq int64, hash string) {
+	c.prev, c.prevSeq, c.chained = hash, seq, true
+	if cp, ok := c.cps[seq]; ok {
+		delete(c.cps, seq)
+		if cp.Hash != hash {
+			c.r.issue(seq, "checkpoint", "chain hash differs from the checkpoint of %s", cp.Time.Format("2006-01-02 15:04:05"))
+		}
+	}
+}
+
+// spoolOnly handles the spool line seq, absent from the database.
+func (c *chainCheck) spoolOnly(seq int64, line string) {
+	plain, ok := c.spoolPlain(line)
+	switch {
+	case !ok:
+		c.r.Unverified++
+	case c.dedupLines[sha256.Sum256([]byte(sanitizeUTF8(plain)))]:
+		c.r.Duplicates++
+	default:
+		c.r.issue(seq, "missing", "in the spool, not in the database")
+	}
+	if c.chained {
+		c.advance(seq, chainHash(c.prev, c.r.TenantID, seq, line))
+	}
+}
+
+// spoolUpTo consumes the spool lines before seq and returns the line of
+// seq, found is false when the spool has none.
+func (c *chainCheck) spoolUpTo(seq int64) (line string, found bool, err error) {
+	for c.spool.ok && c.spool.seq < seq {
+		c.spoolOnly(c.spool.seq, c.spool.line)
+		if err := c.spool.next(); err != nil {
+			return "", false, err
+		}
+	}
+	if !c.spool.ok || c.spool.seq != seq {
+		return "", false, nil
+	}
+	line = c.spool.line
+	return line, true, c.spool.next()
+}
+
+func (c *chainCheck) row(r eventRecord) error {
+	c.r.Rows++
+
+	line, cmd, ok, err := c.plain(r)
+	if err != nil {
+		c.r.issue(r.Seq, "edited", "cannot decrypt: %v", err)
+	}
+	// the line as spooled and chained, the ciphertext for crypt tenants
+	spooled, spooledOK := line, ok
+	if c.crypt && r.ChainHash != nil {
+		spooled, spooledOK = r.RawLine, true
+	}
+
+	if c.spool != nil {
+		spoolLine, found, err := c.spoolUpTo(r.Seq)
+		if err != nil {
+			return err
+		}
+		switch {
+		case found && spooledOK && spoolLine != spoolText(spooled):
+			c.r.issue(r.Seq, "spool", "line differs from the spool")
+		case !found && r.ChainHash != nil && c.spoolFirst > 0 && r.Seq > c.spoolFirst:
+			c.r.issue(r.Seq, "spool", "not in the spool")
+		}
+	}
+	if ok && r.DedupKey != nil {
+		c.dedupLines[sha256.Sum256([]byte(sanitizeUTF8(line)))] = true
+	}
+
+	if r.ChainHash == nil && r.Transport == "import" {
+		c.r.Imported++
+		return nil
+	}
+	if r.ChainHash == nil {
+		c.r.Unchained++
+		if c.chained {
+			c.r.issue(r.Seq, "unchained", "no chain hash after chained rows")
+		}
+		return nil
+	}
+	c.r.Chained++
+	stored := *r.ChainHash
+
+	gap := c.chained && r.Seq != c.prevSeq+1
+	switch {
+	case chainHash(c.prev, c.r.TenantID, r.Seq, spooled) == stored:
+		if gap {
+			c.r.UnusedSeqs += r.Seq - c.prevSeq - 1
+		}
+		if ok {
+			c.checkColumns(r, line, cmd)
+		} else if err == nil {
+			c.r.Unverified++
+		}
+	case gap && c.spool == nil:
+		// a line dropped as a duplicate by the database is chained, only
+		// the spool tells it from a deleted row
+		c.r.Gaps += r.Seq - c.prevSeq - 1
+		if ok {
+			c.checkColumns(r, line, cmd)
+		}
+	case gap && r.Seq == c.prevSeq+2:
+		c.r.issue(r.Seq, "missing", "seq %d deleted or dropped as duplicate", c.prevSeq+1)
+	case gap:
+		c.r.issue(r.Seq, "missing", "seq %d to %d deleted or dropped as duplicates", c.prevSeq+1, r.Seq-1)
+	case chainHash(chainGenesis, c.r.TenantID, r.Seq, spooled) == stored:
+		c.r.issue(r.Seq, "restart", "chain restarted, the chain head of the spool was lost")
+	default:
+		c.r.issue(r.Seq, "edited", "line or chain hash changed")
+	}
+	c.advance(r.Seq, stored)
+	return nil
+}
+
+// checkColumns compares the parsed columns of r with its raw line.
+func (c *chainCheck) checkColumns(r eventRecord, line string, cmd *string) {
+	ev, _ := ParseIngestLine(c.r.TenantID, line)
+	deref := func(p *string) string {
+		if p == nil {
+			return ""
+		}
+		return *p
+	}
+	unix := func(t *time.Time) int64 {
+		if t == nil {
+			return 0
+		}
+		return t.Unix()
+	}
+	if ev.SessionID != r.SessionID || ev.HostFQDN != r.HostFQDN || deref(ev.CWD) != deref(r.CWD) ||
+		deref(ev.Cmd) != deref(cmd) || unix(ev.TSClient) != unix(r.TSClient) {
+		c.r.issue(r.Seq, "edited", "columns differ from the raw line")
+	}
+}
+
+// checkTenantChain verifies the chain of a tenant, against the spool and
+// the checkpoints of spoolDir when not empty.
+func checkTenantChain(ctx context.Context, db DBInterface, cfg *Config, tenantID string, key []byte, spoolDir string) (chainReport, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %s, %s\n", ctx, tenantID, spoolDir)
+
+	c := chainCheck{
+		r:          chainReport{TenantID: tenantID},
+		key:        key,
+		dedupLines: make(map[[sha256.Size]byte]bool),
+	}
+	if t := findTenant(cfg, tenantID); t != nil {
+		c.crypt = t.Crypt
+	}
+
+	if spoolDir != "" {
+		sr, err := openSpoolReader(filepath.Join(spoolDir, tenantID+".log"))
+		if err != nil {
+			return c.r, err
+		}
+		defer sr.close()
+		if err := sr.next(); err != nil {
+			return c.r, err
+		}
+		c.spool, c.spoolFirst = sr, sr.seq
+
+		cps, err := readCheckpoints(filepath.Join(spoolDir, tenantID+".checkpoints"))
+		if err != nil {
+			return c.r, err
+		}
+		if err := c.loadCheckpoints(cfg, cps); err != nil {
+			return c.r, err
+		}
+	}
+
+	if err := db.ScanEventRecords(ctx, tenantID, 0, c.row); err != nil {
+		return c.r, err
+	}
+
+	if c.spool != nil {
+		for c.spool.ok {
+			c.r.SpoolAhead++
+			if c.chained {
+				c.advance(c.spool.seq, chainHash(c.prev, tenantID, c.spool.seq, c.spool.line))
+			}
+			if err := c.spool.next(); err != nil {
+				return c.r, err
+			}
+		}
+	}
+	for seq := range c.cps {
+		c.r.issue(seq, "checkpoint", "checkpointed seq not found")
+	}
+	return c.r, nil
+}
+
+// loadCheckpoints keeps the checkpoints of the tenant whose signature
+// verifies with the identity certificate.
+func (c *chainCheck) loadCheckpoints(cfg *Config, cps []chainCheckpoint) error {
+	c.cps = make(map[int64]chainCheckpoint, len(cps))
+	if len(cps) == 0 {
+		return nil
+	}
+	cert, err := loadIdentityCert(cfg.Globals.Identity.CertFile)
+	if err != nil {
+		return fmt.Errorf("checkpoints: %w", err)
+	}
+	c.r.Checkpoints = len(cps)
+	for _, cp := range cps {
+		if cp.Tenant != c.r.TenantID {
+			c.r.issue(cp.Seq, "checkpoint", "checkpoint of tenant %s", cp.Tenant)
+			continue
+		}
+		if err := cp.verify(cert); err != nil {
+			c.r.issue(cp.Seq, "checkpoint", "bad signature: %v", err)
+			continue
+		}
+		c.cps[cp.Seq] = cp
+	}
+	return nil
+}
+
+// doVerify checks the hash chain of -tenant, default
+// globals.default_tenant_id. It exits 1 when it finds a problem.
+func doVerify(version string, args []string) {
+	debugPrint(log.Printf, levelCrazy, "Args=%s, %v\n", version, args)
+	opts, err := getRuntimeConf(version, args)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	tenantID := opts.Import.Tenant
+	if tenantID == "" {
+		tenantID = opts.Cfg.Globals.DefaultTenantID
+	}
+	var key []byte
+	if opts.VerifyKey != "" {
+		if key, err = base64.StdEncoding.DecodeString(opts.VerifyKey); err != nil {
+			fmt.Fprintln(os.Stderr, "verify: key is not base64")
+			os.Exit(2)
+		}
+	}
+
+	ctx := context.Background()
+	debugPrint(log.Printf, levelDebug, "connecting db\n")
+	db, err := OpenDB(ctx, opts.Cfg.DB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	r, err := checkTenantChain(ctx, db, &opts.Cfg, tenantID, key, opts.VerifySpool)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("tenant %s: %d rows, %d chained, %d unchained, %d imported, %d unverified, %d unused seqs\n",
+		r.TenantID, r.Rows, r.Chained, r.Unchained, r.Imported, r.Unverified, r.UnusedSeqs)
+	if opts.VerifySpool != "" {
+		fmt.Printf("  spool: %d duplicates, %d lines not stored yet, %d checkpoints\n",
+			r.Duplicates, r.SpoolAhead, r.Checkpoints)
+	} else if r.Gaps > 0 {
+		fmt.Printf("  %d seqs missing from the chain, dropped as duplicates or deleted, check with -spool\n", r.Gaps)
+	}
+	for _, is := range r.Issues {
+		fmt.Printf("  seq %d %s: %s\n", is.Seq, is.Kind, is.Detail)
+	}
+	if r.Problems > int64(len(r.Issues)) {
+		fmt.Printf("  ... %d more\n", r.Problems-int64(len(r.Issues)))
+	}
+	if r.Problems > 0 {
+		os.Exit(1)
+	}
+}
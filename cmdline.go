@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"strings"
 
 	"github.com/google/uuid"
 )
@@ -14,6 +15,21 @@ type CommandLine struct {
 	AKUserID     uuid.UUID
 	LogLevel     DebugLevels
 	PrintVersion bool
+	Stats        statsQuery
+	StatsJSON    bool
+	TagTarget    tagTarget
+	Tags         []string
+	TagRemove    bool
+	Note         string
+	ImportFormat string
+	ImportTenant string
+	ImportFrom   string
+	Import       importOptions
+	Args         []string // positional arguments
+	MigrateFrom  string
+	MigrateTo    string
+	VerifyKey    string
+	VerifySpool  string
 }
 
 func ParseCommandLine(args []string) (CommandLine, error) {
@@ -22,6 +38,9 @@ func ParseCommandLine(args []string) (CommandLine, error) {
 		lL           string
 		tmpSTenantID string
 		tmpSUserID   string
+		tmpFrom      string
+		tmpTo        string
+		tmpTags      string
 		err          error
 	)
 
@@ -31,14 +50,50 @@ func ParseCommandLine(args []string) (CommandLine, error) {
 	fs.StringVar(&lL, "loglevel", "info", "Log level (e.g. debug, info, warn, error).")
 
 	fs.StringVar(&cl.HistoryFile, "historyFile", "", "Specifis the file to import (import switch only, ignored elsewhere)")
+	fs.StringVar(&cl.ImportFormat, "format", histFormatAuto, "History format: auto, hc, bash, zsh or fish (import switch only, ignored elsewhere)")
+	fs.StringVar(&cl.ImportTenant, "tenant", "", "Tenant id, default globals.default_tenant_id for import, backup and verify, every crypt tenant for verify_crypt (import, backup, restore, verify and verify_crypt switches only, ignored elsewhere)")
+	fs.BoolVar(&cl.Import.DryRun, "dry-run", false, "Parse only and print statistics per line kind (import switch only, ignored elsewhere)")
+	fs.StringVar(&cl.Import.OnError, "on-error", importOnErrorAbort, "Entry that cannot be stored: abort or skip (import switch only, ignored elsewhere)")
+	fs.StringVar(&cl.Import.Checkpoint, "checkpoint", "", "Checkpoint file, written after every chunk and resumed from when it exists (import switch only, ignored elsewhere)")
 	fs.StringVar(&tmpSTenantID, "api_tenantid", "", "Specifis the tenantid for the api key (api_key switch only, ignored elsewhere)")
 	fs.StringVar(&tmpSUserID, "api_userid", "", "Specifis the file to import (api_key switch only, ignored elsewhere)")
 
+	fs.StringVar(&cl.Stats.Host, "host", "", "Restrict to one host, or the host of the imported commands (stats, tag and import switches only, ignored elsewhere)")
+	fs.StringVar(&tmpFrom, "from", "", "Start of the time range, RFC3339 or YYYY-MM-DD (stats switch only, ignored elsewhere)")
+	fs.StringVar(&tmpTo, "to", "", "End of the time range, excluded (stats switch only, ignored elsewhere)")
+	fs.StringVar(&cl.ImportFrom, "tool", "", "Tool database to import: atuin or mcfly (import switch only, ignored elsewhere)")
+	fs.StringVar(&cl.MigrateFrom, "src", "", "Source dsn (migrate-data switch only, ignored elsewhere)")
+	fs.StringVar(&cl.MigrateTo, "dst", "", "Target dsn (migrate-data switch only, ignored elsewhere)")
+	fs.IntVar(&cl.Stats.Top, "top", statsDefaultTop, "Entries in each top list (stats switch only, ignored elsewhere)")
+	fs.BoolVar(&cl.StatsJSON, "json", false, "Print json instead of text (stats switch only, ignored elsewhere)")
+
+	fs.Int64Var(&cl.TagTarget.Seq, "seq", 0, "Event sequence number (tag and note switches only, ignored elsewhere)")
+	fs.StringVar(&cl.TagTarget.Session, "session", "", "Session id (tag and import switches only, ignored elsewhere)")
+	fs.StringVar(&tmpTags, "tags", "", "Comma separated tags (tag switch only, ignored elsewhere)")
+	fs.BoolVar(&cl.TagRemove, "remove", false, "Remove the tags instead of adding them (tag switch only, ignored elsewhere)")
+	fs.StringVar(&cl.Note, "note", "", "Note text (note switch only, ignored elsewhere)")
+	fs.StringVar(&cl.VerifyKey, "key", "", "Base64 private key of a crypt tenant, to verify its lines (verify switch only, ignored elsewhere)")
+	fs.StringVar(&cl.VerifySpool, "spool", "", "Spool directory to compare with the database, and read the checkpoints from (verify switch only, ignored elsewhere)")
+
 	fs.BoolVar(&cl.PrintVersion, "version", false, "Print version and exit.")
 
 	if err = fs.Parse(args); err != nil {
 		return CommandLine{}, err
 	}
+	cl.Args = fs.Args()
+	if cl.HistoryFile == "" && fs.NArg() > 0 {
+		cl.HistoryFile = fs.Arg(0)
+	}
+	switch cl.ImportFormat {
+	case histFormatAuto, histFormatHC, histFormatBash, histFormatZsh, histFormatFish:
+	default:
+		return CommandLine{}, fmt.Errorf("import: unknown format %q", cl.ImportFormat)
+	}
+	switch cl.Import.OnError {
+	case importOnErrorAbort, importOnErrorSkip:
+	default:
+		return CommandLine{}, fmt.Errorf("import: on-error must be abort or skip, not %q", cl.Import.OnError)
+	}
 
 	if tmpSTenantID != "" {
 		cl.AKTenantID, err = uuid.Parse(tmpSTenantID)
@@ -54,6 +109,31 @@ func ParseCommandLine(args []string) (CommandLine, error) {
 		}
 	}
 
+	cl.TagTarget.Host = cl.Stats.Host
+	cl.TagTarget.Session = strings.ToLower(strings.TrimSpace(cl.TagTarget.Session))
+	if tmpTags != "" {
+		cl.Tags = strings.Split(tmpTags, ",")
+	}
+
+	switch cl.ImportFrom {
+	case "", histSourceAtuin, histSourceMcfly:
+	default:
+		return CommandLine{}, fmt.Errorf("import: tool must be atuin or mcfly, not %q", cl.ImportFrom)
+	}
+	if tmpFrom != "" {
+		if cl.Stats.From, err = parseTimeParam(tmpFrom); err != nil {
+			return CommandLine{}, fmt.Errorf("stats: invalid from: %w", err)
+		}
+	}
+	if tmpTo != "" {
+		if cl.Stats.To, err = parseTimeParam(tmpTo); err != nil {
+			return CommandLine{}, fmt.Errorf("stats: invalid to: %w", err)
+		}
+	}
+	if cl.Stats.Top <= 0 || cl.Stats.Top > statsMaxTop {
+		return CommandLine{}, fmt.Errorf("stats: top must be in 1..%d", statsMaxTop)
+	}
+
 	l, err := DebugLevelFromString(lL)
 	if err != nil {
 		return CommandLine{}, err
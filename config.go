@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"regexp"
 	"strings"
 
 	"github.com/google/uuid"
@@ -24,6 +25,14 @@ type ServerConfig struct {
 	IngestTLS   ListenerConfig `json:"ingest_tls"`
 	HTTP        HTTPConfig     `json:"http"`
 	HTTPS       HTTPConfig     `json:"https"`
+	Metrics     MetricsConfig  `json:"metrics"`
+}
+
+// MetricsConfig exposes /metrics, on its own listener when Addr is set,
+// otherwise on the HTTP(S) export listeners.
+type MetricsConfig struct {
+	Enabled bool   `json:"enabled"`
+	Addr    string `json:"addr"`
 }
 
 type ListenerConfig struct {
@@ -55,8 +64,17 @@ func (a AuthMode) Valid() bool {
 	}
 }
 
+// DBConfig selects the backend: Driver, else the URL scheme of DSN
+// (postgres://, sqlite://, mysql://, bolt://), else a guess from DSN. The pool
+// settings are 0 for the defaults.
 type DBConfig struct {
-	DSN string `json:"dsn"`
+	Driver                 string `json:"driver"`
+	DSN                    string `json:"dsn"`
+	MaxOpenConns           int    `json:"max_open_conns"`            // default 10
+	MaxIdleConns           int    `json:"max_idle_conns"`            // default 5
+	ConnMaxLifetimeSeconds int    `json:"conn_max_lifetime_seconds"` // default 1800
+	SQLiteWAL              bool   `json:"sqlite_wal"`                // journal_mode=WAL
+	SQLiteBusyTimeoutMS    int    `json:"sqlite_busy_timeout_ms"`    // default of the driver, 5000
 }
 
 type ACL struct {
@@ -71,21 +89,108 @@ type ACLRule struct {
 }
 
 type Tenant struct {
-	TenantID   string `json:"tenantID"`
-	TenantName string `json:"tenant_name"`
-	ACL        string `json:"acl"`
-	PubKey     string `json:"pub_key"`
-	Crypt      bool   `json:"crypt"`
+	TenantID   string        `json:"tenantID"`
+	TenantName string        `json:"tenant_name"`
+	ACL        string        `json:"acl"`
+	PubKey     string        `json:"pub_key"`
+	Crypt      bool          `json:"crypt"`
+	AutoTags   []AutoTagRule `json:"auto_tags"`
+	Redact     RedactConfig  `json:"redact"`
+	Filters    []FilterRule  `json:"filters"`
+	Limits     TenantLimits  `json:"limits"`
+}
+
+// TenantLimits overrides the globals.limits tenant values: 0 inherits the
+// global value, a negative value removes the limit.
+type TenantLimits struct {
+	Rate      float64 `json:"rate"`
+	Burst     int     `json:"burst"`
+	DailyRows int64   `json:"daily_rows"`
+}
+
+// FilterRule drops, or samples, the ingested lines matching every set
+// criterion. Cmd, Host and Cwd are regexes, SrcCIDR the sender address.
+type FilterRule struct {
+	Name    string `json:"name"`
+	Cmd     string `json:"cmd"`
+	Host    string `json:"host"`
+	Cwd     string `json:"cwd"`
+	SrcCIDR string `json:"src_cidr"`
+	Action  string `json:"action"` // "drop" / "sample"
+	Sample  int    `json:"sample"` // sample: keep one line every Sample
+}
+
+// RedactConfig selects the secret detectors applied before spooling:
+// built-in ones by name ("all" enables every one) plus custom regexes.
+type RedactConfig struct {
+	Builtin []string     `json:"builtin"`
+	Rules   []RedactRule `json:"rules"`
+}
+
+// RedactRule masks the capture groups of Match, or the whole match when
+// it has no groups.
+type RedactRule struct {
+	Name  string `json:"name"`
+	Match string `json:"match"`
+}
+
+// DedupConfig enables duplicate suppression at ingestion. Lines carrying
+// the same client event id, or the same timestamp (truncated to
+// WindowSeconds), session, host and command are stored once.
+type DedupConfig struct {
+	Enabled       bool `json:"enabled"`
+	WindowSeconds int  `json:"window_seconds"` // default 1
+	CacheSeconds  int  `json:"cache_seconds"`  // in memory keys lifetime, default 600
+}
+
+// LimitsConfig bounds the ingestion load. A zero value disables the limit.
+type LimitsConfig struct {
+	SourceRate      float64 `json:"source_rate"`  // lines per second per source IP
+	SourceBurst     int     `json:"source_burst"` // default: rate rounded up
+	SourceConns     int     `json:"source_conns"` // concurrent connections per source IP
+	MaxConns        int     `json:"max_conns"`    // concurrent connections, all listeners
+	TenantRate      float64 `json:"tenant_rate"`  // lines per second per tenant
+	TenantBurst     int     `json:"tenant_burst"`
+	TenantDailyRows int64   `json:"tenant_daily_rows"` // accepted lines per tenant and UTC day
+}
+
+// DBBatchConfig groups the ingested rows in one transaction per batch of
+// up to Size rows, or what arrived within WaitMS. Size 1 disables it.
+type DBBatchConfig struct {
+	Size   int `json:"size"`    // default 100, at most 1000
+	WaitMS int `json:"wait_ms"` // default 10
+}
+
+// ChainConfig enables the hash chain over the events of each tenant, see
+// chain.go. CheckpointEvery > 0 signs the chain head with the identity key
+// every CheckpointEvery events and at shutdown.
+type ChainConfig struct {
+	Enabled         bool `json:"enabled"`
+	CheckpointEvery int  `json:"checkpoint_every"`
+}
+
+// AutoTagRule tags at ingestion the commands matching Match.
+type AutoTagRule struct {
+	Tag   string `json:"tag"`
+	Match string `json:"match"`
 }
 
 type Globals struct {
-	Identity        Identity `json:"identity"`
-	MaxLineBytes    int      `json:"max_line_bytes"`
-	MaxRows         int      `json:"max_rows"`
-	ClientCert      string   `json:"client_cert"`
-	DefaultTenantID string   `json:"default_tenant_id"`
-	MaxSeconds      int      `json:"max_seconds"`
-	Pepper          string   `json:"apikey_pepper"`
+	Identity        Identity      `json:"identity"`
+	MaxLineBytes    int           `json:"max_line_bytes"`
+	MaxRows         int           `json:"max_rows"`
+	ClientCert      string        `json:"client_cert"`
+	DefaultTenantID string        `json:"default_tenant_id"`
+	MaxSeconds      int           `json:"max_seconds"`
+	Pepper          string        `json:"apikey_pepper"`
+	AutoTags        []AutoTagRule `json:"auto_tags"`
+	Redact          RedactConfig  `json:"redact"`
+	Dedup           DedupConfig   `json:"dedup"`
+	Limits          LimitsConfig  `json:"limits"`
+	ReadyMaxDBLag   int64         `json:"ready_max_db_lag"` // /readyz fails above, 0 = report only
+	ShutdownSeconds int           `json:"shutdown_seconds"` // drain deadline on SIGINT/SIGTERM, default 10
+	DBBatch         DBBatchConfig `json:"db_batch"`
+	Chain           ChainConfig   `json:"chain"`
 }
 
 type Identity struct {
@@ -156,6 +261,33 @@ func (c Config) validate() error {
 	if c.Globals.DefaultTenantID == "" {
 		return errors.New("globals.identity.DefaultTenantID is required")
 	}
+	if err := validateAutoTags("globals.auto_tags", c.Globals.AutoTags); err != nil {
+		return err
+	}
+	if err := validateRedact("globals.redact", c.Globals.Redact); err != nil {
+		return err
+	}
+	if c.Globals.Dedup.WindowSeconds < 0 {
+		return errors.New("globals.dedup.window_seconds must be >= 0")
+	}
+	if c.Globals.Dedup.CacheSeconds < 0 {
+		return errors.New("globals.dedup.cache_seconds must be >= 0")
+	}
+	if c.Globals.ReadyMaxDBLag < 0 {
+		return errors.New("globals.ready_max_db_lag must be >= 0")
+	}
+	if c.Globals.ShutdownSeconds < 0 {
+		return errors.New("globals.shutdown_seconds must be >= 0")
+	}
+	if b := c.Globals.DBBatch; b.Size < 0 || b.Size > dbBatchMaxSize || b.WaitMS < 0 {
+		return fmt.Errorf("globals.db_batch: size must be 0..%d, wait_ms >= 0", dbBatchMaxSize)
+	}
+	if c.Globals.Chain.CheckpointEvery < 0 {
+		return errors.New("globals.chain.checkpoint_every must be >= 0")
+	}
+	if err := validateLimits(c.Globals.Limits); err != nil {
+		return err
+	}
 
 	// Build maps for cross-reference checks
 	tenantIDs := make(map[string]struct{}, len(c.Tenants))
@@ -173,6 +305,18 @@ func (c Config) validate() error {
 		if t.ACL == "" {
 			return fmt.Errorf("tenants[%d].acl is required", i)
 		}
+		if err := validateAutoTags(fmt.Sprintf("tenants[%d].auto_tags", i), t.AutoTags); err != nil {
+			return err
+		}
+		if err := validateRedact(fmt.Sprintf("tenants[%d].redact", i), t.Redact); err != nil {
+			return err
+		}
+		if err := validateFilters(fmt.Sprintf("tenants[%d].filters", i), t.Filters); err != nil {
+			return err
+		}
+		if t.Limits.Burst < 0 {
+			return fmt.Errorf("tenants[%d].limits.burst must be >= 0", i)
+		}
 	}
 	if len(c.Tenants) == 0 {
 		return errors.New("tenants must not be empty")
@@ -226,6 +370,12 @@ func (c Config) validate() error {
 	if strings.TrimSpace(c.DB.DSN) == "" {
 		return errors.New("db.dsn is required")
 	}
+	if _, _, _, err := resolveDBDriver(c.DB); err != nil {
+		return err
+	}
+	if c.DB.MaxOpenConns < 0 || c.DB.MaxIdleConns < 0 || c.DB.ConnMaxLifetimeSeconds < 0 || c.DB.SQLiteBusyTimeoutMS < 0 {
+		return errors.New("db: pool settings must be >= 0")
+	}
 
 	return nil
 }
@@ -259,6 +409,90 @@ func validateServerCommon(name string, l CommonConfig, tenantIDs map[string]stru
 	return nil
 }
 
+func validateAutoTags(name string, rules []AutoTagRule) error {
+	for i, r := range rules {
+		if !reTag.MatchString(r.Tag) {
+			return fmt.Errorf("%s[%d].tag invalid: %q", name, i, r.Tag)
+		}
+		if _, err := regexp.Compile(r.Match); err != nil {
+			return fmt.Errorf("%s[%d].match invalid: %v", name, i, err)
+		}
+	}
+	return nil
+}
+
+func validateRedact(name string, rc RedactConfig) error {
+	for i, b := range rc.Builtin {
+		if b == "all" && len(rc.Builtin) == 1 {
+			continue
+		}
+		if _, ok := builtinRedactors[b]; !ok {
+			return fmt.Errorf("%s.builtin[%d] unknown: %q (allowed: all|%s)", name, i, b, strings.Join(builtinRedactorNames(), "|"))
+		}
+	}
+	for i, r := range rc.Rules {
+		if strings.TrimSpace(r.Name) == "" {
+			return fmt.Errorf("%s.rules[%d].name is required", name, i)
+		}
+		if _, err := regexp.Compile(r.Match); err != nil {
+			return fmt.Errorf("%s.rules[%d].match invalid: %v", name, i, err)
+		}
+	}
+	return nil
+}
+
+func validateFilters(name string, rules []FilterRule) error {
+	names := make(map[string]struct{}, len(rules))
+	for i, r := range rules {
+		if strings.TrimSpace(r.Name) == "" {
+			return fmt.Errorf("%s[%d].name is required", name, i)
+		}
+		if _, dup := names[r.Name]; dup {
+			return fmt.Errorf("%s[%d] duplicate name %q", name, i, r.Name)
+		}
+		names[r.Name] = struct{}{}
+		if r.Cmd == "" && r.Host == "" && r.Cwd == "" && r.SrcCIDR == "" {
+			return fmt.Errorf("%s[%d] needs at least one of cmd, host, cwd, src_cidr", name, i)
+		}
+		for field, expr := range map[string]string{"cmd": r.Cmd, "host": r.Host, "cwd": r.Cwd} {
+			if _, err := regexp.Compile(expr); err != nil {
+				return fmt.Errorf("%s[%d].%s invalid: %v", name, i, field, err)
+			}
+		}
+		if r.SrcCIDR != "" {
+			if _, _, err := net.ParseCIDR(r.SrcCIDR); err != nil {
+				return fmt.Errorf("%s[%d].src_cidr invalid (%q): %v", name, i, r.SrcCIDR, err)
+			}
+		}
+		switch r.Action {
+		case "drop":
+		case "sample":
+			if r.Sample < 2 {
+				return fmt.Errorf("%s[%d].sample must be >= 2 with action sample", name, i)
+			}
+		default:
+			return fmt.Errorf("%s[%d].action must be drop|sample, got %q", name, i, r.Action)
+		}
+	}
+	return nil
+}
+
+func validateLimits(l LimitsConfig) error {
+	if l.SourceRate < 0 || l.TenantRate < 0 {
+		return errors.New("globals.limits rates must be >= 0")
+	}
+	if l.SourceBurst < 0 || l.TenantBurst < 0 {
+		return errors.New("globals.limits bursts must be >= 0")
+	}
+	if l.SourceConns < 0 || l.MaxConns < 0 {
+		return errors.New("globals.limits connection caps must be >= 0")
+	}
+	if l.TenantDailyRows < 0 {
+		return errors.New("globals.limits.tenant_daily_rows must be >= 0")
+	}
+	return nil
+}
+
 func isValidUUID(u string) bool {
 	_, err := uuid.Parse(u)
 	return err == nil
@@ -78,6 +78,35 @@ CREATE TABLE public.cmd_event_tags (
 
 ALTER TABLE public.cmd_event_tags OWNER TO hc;
 
+--
+-- Name: cmd_event_notes; Type: TABLE; Schema: public; Owner: hc
+--
+
+CREATE TABLE public.cmd_event_notes (
+    id bigint NOT NULL,
+    tenant_id uuid NOT NULL,
+    event_id bigint NOT NULL,
+    note text NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.cmd_event_notes OWNER TO hc;
+
+--
+-- Name: cmd_event_notes_id_seq; Type: SEQUENCE; Schema: public; Owner: hc
+--
+
+ALTER TABLE public.cmd_event_notes ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.cmd_event_notes_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
 --
 -- Name: cmd_events; Type: TABLE; Schema: public; Owner: hc
 --
@@ -95,7 +124,9 @@ CREATE TABLE public.cmd_events (
     src_ip inet,
     transport text DEFAULT 'tcp-clear'::text NOT NULL,
     parse_ok boolean DEFAULT true NOT NULL,
-    raw_line text NOT NULL
+    raw_line text NOT NULL,
+    dedup_key text,
+    chain_hash text
 );
 
 
@@ -160,6 +191,14 @@ ALTER TABLE ONLY public.app_users
     ADD CONSTRAINT app_users_tenant_id_username_key UNIQUE (tenant_id, username);
 
 
+--
+-- Name: cmd_event_notes cmd_event_notes_pkey; Type: CONSTRAINT; Schema: public; Owner: hc
+--
+
+ALTER TABLE ONLY public.cmd_event_notes
+    ADD CONSTRAINT cmd_event_notes_pkey PRIMARY KEY (id);
+
+
 --
 -- Name: cmd_event_tags cmd_event_tags_pkey; Type: CONSTRAINT; Schema: public; Owner: hc
 --
@@ -208,6 +247,13 @@ ALTER TABLE ONLY public.tenants
     ADD CONSTRAINT tenants_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: cmd_event_notes_event_id_idx; Type: INDEX; Schema: public; Owner: hc
+--
+
+CREATE INDEX cmd_event_notes_event_id_idx ON public.cmd_event_notes USING btree (event_id);
+
+
 --
 -- Name: cmd_events_cmd_trgm; Type: INDEX; Schema: public; Owner: hc
 --
@@ -229,6 +275,13 @@ CREATE INDEX cmd_events_raw_trgm ON public.cmd_events USING gin (raw_line public
 CREATE INDEX cmd_events_tenant_id_id_desc ON public.cmd_events USING btree (tenant_id, id DESC);
 
 
+--
+-- Name: cmd_events_tenant_id_dedup_key; Type: INDEX; Schema: public; Owner: hc
+--
+
+CREATE UNIQUE INDEX cmd_events_tenant_id_dedup_key ON public.cmd_events USING btree (tenant_id, dedup_key) WHERE (dedup_key IS NOT NULL);
+
+
 --
 -- Name: api_keys api_keys_tenant_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: hc
 --
@@ -253,6 +306,22 @@ ALTER TABLE ONLY public.app_users
     ADD CONSTRAINT app_users_tenant_id_fkey FOREIGN KEY (tenant_id) REFERENCES public.tenants(id);
 
 
+--
+-- Name: cmd_event_notes cmd_event_notes_event_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: hc
+--
+
+ALTER TABLE ONLY public.cmd_event_notes
+    ADD CONSTRAINT cmd_event_notes_event_id_fkey FOREIGN KEY (event_id) REFERENCES public.cmd_events(id) ON DELETE CASCADE;
+
+
+--
+-- Name: cmd_event_notes cmd_event_notes_tenant_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: hc
+--
+
+ALTER TABLE ONLY public.cmd_event_notes
+    ADD CONSTRAINT cmd_event_notes_tenant_id_fkey FOREIGN KEY (tenant_id) REFERENCES public.tenants(id);
+
+
 --
 -- Name: cmd_event_tags cmd_event_tags_event_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: hc
 --
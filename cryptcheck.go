@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+)
+
+const cryptCheckListMax = 20
+
+// eventPayload is what the crypt check reads of a row.
+type eventPayload struct {
+	Seq     int64
+	RawLine string
+	Cmd     sql.NullString
+}
+
+// scanEventPayloads calls fn for every row of the tenant in seq order,
+// shared by the SQL backends.
+func scanEventPayloads(ctx context.Context, db *sql.DB, ph func(int) string, tenantID string, fn func(eventPayload) error) error {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s\n", ctx, tenantID)
+
+	rows, err := db.QueryContext(ctx, `
+		select seq, raw_line, cmd
+		from cmd_events
+		where tenant_id = `+ph(1)+`
+		order by seq`, tenantID)
+	if err != nil {
+		return fmt.Errorf("scan events: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p eventPayload
+		if err := rows.Scan(&p.Seq, &p.RawLine, &p.Cmd); err != nil {
+			return fmt.Errorf("scan events: %w", err)
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// cryptReport is the crypt check of one tenant.
+type cryptReport struct {
+	TenantID  string
+	Rows      int64
+	Plaintext int64
+	Seqs      []int64 // first plaintext rows, up to cryptCheckListMax
+}
+
+// checkTenantCrypt reports the rows of a crypt tenant whose line or
+// command is not encrypted.
+func checkTenantCrypt(ctx context.Context, db DBInterface, tenantID string) (cryptReport, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %s\n", ctx, tenantID)
+
+	r := cryptReport{TenantID: tenantID}
+	err := db.ScanEventPayloads(ctx, tenantID, func(p eventPayload) error {
+		r.Rows++
+		if looksEncrypted(p.RawLine) && (!p.Cmd.Valid || looksEncrypted(p.Cmd.String)) {
+			return nil
+		}
+		r.Plaintext++
+		if len(r.Seqs) < cryptCheckListMax {
+			r.Seqs = append(r.Seqs, p.Seq)
+		}
+		return nil
+	})
+	return r, err
+}
+
+// doVerifyCrypt checks the crypt tenants, -tenant or all configured,
+// for plaintext rows. It exits 1 when it finds some.
+func doVerifyCrypt(version string, args []string) {
+	debugPrint(log.Printf, levelCrazy, "Args=%s, %v\n", version, args)
+	opts, err := getRuntimeConf(version, args)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	var tenants []string
+	for _, t := range opts.Cfg.Tenants {
+		if t.Crypt && (opts.Import.Tenant == "" || t.TenantID == opts.Import.Tenant) {
+			tenants = append(tenants, t.TenantID)
+		}
+	}
+	if len(tenants) == 0 {
+		fmt.Fprintln(os.Stderr, "no crypt tenant to verify")
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	debugPrint(log.Printf, levelDebug, "connecting db\n")
+	db, err := OpenDB(ctx, opts.Cfg.DB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	found := false
+	for _, tenantID := range tenants {
+		r, err := checkTenantCrypt(ctx, db, tenantID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("tenant %s: %d rows, %d plaintext\n", r.TenantID, r.Rows, r.Plaintext)
+		for _, seq := range r.Seqs {
+			fmt.Printf("  seq %d\n", seq)
+		}
+		if r.Plaintext > int64(len(r.Seqs)) {
+			fmt.Printf("  ... %d more\n", r.Plaintext-int64(len(r.Seqs)))
+		}
+		found = found || r.Plaintext > 0
+	}
+	if found {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// exportCursor is the position of a row in an export result. It is handed
+// to clients base64 encoded and must be treated as opaque by them.
+type exportCursor struct {
+	Order string  `json:"o"`
+	Key   *string `json:"k,omitempty"` // sort column as text, nil for NULL
+	ID    int64   `json:"i"`
+}
+
+// exportSort describes how a backend orders an export: by an optional
+// (nullable) key column, then by id as tie breaker.
+type exportSort struct {
+	KeyCol     string // "" means the order is by id only
+	KeySelect  string // expression returning KeyCol as text
+	KeyBind    string // format applied to the placeholder when comparing KeyCol
+	Desc       bool
+	NullsFirst bool
+}
+
+type exportPage struct {
+	Lines []string
+	First *exportCursor
+	Last  *exportCursor
+}
+
+func encodeExportCursor(c exportCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeExportCursor(s string) (exportCursor, error) {
+	var c exportCursor
+
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	if c.Order == "" || c.ID <= 0 {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+func (s exportSort) reversed() exportSort {
+	s.Desc = !s.Desc
+	s.NullsFirst = !s.NullsFirst
+	return s
+}
+
+func (s exportSort) orderBy() string {
+	dir := "asc"
+	if s.Desc {
+		dir = "desc"
+	}
+	if s.KeyCol == "" {
+		return "id " + dir
+	}
+	nulls := "nulls last"
+	if s.NullsFirst {
+		nulls = "nulls first"
+	}
+	return s.KeyCol + " " + dir + " " + nulls + ", id " + dir
+}
+
+func (s exportSort) keySelect() string {
+	if s.KeyCol == "" {
+		return "null"
+	}
+	return s.KeySelect
+}
+
+// after returns the keyset predicate selecting the rows that follow c in
+// this order. bind registers an argument and returns its placeholder.
+func (s exportSort) after(c exportCursor, bind func(any) string) string {
+	cmp := ">"
+	if s.Desc {
+		cmp = "<"
+	}
+	// Placeholders are bound in textual order, sqlite "?" are positional.
+	if s.KeyCol == "" {
+		return "id " + cmp + " " + bind(c.ID)
+	}
+
+	if c.Key == nil {
+		// Cursor sits among the NULL keys; non NULL keys follow only
+		// when NULLs are sorted first.
+		cond := "(" + s.KeyCol + " is null and id " + cmp + " " + bind(c.ID) + ")"
+		if s.NullsFirst {
+			cond = "(" + cond + " or " + s.KeyCol + " is not null)"
+		}
+		return cond
+	}
+
+	k := fmt.Sprintf(s.KeyBind, bind(*c.Key))
+	k2 := fmt.Sprintf(s.KeyBind, bind(*c.Key))
+	id := bind(c.ID)
+	cond := "(" + s.KeyCol + " " + cmp + " " + k + " or (" + s.KeyCol + " = " + k2 + " and id " + cmp + " " + id + "))"
+	if !s.NullsFirst {
+		cond = "(" + cond + " or " + s.KeyCol + " is null)"
+	}
+	return cond
+}
+
+// exportKeyset resolves the cursors of q against the backend sort. It
+// returns the sort to use in SQL, the keyset predicate (may be empty) and
+// whether the rows come back reversed and must be flipped by the caller.
+func exportKeyset(q exportQuery, sort exportSort, bind func(any) string) (exportSort, string, bool, error) {
+	switch {
+	case q.After != nil:
+		if q.After.Order != q.Order {
+			return sort, "", false, fmt.Errorf("cursor was issued for order=%s", q.After.Order)
+		}
+		return sort, sort.after(*q.After, bind), false, nil
+	case q.Before != nil:
+		if q.Before.Order != q.Order {
+			return sort, "", false, fmt.Errorf("cursor was issued for order=%s", q.Before.Order)
+		}
+		rev := sort.reversed()
+		return rev, rev.after(*q.Before, bind), true, nil
+	default:
+		return sort, "", false, nil
+	}
+}
+
+func newExportCursor(order string, key *string, id int64) *exportCursor {
+	return &exportCursor{Order: order, Key: key, ID: id}
+}
+
+func reverseStrings(s []string) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
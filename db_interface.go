@@ -5,7 +5,7 @@ import (
 	"database/sql"
 	"github.com/google/uuid"
 	"strings"
-	"log"
+	"time"
 )
 
 type APIKeyRecord struct {
@@ -16,28 +16,36 @@ type APIKeyRecord struct {
 
 type DBInterface interface {
 	EnsureSchema(ctx context.Context) error
+	UpgradeSchema(ctx context.Context) error
 	EnsureTenant(ctx context.Context, tenantID, name string) error
 	GetTenantName(ctx context.Context, tenantID string) (string, bool, error)
-	ImportHistoryFile(ctx context.Context, tenantID, path string) (inserted int, skipped int, err error)
 	MaxSeq(ctx context.Context, tenantID string) (int64, error)
 	InsertEventWithSeq(ctx context.Context, ev Event, seq int64) error
+	InsertEventBatch(ctx context.Context, batch []seqEvent) ([]bool, error)
 	lookupTenantByUsername(username string) (string, bool)
-	ExportLines(ctx context.Context, tenantID string, q exportQuery) ([]string, error)
+	ExportLines(ctx context.Context, tenantID string, q exportQuery) (exportPage, error)
+	ListSessions(ctx context.Context, tenantID string, q sessionQuery) ([]SessionInfo, error)
+	SessionEvents(ctx context.Context, tenantID, sessionID, host string) ([]SessionEvent, error)
+	CommandStats(ctx context.Context, tenantID string, q statsQuery) (CmdStats, error)
+	TagEvents(ctx context.Context, tenantID string, t tagTarget, tags []string) (int64, error)
+	UntagEvents(ctx context.Context, tenantID string, t tagTarget, tags []string) (int64, error)
+	ListTags(ctx context.Context, tenantID string) ([]TagCount, error)
+	AddNote(ctx context.Context, tenantID string, seq int64, note string) error
+	GetEvent(ctx context.Context, tenantID string, seq int64) (EventDetail, error)
+	CountEventsSince(ctx context.Context, tenantID string, since time.Time) (int64, error)
+	ScanEventPayloads(ctx context.Context, tenantID string, fn func(eventPayload) error) error
+	ListTenants(ctx context.Context) ([]tenantRecord, error)
+	ReadTenantMeta(ctx context.Context, tenantID string) (tenantMeta, error)
+	WriteTenantMeta(ctx context.Context, m tenantMeta) error
+	ScanEventRecords(ctx context.Context, tenantID string, afterSeq int64, fn func(eventRecord) error) error
+	WriteEventRecords(ctx context.Context, tenantID string, recs []eventRecord) (int, error)
 	insertAPIKey(ctx context.Context, id uuid.UUID, tenant uuid.UUID, user *uuid.UUID, keyID, keyHash string) error
 	RequireTenantExists(ctx context.Context, tenantID uuid.UUID) error
 	GetAPIKeyByKeyID(ctx context.Context, keyID string) (APIKeyRecord, bool, error)
+	Ping(ctx context.Context) error
 	Close() error
 }
 
-func OpenDB(ctx context.Context, dsn string) (DBInterface, error) {
-	if looksLikePostgresDSN(dsn) {
-		debugPrint(log.Printf, levelInfo, "Database backend Postgres\n")
-		return OpenPgsqlDB(ctx, dsn)
-	}
-	debugPrint(log.Printf, levelInfo, "Database backend sqlite3\n")
-	return OpenSQLiteDB(ctx, dsn)
-}
-
 func looksLikePostgresDSN(dsn string) bool {
 	return strings.Contains(dsn, "host=") ||
 		strings.Contains(dsn, "user=") ||
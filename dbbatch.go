@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dbBatchDefaultSize = 100
+	dbBatchDefaultWait = 10 * time.Millisecond
+	dbBatchMaxSize     = 1000 // 13 parameters per row, below the drivers limits
+)
+
+// seqEvent is one row of a batch insert.
+type seqEvent struct {
+	Ev  Event
+	Seq int64
+}
+
+// insertEventBatch stores batch with one multi-row insert in tx. Each row
+// keeps the "on conflict do nothing" of the single insert, the result
+// tells which rows were stored. tenantArg converts the tenant id to the
+// column type of the backend.
+func insertEventBatch(ctx context.Context, tx *sql.Tx, ph func(int) string, tenantArg func(string) (any, error), batch []seqEvent) ([]bool, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %d rows\n", ctx, len(batch))
+
+	withDedupKey := false
+	for _, r := range batch {
+		if r.Ev.DedupKey != "" {
+			withDedupKey = true
+			break
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`insert into cmd_events
+		(tenant_id, seq, ts_client, session_id, host_fqdn, cwd, cmd, raw_line, src_ip, transport, parse_ok, chain_hash`)
+	if withDedupKey {
+		sb.WriteString(`, dedup_key`)
+	}
+	sb.WriteString(`)
+		values `)
+
+	args, bind := newBinder(ph)
+	for i, r := range batch {
+		tenant, err := tenantArg(r.Ev.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		ev := r.Ev
+		sb.WriteString("(" + bind(tenant) + "," + bind(r.Seq) + "," + bind(nullTime(ev.TSClient)) + "," +
+			bind(ev.SessionID) + "," + bind(ev.HostFQDN) + "," + bind(nullString(ev.CWD)) + "," +
+			bind(nullString(ev.Cmd)) + "," + bind(ev.RawLine) + "," + bind(nullString(ev.SrcIP)) + "," +
+			bind(ev.Transport) + "," + bind(ev.ParseOK) + "," + bind(chainHashArg(ev.ChainHash)))
+		if withDedupKey {
+			// null keys never collide
+			key := sql.NullString{String: ev.DedupKey, Valid: ev.DedupKey != ""}
+			sb.WriteString("," + bind(key))
+		}
+		sb.WriteByte(')')
+	}
+	if withDedupKey {
+		sb.WriteString(` on conflict do nothing`)
+	} else {
+		sb.WriteString(` on conflict (tenant_id, seq) do nothing`)
+	}
+	sb.WriteString(` returning tenant_id, seq`)
+
+	rows, err := tx.QueryContext(ctx, sb.String(), *args...)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]bool, len(batch))
+	for rows.Next() {
+		var tenantID string
+		var seq int64
+		if err := rows.Scan(&tenantID, &seq); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stored[batchRowKey(tenantID, seq)] = true
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	inserted := make([]bool, len(batch))
+	for i, r := range batch {
+		inserted[i] = stored[batchRowKey(r.Ev.TenantID, r.Seq)]
+		if !inserted[i] {
+			continue
+		}
+		if err := insertEventTags(ctx, tx, ph, r.Ev.TenantID, r.Seq, r.Ev.Tags); err != nil {
+			return nil, err
+		}
+	}
+	return inserted, nil
+}
+
+func batchRowKey(tenantID string, seq int64) string {
+	return strings.ToLower(tenantID) + "/" + strconv.FormatInt(seq, 10)
+}
+
+// dbBatchParams returns the batch size and wait of the running
+// configuration, size 1 disables batching.
+func dbBatchParams(cfg DBBatchConfig) (int, time.Duration) {
+	size, wait := dbBatchDefaultSize, dbBatchDefaultWait
+	if cfg.Size > 0 {
+		size = cfg.Size
+	}
+	if cfg.WaitMS > 0 {
+		wait = time.Duration(cfg.WaitMS) * time.Millisecond
+	}
+	return size, wait
+}
+
+// collectBatch waits for a first message then adds the ones arriving
+// within wait, up to size. ok is false once dbCh is closed and empty or
+// the service is stopped.
+func (s *IngestService) collectBatch(batch []SeqMsg, size int, wait time.Duration) ([]SeqMsg, bool) {
+	select {
+	case <-s.ctx.Done():
+		return batch, false
+	case msg, ok := <-s.dbCh:
+		if !ok {
+			return batch, false
+		}
+		batch = append(batch, msg)
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for len(batch) < size {
+		select {
+		case <-s.ctx.Done():
+			return batch, true
+		case <-timer.C:
+			return batch, true
+		case msg, ok := <-s.dbCh:
+			if !ok {
+				return batch, true
+			}
+			batch = append(batch, msg)
+		}
+	}
+	return batch, true
+}
+
+// storeBatch writes batch in one transaction. When the transaction fails
+// the rows are stored one by one, so that a bad row only holds itself.
+// It returns false when the service is stopped.
+func (s *IngestService) storeBatch(batch []SeqMsg) bool {
+	debugPrint(log.Printf, levelCrazy, "Args=%d rows\n", len(batch))
+
+	rows := make([]seqEvent, 0, len(batch))
+	msgs := make([]SeqMsg, 0, len(batch))
+	for _, msg := range batch {
+		ev, err := encryptEventLine(msg.TenantPTR, s.seqMsgEvent(msg), msg.RawCrypt)
+		if err != nil {
+			// reported by the single row path
+			if !s.storeOne(msg) {
+				return false
+			}
+			continue
+		}
+		rows = append(rows, seqEvent{Ev: ev, Seq: msg.Seq})
+		msgs = append(msgs, msg)
+	}
+	if len(rows) == 0 {
+		return true
+	}
+
+	start := time.Now()
+	inserted, err := s.db.InsertEventBatch(s.ctx, rows)
+	elapsed := time.Since(start).Seconds()
+	if err != nil {
+		if s.ctx.Err() != nil {
+			return false
+		}
+		debugPrint(log.Printf, levelWarning, "DB batch insert of %d rows failed, storing them one by one (%v)\n", len(rows), err)
+		for _, msg := range msgs {
+			if !s.storeOne(msg) {
+				return false
+			}
+		}
+		return true
+	}
+
+	observed := make(map[string]bool)
+	for i, msg := range msgs {
+		tenantID, tr := msg.TenantPTR.TenantID, msg.Transport.String()
+		if !observed[tenantID] {
+			observed[tenantID] = true
+			s.metrics.dbLatency.observe(elapsed, tenantID)
+		}
+		if !inserted[i] && rows[i].Ev.DedupKey != "" {
+			s.dbDone(msg)
+			s.metrics.dbInserts.inc(tenantID, tr, "duplicate")
+			s.dropLine(&s.linesDuplicate, "duplicate", tenantID, msg.Transport)
+			continue
+		}
+		// a row without key is only skipped when its seq is stored already
+		atomic.AddUint64(&s.linesDBOK, 1)
+		s.dbDone(msg)
+		s.metrics.dbInserts.inc(tenantID, tr, "ok")
+		if inserted[i] {
+			s.tail.Publish(msg.Seq, rows[i].Ev)
+		}
+	}
+	debugPrint(log.Printf, levelDebug, "DB batch insert of %d rows in %.3fs\n", len(rows), elapsed)
+	return true
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// copyBatchRows is the events read or written per statement by backup,
+// restore and migrate-data. 14 parameters per row.
+const copyBatchRows = 500
+
+// The records copied by backup, restore and migrate-data. They keep the ids
+// and the sequence numbers of the source, the internal event row ids are
+// not copied: tags and notes follow their event by seq.
+
+type tenantRecord struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type userRecord struct {
+	ID        string    `json:"id"`
+	TenantID  string    `json:"tenant_id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type apiKeyRecord struct {
+	ID        string     `json:"id"`
+	TenantID  string     `json:"tenant_id"`
+	UserID    *string    `json:"user_id,omitempty"`
+	KeyID     string     `json:"key_id"`
+	KeyHash   string     `json:"key_hash"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// tenantMeta is a tenant with its users and API keys.
+type tenantMeta struct {
+	Tenant  tenantRecord   `json:"tenant"`
+	Users   []userRecord   `json:"users"`
+	APIKeys []apiKeyRecord `json:"api_keys"`
+}
+
+type noteRecord struct {
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type eventRecord struct {
+	Seq        int64        `json:"seq"`
+	TSClient   *time.Time   `json:"ts_client,omitempty"`
+	SessionID  string       `json:"session_id"`
+	HostFQDN   string       `json:"host_fqdn"`
+	CWD        *string      `json:"cwd,omitempty"`
+	Cmd        *string      `json:"cmd,omitempty"`
+	TSIngested time.Time    `json:"ts_ingested"`
+	SrcIP      *string      `json:"src_ip,omitempty"`
+	Transport  string       `json:"transport"`
+	ParseOK    bool         `json:"parse_ok"`
+	RawLine    string       `json:"raw_line"`
+	DedupKey   *string      `json:"dedup_key,omitempty"`
+	ChainHash  *string      `json:"chain_hash,omitempty"`
+	Tags       []string     `json:"tags,omitempty"`
+	Notes      []noteRecord `json:"notes,omitempty"`
+}
+
+// sqliteTimeLayouts are the text timestamps of SQLite, the list of
+// go-sqlite3 which is not available in a CGO_ENABLED=0 build.
+var sqliteTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// dbTime scans a timestamp of either backend: time.Time from Postgres,
+// text from SQLite.
+type dbTime struct {
+	Time  time.Time
+	Valid bool
+}
+
+func (t *dbTime) Scan(v any) error {
+	switch x := v.(type) {
+	case nil:
+		t.Time, t.Valid = time.Time{}, false
+		return nil
+	case time.Time:
+		t.Time, t.Valid = x, true
+		return nil
+	case string:
+		return t.parse(x)
+	case []byte:
+		return t.parse(string(x))
+	}
+	return fmt.Errorf("unsupported timestamp type %T", v)
+}
+
+func (t *dbTime) parse(s string) error {
+	s = strings.TrimSuffix(s, "Z")
+	for _, layout := range sqliteTimeLayouts {
+		if ts, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			t.Time, t.Valid = ts, true
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid timestamp %q", s)
+}
+
+func (t dbTime) ptr() *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	ts := t.Time
+	return &ts
+}
+
+func nullStringPtr(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+// sqlCopy implements the data copy methods of the SQL backends.
+type sqlCopy struct {
+	db    *sql.DB
+	ph    func(int) string
+	pg    bool
+	mysql bool
+}
+
+// keepExisting is the clause of an insert leaving the row alone when col
+// exists already. MySQL has no "on conflict": there any unique key counts,
+// and the update of col to itself changes nothing.
+func (c sqlCopy) keepExisting(col string) string {
+	if c.mysql {
+		return ` on duplicate key update ` + col + ` = ` + col
+	}
+	return ` on conflict (` + col + `) do nothing`
+}
+
+func (c sqlCopy) listTenants(ctx context.Context) ([]tenantRecord, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v\n", ctx)
+
+	rows, err := c.db.QueryContext(ctx, `select id, name, created_at from tenants order by name`)
+	if err != nil {
+		return nil, fmt.Errorf("list tenants: %w", err)
+	}
+	defer rows.Close()
+
+	var out []tenantRecord
+	for rows.Next() {
+		var t tenantRecord
+		var created dbTime
+		if err := rows.Scan(&t.ID, &t.Name, &created); err != nil {
+			return nil, fmt.Errorf("list tenants: %w", err)
+		}
+		t.CreatedAt = created.Time
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func (c sqlCopy) readTenantMeta(ctx context.Context, tenantID string) (tenantMeta, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s\n", ctx, tenantID)
+
+	var m tenantMeta
+	var created dbTime
+	err := c.db.QueryRowContext(ctx, `select id, name, created_at from tenants where id = `+c.ph(1), tenantID).
+		Scan(&m.Tenant.ID, &m.Tenant.Name, &created)
+	if err == sql.ErrNoRows {
+		return m, fmt.Errorf("tenant %s not found", tenantID)
+	}
+	if err != nil {
+		return m, fmt.Errorf("read tenant: %w", err)
+	}
+	m.Tenant.CreatedAt = created.Time
+
+	rows, err := c.db.QueryContext(ctx, `
+		select id, tenant_id, username, created_at from app_users
+		where tenant_id = `+c.ph(1)+` order by created_at, id`, tenantID)
+	if err != nil {
+		return m, fmt.Errorf("read users: %w", err)
+	}
+	for rows.Next() {
+		var u userRecord
+		if err := rows.Scan(&u.ID, &u.TenantID, &u.Username, &created); err != nil {
+			rows.Close()
+			return m, fmt.Errorf("read users: %w", err)
+		}
+		u.CreatedAt = created.Time
+		m.Users = append(m.Users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return m, fmt.Errorf("read users: %w", err)
+	}
+
+	rows, err = c.db.QueryContext(ctx, `
+		select id, tenant_id, user_id, key_id, key_hash, created_at, revoked_at from api_keys
+		where tenant_id = `+c.ph(1)+` order by created_at, id`, tenantID)
+	if err != nil {
+		return m, fmt.Errorf("read api keys: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k apiKeyRecord
+		var user sql.NullString
+		var revoked dbTime
+		if err := rows.Scan(&k.ID, &k.TenantID, &user, &k.KeyID, &k.KeyHash, &created, &revoked); err != nil {
+			return m, fmt.Errorf("read api keys: %w", err)
+		}
+		k.UserID, k.CreatedAt, k.RevokedAt = nullStringPtr(user), created.Time, revoked.ptr()
+		m.APIKeys = append(m.APIKeys, k)
+	}
+	return m, rows.Err()
+}
+
+// writeTenantMeta stores m, the rows already present are kept.
+func (c sqlCopy) writeTenantMeta(ctx context.Context, m tenantMeta) error {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s\n", ctx, m.Tenant.ID)
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ph := c.ph
+	if _, err := tx.ExecContext(ctx, `insert into tenants (id, name, created_at)
+		values (`+ph(1)+`,`+ph(2)+`,`+ph(3)+`)`+c.keepExisting("id"),
+		m.Tenant.ID, m.Tenant.Name, m.Tenant.CreatedAt); err != nil {
+		return fmt.Errorf("write tenant: %w", err)
+	}
+	for _, u := range m.Users {
+		if _, err := tx.ExecContext(ctx, `insert into app_users (id, tenant_id, username, created_at)
+			values (`+ph(1)+`,`+ph(2)+`,`+ph(3)+`,`+ph(4)+`)`+c.keepExisting("id"),
+			u.ID, u.TenantID, u.Username, u.CreatedAt); err != nil {
+			return fmt.Errorf("write user %s: %w", u.Username, err)
+		}
+	}
+	for _, k := range m.APIKeys {
+		if _, err := tx.ExecContext(ctx, `insert into api_keys (id, tenant_id, user_id, key_id, key_hash, created_at, revoked_at)
+			values (`+ph(1)+`,`+ph(2)+`,`+ph(3)+`,`+ph(4)+`,`+ph(5)+`,`+ph(6)+`,`+ph(7)+`)`+c.keepExisting("id"),
+			k.ID, k.TenantID, nullString(k.UserID), k.KeyID, k.KeyHash, k.CreatedAt, nullTime(k.RevokedAt)); err != nil {
+			return fmt.Errorf("write api key %s: %w", k.KeyID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// scanEvents calls fn for the events of the tenant after afterSeq, in seq
+// order, with their tags and notes.
+func (c sqlCopy) scanEvents(ctx context.Context, tenantID string, afterSeq int64, fn func(eventRecord) error) error {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %d\n", ctx, tenantID, afterSeq)
+
+	ph := c.ph
+	for {
+		rows, err := c.db.QueryContext(ctx, `
+			select id, seq, ts_client, session_id, host_fqdn, cwd, cmd, ts_ingested,
+				src_ip, transport, parse_ok, raw_line, dedup_key, chain_hash
+			from cmd_events
+			where tenant_id = `+ph(1)+` and seq > `+ph(2)+`
+			order by seq
+			limit `+strconv.Itoa(copyBatchRows), tenantID, afterSeq)
+		if err != nil {
+			return fmt.Errorf("read events: %w", err)
+		}
+		var page []eventRecord
+		byID := make(map[int64]int)
+		for rows.Next() {
+			var (
+				r                             eventRecord
+				id                            int64
+				tsClient, tsIngested          dbTime
+				cwd, cmd, srcIP, dedup, chain sql.NullString
+			)
+			if err := rows.Scan(&id, &r.Seq, &tsClient, &r.SessionID, &r.HostFQDN, &cwd, &cmd, &tsIngested,
+				&srcIP, &r.Transport, &r.ParseOK, &r.RawLine, &dedup, &chain); err != nil {
+				rows.Close()
+				return fmt.Errorf("read events: %w", err)
+			}
+			r.TSClient, r.TSIngested = tsClient.ptr(), tsIngested.Time
+			r.CWD, r.Cmd, r.SrcIP, r.DedupKey = nullStringPtr(cwd), nullStringPtr(cmd), nullStringPtr(srcIP), nullStringPtr(dedup)
+			r.ChainHash = nullStringPtr(chain)
+			byID[id] = len(page)
+			page = append(page, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("read events: %w", err)
+		}
+		if len(page) == 0 {
+			return nil
+		}
+
+		last := page[len(page)-1].Seq
+		if err := c.pageExtras(ctx, tenantID, afterSeq, last, page, byID); err != nil {
+			return err
+		}
+		for _, r := range page {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		if len(page) < copyBatchRows {
+			return nil
+		}
+		afterSeq = last
+	}
+}
+
+// pageExtras adds the tags and notes of the events with seq in
+// (after, last] to page.
+func (c sqlCopy) pageExtras(ctx context.Context, tenantID string, after, last int64, page []eventRecord, byID map[int64]int) error {
+	ph := c.ph
+	inPage := `(select id from cmd_events where tenant_id = ` + ph(2) + ` and seq > ` + ph(3) + ` and seq <= ` + ph(4) + `)`
+
+	rows, err := c.db.QueryContext(ctx, `select event_id, tag from cmd_event_tags
+		where tenant_id = `+ph(1)+` and event_id in `+inPage+` order by event_id, tag`,
+		tenantID, tenantID, after, last)
+	if err != nil {
+		return fmt.Errorf("read tags: %w", err)
+	}
+	for rows.Next() {
+		var id int64
+		var tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			rows.Close()
+			return fmt.Errorf("read tags: %w", err)
+		}
+		if i, ok := byID[id]; ok {
+			page[i].Tags = append(page[i].Tags, tag)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read tags: %w", err)
+	}
+
+	rows, err = c.db.QueryContext(ctx, `select event_id, note, created_at from cmd_event_notes
+		where tenant_id = `+ph(1)+` and event_id in `+inPage+` order by id`,
+		tenantID, tenantID, after, last)
+	if err != nil {
+		return fmt.Errorf("read notes: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var n noteRecord
+		var created dbTime
+		if err := rows.Scan(&id, &n.Note, &created); err != nil {
+			return fmt.Errorf("read notes: %w", err)
+		}
+		n.CreatedAt = created.Time
+		if i, ok := byID[id]; ok {
+			page[i].Notes = append(page[i].Notes, n)
+		}
+	}
+	return rows.Err()
+}
+
+// writeEvents stores recs for the tenant in one transaction and returns
+// how many were new, the seqs present already are left alone.
+func (c sqlCopy) writeEvents(ctx context.Context, tenantID string, recs []eventRecord) (int, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %d rows\n", ctx, tenantID, len(recs))
+
+	if len(recs) == 0 {
+		return 0, nil
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	insert := c.insertEventsReturning
+	if c.mysql {
+		insert = c.insertEventsOneByOne
+	}
+	stored, err := insert(ctx, tx, tenantID, recs)
+	if err != nil {
+		return 0, fmt.Errorf("write events: %w", err)
+	}
+
+	for _, r := range recs {
+		if !stored[r.Seq] {
+			continue
+		}
+		if err := c.insertTags(ctx, tx, tenantID, r.Seq, r.Tags); err != nil {
+			return 0, err
+		}
+		for _, n := range r.Notes {
+			nargs, nbind := newBinder(c.ph)
+			q := `insert into cmd_event_notes (tenant_id, event_id, note, created_at)
+				select tenant_id, id, ` + nbind(n.Note) + `, ` + nbind(n.CreatedAt) + ` from cmd_events
+				where tenant_id = ` + nbind(tenantID) + ` and seq = ` + nbind(r.Seq)
+			if _, err := tx.ExecContext(ctx, q, *nargs...); err != nil {
+				return 0, fmt.Errorf("write note: %w", err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(stored), nil
+}
+
+// insertEventsReturning stores recs with one multi-row insert and returns
+// the seqs that were new.
+func (c sqlCopy) insertEventsReturning(ctx context.Context, tx *sql.Tx, tenantID string, recs []eventRecord) (map[int64]bool, error) {
+	var sb strings.Builder
+	sb.WriteString(`insert into cmd_events
+		(tenant_id, seq, ts_client, session_id, host_fqdn, cwd, cmd, ts_ingested,
+		 src_ip, transport, parse_ok, raw_line, dedup_key, chain_hash)
+		values `)
+	args, bind := newBinder(c.ph)
+	for i, r := range recs {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString("(" + bind(tenantID) + "," + bind(r.Seq) + "," + bind(nullTime(r.TSClient)) + "," +
+			bind(r.SessionID) + "," + bind(r.HostFQDN) + "," + bind(nullString(r.CWD)) + "," +
+			bind(nullString(r.Cmd)) + "," + bind(r.TSIngested) + "," + bind(c.srcIPArg(r.SrcIP)) + "," +
+			bind(r.Transport) + "," + bind(r.ParseOK) + "," + bind(r.RawLine) + "," + bind(nullString(r.DedupKey)) + "," +
+			bind(nullString(r.ChainHash)) + ")")
+	}
+	sb.WriteString(` on conflict do nothing returning seq`)
+
+	rows, err := tx.QueryContext(ctx, sb.String(), *args...)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[int64]bool, len(recs))
+	for rows.Next() {
+		var seq int64
+		if err := rows.Scan(&seq); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stored[seq] = true
+	}
+	rows.Close()
+	return stored, rows.Err()
+}
+
+// insertEventsOneByOne is insertEventsReturning for MySQL, which has no
+// "returning": the rows affected of each insert tell whether it was new.
+func (c sqlCopy) insertEventsOneByOne(ctx context.Context, tx *sql.Tx, tenantID string, recs []eventRecord) (map[int64]bool, error) {
+	stored := make(map[int64]bool, len(recs))
+	for _, r := range recs {
+		args, bind := newBinder(c.ph)
+		q := `insert into cmd_events
+			(tenant_id, seq, ts_client, session_id, host_fqdn, cwd, cmd, ts_ingested,
+			 src_ip, transport, parse_ok, raw_line, dedup_key, chain_hash)
+			values (` + bind(tenantID) + "," + bind(r.Seq) + "," + bind(nullTime(r.TSClient)) + "," +
+			bind(r.SessionID) + "," + bind(r.HostFQDN) + "," + bind(nullString(r.CWD)) + "," +
+			bind(nullString(r.Cmd)) + "," + bind(r.TSIngested) + "," + bind(c.srcIPArg(r.SrcIP)) + "," +
+			bind(r.Transport) + "," + bind(r.ParseOK) + "," + bind(r.RawLine) + "," + bind(nullString(r.DedupKey)) + "," +
+			bind(nullString(r.ChainHash)) + `)` +
+			c.keepExisting("id")
+		res, err := tx.ExecContext(ctx, q, *args...)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if n > 0 {
+			stored[r.Seq] = true
+		}
+	}
+	return stored, nil
+}
+
+func (c sqlCopy) insertTags(ctx context.Context, tx *sql.Tx, tenantID string, seq int64, tags []string) error {
+	if c.mysql {
+		return mysqlInsertEventTags(ctx, tx, tenantID, seq, tags)
+	}
+	return insertEventTags(ctx, tx, c.ph, tenantID, seq, tags)
+}
+
+// srcIPArg converts src_ip for the column: Postgres inet refuses what is
+// not an address, like the "unknown" of the imports, it becomes null.
+func (c sqlCopy) srcIPArg(ip *string) any {
+	if ip == nil {
+		return nil
+	}
+	if c.pg && net.ParseIP(*ip) == nil {
+		if _, _, err := net.ParseCIDR(*ip); err != nil {
+			return nil
+		}
+	}
+	return *ip
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pool defaults of the SQL backends, db.max_open_conns and friends
+// override them.
+const (
+	dbDefaultMaxOpenConns    = 10
+	dbDefaultMaxIdleConns    = 5
+	dbDefaultConnMaxLifetime = 30 * time.Minute
+)
+
+// dbOpener connects a backend. cfg.DSN is stripped of its URL scheme when
+// the backend registered it, "sqlite://hc.db" arrives as "hc.db".
+type dbOpener func(ctx context.Context, cfg DBConfig) (DBInterface, error)
+
+type dbDriver struct {
+	open    dbOpener
+	schemes []string // URL schemes of the DSN, "postgres" for postgres://
+}
+
+var dbDrivers = map[string]dbDriver{}
+
+// registerDBDriver makes a backend available to db.driver and to the DSNs
+// with one of its URL schemes. Backends register in their init.
+func registerDBDriver(name string, open dbOpener, schemes ...string) {
+	if _, dup := dbDrivers[name]; dup {
+		panic("db driver registered twice: " + name)
+	}
+	dbDrivers[name] = dbDriver{open: open, schemes: schemes}
+}
+
+func dbDriverNames() []string {
+	names := make([]string, 0, len(dbDrivers))
+	for name := range dbDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dsnScheme returns the URL scheme of dsn and the rest, "" when it has
+// none.
+func dsnScheme(dsn string) (string, string) {
+	i := strings.Index(dsn, "://")
+	if i <= 0 || strings.ContainsAny(dsn[:i], " =/") {
+		return "", dsn
+	}
+	return strings.ToLower(dsn[:i]), dsn[i+3:]
+}
+
+// resolveDBDriver picks the backend of cfg: db.driver, else the URL scheme
+// of the DSN, else the guess of the former versions. guessed reports the
+// last case.
+func resolveDBDriver(cfg DBConfig) (name string, out DBConfig, guessed bool, err error) {
+	out = cfg
+	scheme, rest := dsnScheme(cfg.DSN)
+	schemeDriver := ""
+	for n, d := range dbDrivers {
+		for _, s := range d.schemes {
+			if s == scheme {
+				schemeDriver = n
+			}
+		}
+	}
+
+	switch {
+	case cfg.Driver != "":
+		if _, ok := dbDrivers[cfg.Driver]; !ok {
+			return "", out, false, fmt.Errorf("db.driver %q unknown (available: %s)", cfg.Driver, strings.Join(dbDriverNames(), "|"))
+		}
+		if schemeDriver != "" && schemeDriver != cfg.Driver {
+			return "", out, false, fmt.Errorf("db.driver %q does not match the %s:// dsn", cfg.Driver, scheme)
+		}
+		name = cfg.Driver
+	case schemeDriver != "":
+		name = schemeDriver
+	case looksLikePostgresDSN(cfg.DSN):
+		name, guessed = "postgres", true
+	default:
+		name, guessed = "sqlite", true
+	}
+
+	// postgres takes its URLs as they are
+	if schemeDriver == name && name != "postgres" {
+		out.DSN = rest
+	}
+	return name, out, guessed, nil
+}
+
+// OpenDB connects the backend of cfg, see resolveDBDriver.
+func OpenDB(ctx context.Context, cfg DBConfig) (DBInterface, error) {
+	name, cfg, guessed, err := resolveDBDriver(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if guessed {
+		debugPrint(log.Printf, levelWarning, "db.driver not set, %s guessed from the dsn\n", name)
+		if name == "sqlite" {
+			// a mistyped Postgres dsn must not become a new database file
+			if path := sqlitePath(cfg.DSN); path != "" {
+				if _, err := os.Stat(path); err != nil {
+					return nil, fmt.Errorf("sqlite database %s: %w (set db.driver to create it)", path, err)
+				}
+			}
+		}
+	}
+	debugPrint(log.Printf, levelInfo, "Database backend %s\n", name)
+	return dbDrivers[name].open(ctx, cfg)
+}
+
+// configurePool applies the pool settings of cfg to db.
+func configurePool(db *sql.DB, cfg DBConfig) {
+	maxOpen, maxIdle, lifetime := dbDefaultMaxOpenConns, dbDefaultMaxIdleConns, dbDefaultConnMaxLifetime
+	if cfg.MaxOpenConns > 0 {
+		maxOpen = cfg.MaxOpenConns
+	}
+	if cfg.MaxIdleConns > 0 {
+		maxIdle = cfg.MaxIdleConns
+	}
+	if cfg.ConnMaxLifetimeSeconds > 0 {
+		lifetime = time.Duration(cfg.ConnMaxLifetimeSeconds) * time.Second
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(min(maxIdle, maxOpen))
+	db.SetConnMaxLifetime(lifetime)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// schemaUpgrade is a change of the tables made after a database was
+// created: check counts the rows describing it, none when it is missing,
+// and apply adds it.
+type schemaUpgrade struct {
+	name  string
+	check string
+	apply []string
+}
+
+// upgradeSchema applies the upgrades missing from db. Only what is missing
+// is changed, so that a server whose user may not alter the tables starts
+// on an up to date schema.
+func upgradeSchema(ctx context.Context, db *sql.DB, ups []schemaUpgrade) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %d upgrades\n", ctx, len(ups))
+
+	for _, u := range ups {
+		var n int
+		if err := db.QueryRowContext(ctx, u.check).Scan(&n); err != nil {
+			return fmt.Errorf("schema check %s: %w", u.name, err)
+		}
+		if n > 0 {
+			continue
+		}
+		log.Printf("schema upgrade: adding %s", u.name)
+		for _, s := range u.apply {
+			if _, err := db.ExecContext(ctx, s); err != nil {
+				return fmt.Errorf("schema upgrade %s failed on %q: %w", u.name, shortSQL(s), err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	dedupDefaultWindow = 1 * time.Second
+	dedupDefaultCache  = 10 * time.Minute
+)
+
+var (
+	// Client supplied event id, an extra header attribute before "> ":
+	// "ts - sid - host [cwd=/x] [eid=web1-4711] > cmd"
+	reEventID = regexp.MustCompile(`^(\d{8}\.\d{6}[^>]*?)\s+\[eid=([A-Za-z0-9._:-]{1,128})\](\s+>\s.*)$`)
+
+	errDuplicateEvent = errors.New("duplicate event")
+)
+
+// extractEventID strips the client event id from line, if any.
+func extractEventID(line string) (string, string) {
+	m := reEventID.FindStringSubmatch(line)
+	if m == nil {
+		return line, ""
+	}
+	return m[1] + m[3], m[2]
+}
+
+// tenantDedupKey is dedupKey for the lines of t, empty when the line is not
+// deduplicated. The key is stored in clear text next to the encrypted cmd:
+// a content hash would let whoever reads the table confirm a guessed
+// command, so crypt tenants are only deduplicated by event id.
+func tenantDedupKey(t *Tenant, ev Event, eventID string, window time.Duration) string {
+	if t.Crypt && eventID == "" {
+		return ""
+	}
+	return dedupKey(ev, eventID, window)
+}
+
+// dedupKey identifies an event for duplicate suppression: the client id
+// when given, otherwise a hash of timestamp, session, host and command with
+// the timestamp truncated to window.
+func dedupKey(ev Event, eventID string, window time.Duration) string {
+	if eventID != "" {
+		return "id:" + eventID
+	}
+
+	ts := ""
+	if ev.TSClient != nil {
+		ts = strconv.FormatInt(ev.TSClient.Truncate(window).Unix(), 10)
+	}
+	cmd := ""
+	if ev.Cmd != nil {
+		cmd = *ev.Cmd
+	}
+	h := sha256.New()
+	for _, part := range []string{ts, ev.SessionID, ev.HostFQDN, cmd} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return "h:" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// dedupCache remembers the recently accepted keys so that retransmissions
+// are discarded before they consume a sequence number. The database unique
+// index catches what the cache has forgotten.
+type dedupCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newDedupCache(ttl time.Duration) *dedupCache {
+	return &dedupCache{ttl: ttl, seen: make(map[string]time.Time), lastSweep: time.Now()}
+}
+
+// setTTL applies a reloaded cache_seconds to the keys seen from now on.
+func (c *dedupCache) setTTL(ttl time.Duration) {
+	c.mu.Lock()
+	c.ttl = ttl
+	c.mu.Unlock()
+}
+
+// has reports whether key was already recorded, without recording it.
+func (c *dedupCache) has(tenantID, key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	exp, ok := c.seen[tenantID+"/"+key]
+	return ok && now.Before(exp)
+}
+
+// check records key and reports whether it was already seen.
+func (c *dedupCache) check(tenantID, key string, now time.Time) bool {
+	debugPrint(log.Printf, levelCrazy, "Args=%s, %s\n", tenantID, key)
+
+	k := tenantID + "/" + key
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastSweep) > c.ttl/2 {
+		for sk, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, sk)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	if exp, ok := c.seen[k]; ok && now.Before(exp) {
+		return true
+	}
+	c.seen[k] = now.Add(c.ttl)
+	return false
+}
+
+// eventInsertSQL is the cmd_events insert shared by the SQL backends. With
+// a dedup key any unique violation, seq or key, leaves the row out.
+func eventInsertSQL(withDedupKey bool) string {
+	if !withDedupKey {
+		return `
+		insert into cmd_events
+			(tenant_id, seq, ts_client, session_id, host_fqdn, cwd, cmd, raw_line, src_ip, transport, parse_ok, chain_hash)
+		values
+			($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
+		on conflict (tenant_id, seq) do nothing
+	`
+	}
+	return `
+		insert into cmd_events
+			(tenant_id, seq, ts_client, session_id, host_fqdn, cwd, cmd, raw_line, src_ip, transport, parse_ok, chain_hash, dedup_key)
+		values
+			($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)
+		on conflict do nothing
+	`
+}
+
+// checkDuplicateInsert turns an insert that stored nothing into
+// errDuplicateEvent when the event had a dedup key.
+func checkDuplicateInsert(res sql.Result, ev Event) error {
+	if ev.DedupKey == "" {
+		return nil
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errDuplicateEvent
+	}
+	return nil
+}
@@ -12,18 +12,30 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type ExportService struct {
-	Opts *Options
+	opts atomic.Pointer[Options] // swapped on reload
 	DB   DBInterface
+	Tail *tailHub
 }
 
-func RegisterExportHandlers(mux *http.ServeMux, opts *Options, db DBInterface) {
-	s := &ExportService{Opts: opts, DB: db}
+func RegisterExportHandlers(mux *http.ServeMux, opts *Options, db DBInterface, tail *tailHub) *ExportService {
+	s := &ExportService{DB: db, Tail: tail}
+	s.opts.Store(opts)
 
 	mux.HandleFunc("/export", s.handleExport)
+	mux.HandleFunc("/tail", s.handleTail)
+	mux.HandleFunc("/sessions", s.handleSessions)
+	mux.HandleFunc("/sessions/{id}", s.handleSession)
+	mux.HandleFunc("/sessions/{id}/tags", s.handleSessionTags)
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/tags", s.handleTags)
+	mux.HandleFunc("/events/{seq}", s.handleEvent)
+	mux.HandleFunc("/events/{seq}/tags", s.handleEventTags)
+	mux.HandleFunc("/events/{seq}/notes", s.handleEventNotes)
 
 	mux.HandleFunc("/web_app", func(w http.ResponseWriter, r *http.Request) {
 		debugPrint(log.Printf, levelInfo, "Wip /web_app page reached!\n")
@@ -34,16 +46,28 @@ func RegisterExportHandlers(mux *http.ServeMux, opts *Options, db DBInterface) {
 		debugPrint(log.Printf, levelInfo, "not implemented or planned page reached!\n")
 		http.Error(w, "not implemented", http.StatusNotImplemented)
 	})
+	return s
+}
+
+func (s *ExportService) Opts() *Options {
+	return s.opts.Load()
+}
+
+// SetOptions makes the handlers use a reloaded configuration.
+func (s *ExportService) SetOptions(opts *Options) {
+	s.opts.Store(opts)
 }
 
 type exportQuery struct {
-	Grep1   string
-	Grep2   string
-	Grep3   string
+	Greps   []grepTerm
 	Session string
+	Host    string
+	Tags    []string
 
-	Order string
-	Limit int
+	Order  string
+	Limit  int
+	After  *exportCursor
+	Before *exportCursor
 
 	Color string
 	Key   string
@@ -107,7 +131,7 @@ func (s *ExportService) getTenantFromHTTPAPI(msg *http.Request) string {
 	}
 
 	debugPrint(log.Printf, levelDebug, "Verify secret\n")
-	pepper := strings.TrimSpace(s.Opts.Cfg.Globals.Pepper)
+	pepper := strings.TrimSpace(s.Opts().Cfg.Globals.Pepper)
 	if !verifySecretSHA256(secret, pepper, rec.KeyHash) {
 		return ""
 	}
@@ -146,20 +170,33 @@ func (s *ExportService) getTenantFromHTTPSCert(r *http.Request) string {
 }
 
 func (s *ExportService) getTenant(msg *http.Request) string {
-	debugPrint(log.Printf, levelCrazy, "Args: %v\n", msg)
+	return s.resolveHTTPTenant(msg, false)
+}
 
-	authMethods := s.Opts.Cfg.Server.HTTP.Auth
+// getAuthenticatedTenant is getTenant without the "none" auth mode: the
+// tenant comes from an API key or a client certificate.
+func (s *ExportService) getAuthenticatedTenant(msg *http.Request) string {
+	return s.resolveHTTPTenant(msg, true)
+}
+
+func (s *ExportService) resolveHTTPTenant(msg *http.Request, skipNone bool) string {
+	debugPrint(log.Printf, levelCrazy, "Args: %v, %t\n", msg, skipNone)
+
+	authMethods := s.Opts().Cfg.Server.HTTP.Auth
 	TLSFlag := false
 	if msg.TLS != nil {
-		authMethods = s.Opts.Cfg.Server.HTTPS.Auth
+		authMethods = s.Opts().Cfg.Server.HTTPS.Auth
 		TLSFlag = true
 	}
 	debugPrint(log.Printf, levelDebug, "Itearate over defined methods %v: TLS=%t\n", authMethods, TLSFlag)
 	for _, method := range authMethods {
 		switch AuthMode(strings.ToLower(string(method))) {
 		case AuthNone:
+			if skipNone {
+				continue
+			}
 			debugPrint(log.Printf, levelInfo, "Using default tenant\n")
-			t := strings.TrimSpace(s.Opts.Cfg.Globals.DefaultTenantID)
+			t := strings.TrimSpace(s.Opts().Cfg.Globals.DefaultTenantID)
 			if t != "" {
 				return t
 			}
@@ -188,69 +225,38 @@ func (s *ExportService) getTenant(msg *http.Request) string {
 
 func (s *ExportService) handleExport(w http.ResponseWriter, r *http.Request) {
 	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", w, r)
-	if r.Method != http.MethodGet {
-		debugPrint(log.Printf, levelInfo, "not allowed method request form %s\n", getIP(r))
-		w.Header().Set("Allow", http.MethodGet)
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	if !s.Opts.Cfg.Server.IngestClear.Enabled {
-		http.Error(w, "export disabled", http.StatusNotFound)
-		return
-	}
-
-	cd := connDataFromRequest(r)
-
-	authPipeline := []authFn{
-		func(c connData) authRes { return AuthAllow }, // stub allow-all
-	}
-
-	switch runAuthPipeline(cd, authPipeline) {
-	case AuthAllow:
-		// proceed
-	default:
-		http.Error(w, "forbidden", http.StatusForbidden)
-		return
-	}
 
-	tenantID := s.getTenant(r)
-	if tenantID == "" {
-		debugPrint(log.Printf, levelError, "no default tenantID\n")
-		http.Error(w, "export no default tenantID", http.StatusInternalServerError)
+	tenantID, ok := s.requestTenant(w, r)
+	if !ok {
 		return
 	}
 
-	q, err := parseExportQuery(r, s.Opts.Cfg.Globals.MaxRows)
+	q, err := parseExportQuery(r, s.Opts().Cfg.Globals.MaxRows)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	pipe, err := CompileGrepPipeline(q.Grep1, q.Grep2, q.Grep3, q.Color)
+	pipe, err := CompileGrepPipeline(q.Greps, q.Color)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	maxSec := s.Opts.Cfg.Globals.MaxSeconds
-	if maxSec <= 0 {
-		maxSec = 30
-	}
-	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(maxSec)*time.Second)
+	ctx, cancel := s.requestContext(r)
 	defer cancel()
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-store")
 
-	lines, err := s.DB.ExportLines(ctx, tenantID, q)
+	page, err := s.DB.ExportLines(ctx, tenantID, q)
 	if err != nil {
 		log.Printf("export query failed: %v", err)
 		http.Error(w, "export query failed", http.StatusInternalServerError)
 		return
 	}
 
-	textLines, err := linesToText(ctx, lines, pipe, q.Key)
+	textLines, err := linesToText(ctx, page.Lines, pipe, q.Key)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
 			log.Printf("export stream error: %v", err)
@@ -258,6 +264,13 @@ func (s *ExportService) handleExport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if page.Last != nil {
+		w.Header().Set("X-HC-Next-Cursor", encodeExportCursor(*page.Last))
+	}
+	if page.First != nil {
+		w.Header().Set("X-HC-Prev-Cursor", encodeExportCursor(*page.First))
+	}
+
 	for _, line := range textLines {
 		if _, err := io.WriteString(w, line+"\n"); err != nil {
 			return
@@ -269,16 +282,39 @@ func parseExportQuery(r *http.Request, maxRows int) (exportQuery, error) {
 	v := r.URL.Query()
 
 	q := exportQuery{
-		Grep1:   v.Get("grep1"),
-		Grep2:   v.Get("grep2"),
-		Grep3:   v.Get("grep3"),
 		Session: strings.TrimSpace(v.Get("session")),
+		Host:    strings.TrimSpace(v.Get("host")),
 
 		Order: strings.TrimSpace(v.Get("order")),
 		Color: strings.TrimSpace(v.Get("color")),
 		Key:   strings.TrimSpace(v.Get("key")),
 	}
 
+	// grep1..3 are kept for compatibility, grep/grepv can be repeated.
+	for _, name := range []string{"grep1", "grep2", "grep3"} {
+		if p := v.Get(name); strings.TrimSpace(p) != "" {
+			q.Greps = append(q.Greps, grepTerm{Name: name, Pattern: p})
+		}
+	}
+	for _, p := range v["grep"] {
+		if strings.TrimSpace(p) != "" {
+			q.Greps = append(q.Greps, grepTerm{Name: "grep", Pattern: p})
+		}
+	}
+	for _, p := range v["grepv"] {
+		if strings.TrimSpace(p) != "" {
+			q.Greps = append(q.Greps, grepTerm{Name: "grepv", Pattern: p, Negate: true})
+		}
+	}
+
+	if len(v["tag"]) > 0 {
+		tags, err := normalizeTags(v["tag"])
+		if err != nil {
+			return exportQuery{}, err
+		}
+		q.Tags = tags
+	}
+
 	if q.Order == "" {
 		q.Order = "ingest_asc"
 	}
@@ -290,6 +326,26 @@ func parseExportQuery(r *http.Request, maxRows int) (exportQuery, error) {
 		return exportQuery{}, fmt.Errorf("invalid color=%q (use never|always)", q.Color)
 	}
 
+	after := strings.TrimSpace(v.Get("after"))
+	before := strings.TrimSpace(v.Get("before"))
+	if after != "" && before != "" {
+		return exportQuery{}, fmt.Errorf("after and before are mutually exclusive")
+	}
+	if after != "" {
+		c, err := decodeExportCursor(after)
+		if err != nil {
+			return exportQuery{}, fmt.Errorf("invalid after=%q: %w", after, err)
+		}
+		q.After = &c
+	}
+	if before != "" {
+		c, err := decodeExportCursor(before)
+		if err != nil {
+			return exportQuery{}, fmt.Errorf("invalid before=%q: %w", before, err)
+		}
+		q.Before = &c
+	}
+
 	limit := maxRows
 	if limit <= 0 {
 		limit = 200000
@@ -343,18 +399,18 @@ func linesToText(ctx context.Context, lines []string, pipe *GrepPipeline, key st
 
 	return out, nil
 }
-func exportOrderSQL(order string) (string, error) {
+func exportOrderSQL(order string) (exportSort, error) {
 	switch order {
 	case "ingest_desc":
-		return "ts_ingested desc, id desc", nil
+		return exportSort{KeyCol: "ts_ingested", KeySelect: "ts_ingested::text", KeyBind: "%s::timestamptz", Desc: true}, nil
 	case "ingest_asc":
-		return "ts_ingested asc, id asc", nil
+		return exportSort{KeyCol: "ts_ingested", KeySelect: "ts_ingested::text", KeyBind: "%s::timestamptz"}, nil
 	case "client_desc":
-		return "ts_client desc nulls last, id desc", nil
+		return exportSort{KeyCol: "ts_client", KeySelect: "ts_client::text", KeyBind: "%s::timestamptz", Desc: true}, nil
 	case "client_asc":
-		return "ts_client asc nulls last, id asc", nil
+		return exportSort{KeyCol: "ts_client", KeySelect: "ts_client::text", KeyBind: "%s::timestamptz"}, nil
 	default:
-		return "", fmt.Errorf("invalid order=%q (use ingest_desc|ingest_asc|client_desc|client_asc)", order)
+		return exportSort{}, fmt.Errorf("invalid order=%q (use ingest_desc|ingest_asc|client_desc|client_asc)", order)
 	}
 }
 
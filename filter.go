@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+const filterReportEvery = 5 * time.Minute
+
+// ingestFilter is a compiled tenant filter rule. All the set criteria must
+// match. A matching line is dropped, or kept one time out of sample.
+type ingestFilter struct {
+	tenantID string
+	name     string
+	cmd      *regexp.Regexp
+	host     *regexp.Regexp
+	cwd      *regexp.Regexp
+	src      netip.Prefix
+	sample   uint64
+
+	matched  uint64
+	dropped  uint64
+	reported uint64
+}
+
+func compileIngestFilters(cfg *Config) (map[string][]*ingestFilter, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", cfg)
+
+	optRe := func(expr string) (*regexp.Regexp, error) {
+		if expr == "" {
+			return nil, nil
+		}
+		return regexp.Compile(expr)
+	}
+
+	result := make(map[string][]*ingestFilter, len(cfg.Tenants))
+	for _, t := range cfg.Tenants {
+		for _, r := range t.Filters {
+			f := &ingestFilter{tenantID: t.TenantID, name: r.Name}
+			var err error
+			if f.cmd, err = optRe(r.Cmd); err != nil {
+				return nil, fmt.Errorf("filter %q cmd: %w", r.Name, err)
+			}
+			if f.host, err = optRe(r.Host); err != nil {
+				return nil, fmt.Errorf("filter %q host: %w", r.Name, err)
+			}
+			if f.cwd, err = optRe(r.Cwd); err != nil {
+				return nil, fmt.Errorf("filter %q cwd: %w", r.Name, err)
+			}
+			if r.SrcCIDR != "" {
+				if f.src, err = netip.ParsePrefix(r.SrcCIDR); err != nil {
+					return nil, fmt.Errorf("filter %q src_cidr: %w", r.Name, err)
+				}
+			}
+			if r.Action == "sample" {
+				f.sample = uint64(r.Sample)
+			}
+			result[t.TenantID] = append(result[t.TenantID], f)
+		}
+	}
+	return result, nil
+}
+
+func (f *ingestFilter) match(ev Event, peer netip.Addr) bool {
+	if f.cmd != nil && (ev.Cmd == nil || !f.cmd.MatchString(*ev.Cmd)) {
+		return false
+	}
+	if f.host != nil && !f.host.MatchString(ev.HostFQDN) {
+		return false
+	}
+	if f.cwd != nil && (ev.CWD == nil || !f.cwd.MatchString(*ev.CWD)) {
+		return false
+	}
+	if f.src.IsValid() && !f.src.Contains(peer.Unmap()) {
+		return false
+	}
+	return true
+}
+
+// drop accounts a matching line and tells whether it must be discarded.
+func (f *ingestFilter) drop() bool {
+	n := atomic.AddUint64(&f.matched, 1)
+	if f.sample > 0 && (n-1)%f.sample == 0 {
+		return false
+	}
+	atomic.AddUint64(&f.dropped, 1)
+	return true
+}
+
+// filterLine applies the first matching rule and returns it when the line
+// has to be dropped.
+func filterLine(filters []*ingestFilter, ev Event, peer netip.Addr) *ingestFilter {
+	for _, f := range filters {
+		if !f.match(ev, peer) {
+			continue
+		}
+		if f.drop() {
+			return f
+		}
+		return nil
+	}
+	return nil
+}
+
+// reportFilters logs the rules that dropped lines since the last report.
+func (s *IngestService) reportFilters() {
+	debugPrint(log.Printf, levelCrazy, "Args=none\n")
+
+	for _, filters := range s.conf().Filters {
+		for _, f := range filters {
+			dropped, reported := atomic.LoadUint64(&f.dropped), atomic.LoadUint64(&f.reported)
+			if dropped == reported {
+				continue
+			}
+			log.Printf("filter tenant=%s rule=%s matched=%d dropped=%d (+%d)",
+				f.tenantID, f.name, atomic.LoadUint64(&f.matched), dropped, dropped-reported)
+			atomic.StoreUint64(&f.reported, dropped)
+		}
+	}
+}
+
+func (s *IngestService) startFilterReporter() {
+	debugPrint(log.Printf, levelCrazy, "Args=none\n")
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t := time.NewTicker(filterReportEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				s.reportFilters()
+				return
+			case <-t.C:
+				s.reportFilters()
+			}
+		}
+	}()
+}
@@ -5,11 +5,17 @@ go 1.24.0
 toolchain go1.24.1
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
+	github.com/go-sql-driver/mysql v1.9.3
+	github.com/google/uuid v1.6.0
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.34
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.48.0
+)
+
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/gorilla/mux v1.8.1 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	github.com/mattn/go-sqlite3 v1.14.34 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/crypto v0.48.0 // indirect
+	github.com/spf13/pflag v1.0.6 // indirect
 	golang.org/x/sys v0.41.0 // indirect
 )
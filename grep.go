@@ -3,40 +3,52 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
+// grepTerm is a single export filter as requested by the client.
+// Negate turns it into an exclusion (grep -v).
+type grepTerm struct {
+	Name    string
+	Pattern string
+	Negate  bool
+}
+
+type grepStage struct {
+	re     *regexp.Regexp
+	negate bool
+}
+
 type GrepPipeline struct {
-	re1 *regexp.Regexp
-	re2 *regexp.Regexp
-	re3 *regexp.Regexp
+	stages []grepStage
 
 	color string
 }
 
-func CompileGrepPipeline(g1, g2, g3, color string) (*GrepPipeline, error) {
+var grepColors = []string{
+	"\x1b[31m", // red
+	"\x1b[32m", // green
+	"\x1b[33m", // yellow
+	"\x1b[34m", // blue
+	"\x1b[35m", // magenta
+	"\x1b[36m", // cyan
+}
+
+func CompileGrepPipeline(terms []grepTerm, color string) (*GrepPipeline, error) {
 	p := &GrepPipeline{
 		color: color,
 	}
 
-	var err error
-	if strings.TrimSpace(g1) != "" {
-		p.re1, err = regexp.Compile(g1)
-		if err != nil {
-			return nil, fmt.Errorf("invalid grep1: %w", err)
+	for _, t := range terms {
+		if strings.TrimSpace(t.Pattern) == "" {
+			continue
 		}
-	}
-	if strings.TrimSpace(g2) != "" {
-		p.re2, err = regexp.Compile(g2)
+		re, err := regexp.Compile(t.Pattern)
 		if err != nil {
-			return nil, fmt.Errorf("invalid grep2: %w", err)
-		}
-	}
-	if strings.TrimSpace(g3) != "" {
-		p.re3, err = regexp.Compile(g3)
-		if err != nil {
-			return nil, fmt.Errorf("invalid grep3: %w", err)
+			return nil, fmt.Errorf("invalid %s: %w", t.Name, err)
 		}
+		p.stages = append(p.stages, grepStage{re: re, negate: t.Negate})
 	}
 
 	return p, nil
@@ -50,14 +62,10 @@ func (p *GrepPipeline) Match(line string) bool {
 	if p == nil {
 		return true
 	}
-	if p.re1 != nil && !p.re1.MatchString(line) {
-		return false
-	}
-	if p.re2 != nil && !p.re2.MatchString(line) {
-		return false
-	}
-	if p.re3 != nil && !p.re3.MatchString(line) {
-		return false
+	for _, st := range p.stages {
+		if st.re.MatchString(line) == st.negate {
+			return false
+		}
 	}
 	return true
 }
@@ -67,19 +75,16 @@ func (p *GrepPipeline) Highlight(line string) string {
 		return line
 	}
 	const reset = "\x1b[0m"
-	const red = "\x1b[31m"
-	const green = "\x1b[32m"
-	const yellow = "\x1b[33m"
 
 	s := line
-	if p.re1 != nil {
-		s = p.re1.ReplaceAllStringFunc(s, func(m string) string { return red + m + reset })
-	}
-	if p.re2 != nil {
-		s = p.re2.ReplaceAllStringFunc(s, func(m string) string { return green + m + reset })
-	}
-	if p.re3 != nil {
-		s = p.re3.ReplaceAllStringFunc(s, func(m string) string { return yellow + m + reset })
+	n := 0
+	for _, st := range p.stages {
+		if st.negate {
+			continue
+		}
+		color := grepColors[n%len(grepColors)]
+		s = st.re.ReplaceAllStringFunc(s, func(m string) string { return color + m + reset })
+		n++
 	}
 	return s
 }
@@ -90,3 +95,92 @@ func IsPlainSubstring(s string) bool {
 	}
 	return !strings.ContainsAny(s, `.+*?()|[]{}^$\`)
 }
+
+// escapeLike quotes the LIKE wildcards of a plain substring so it can be
+// used with the default backslash escape character.
+func escapeLike(s string) string {
+	s = strings.ReplaceAll(s, `%`, `\%`)
+	return strings.ReplaceAll(s, `_`, `\_`)
+}
+
+// regexDupMax is the largest {m,n} count of the Postgres regex engine.
+const regexDupMax = 255
+
+// IsPortableRegex tells whether a pattern accepted by regexp.Compile means
+// the same to the database regex engines (Postgres ARE, MySQL REGEXP):
+// literals, escaped punctuation, ., ^, $, groups, alternation, greedy
+// repetitions and bracket expressions without escapes or classes. Other
+// syntax, like \b (a backspace for Postgres), \d, (?i) or lazy
+// repetitions, must be evaluated in Go.
+func IsPortableRegex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 >= len(s) || !isASCIIPunct(s[i+1]) {
+				return false
+			}
+			i++
+		case '(':
+			if i+1 < len(s) && (s[i+1] == '?' || s[i+1] == ')') {
+				return false
+			}
+		case '|':
+			if i == 0 || i == len(s)-1 || s[i-1] == '(' || s[i+1] == '|' || s[i+1] == ')' {
+				return false
+			}
+		case '*', '+', '?':
+			if i+1 < len(s) && s[i+1] == '?' {
+				return false
+			}
+		case '{':
+			end, ok := portableRepeat(s, i)
+			if !ok || (end+1 < len(s) && s[end+1] == '?') {
+				return false
+			}
+			i = end
+		case '[':
+			j := i + 1
+			if j < len(s) && s[j] == '^' {
+				j++
+			}
+			if j < len(s) && s[j] == ']' {
+				j++
+			}
+			for ; j < len(s) && s[j] != ']'; j++ {
+				if s[j] == '\\' || s[j] == '[' {
+					return false
+				}
+			}
+			if j >= len(s) {
+				return false
+			}
+			i = j
+		}
+	}
+	return true
+}
+
+// portableRepeat checks the {m}, {m,} or {m,n} starting at s[i] and
+// returns the index of its closing brace.
+func portableRepeat(s string, i int) (int, bool) {
+	end := strings.IndexByte(s[i:], '}')
+	if end < 0 {
+		return 0, false
+	}
+	lo, hi, _ := strings.Cut(s[i+1:i+end], ",")
+	for k, n := range []string{lo, hi} {
+		if n == "" && k == 1 {
+			continue
+		}
+		v, err := strconv.Atoi(n)
+		if err != nil || v < 0 || v > regexDupMax || strings.TrimLeft(n, "0123456789") != "" {
+			return 0, false
+		}
+	}
+	return i + end, true
+}
+
+func isASCIIPunct(c byte) bool {
+	return c < 0x80 && c > ' ' && c != 0x7f &&
+		!(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z')
+}
@@ -44,6 +44,46 @@ var commands = []Command{
 		Handler:     doExport,
 		Description: "Exports a grep friendly history.",
 	},
+	{
+		Name:        "stats",
+		Handler:     doStats,
+		Description: "Prints command statistics for the default tenant.",
+	},
+	{
+		Name:        "tag",
+		Handler:     doTag,
+		Description: "Adds or removes tags on an event or a session.",
+	},
+	{
+		Name:        "note",
+		Handler:     doNote,
+		Description: "Attaches a note to an event.",
+	},
+	{
+		Name:        "backup",
+		Handler:     doBackup,
+		Description: "Writes the archive of a tenant: manifest, users, api keys and events.",
+	},
+	{
+		Name:        "restore",
+		Handler:     doRestore,
+		Description: "Restores a tenant archive written by backup, into any backend.",
+	},
+	{
+		Name:        "migrate-data",
+		Handler:     doMigrateData,
+		Description: "Copies every tenant from one database to another, SQLite or Postgres.",
+	},
+	{
+		Name:        "verify",
+		Handler:     doVerify,
+		Description: "Verifies the hash chain of a tenant, against the spool with -spool.",
+	},
+	{
+		Name:        "verify_crypt",
+		Handler:     doVerifyCrypt,
+		Description: "Reports plaintext rows of the crypt tenants.",
+	},
 	{
 		Name:        "apy_key",
 		Handler:     doRunAPIKeyCreate,
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	readyTimeout   = 2 * time.Second
+	queueHighWater = 0.9
+)
+
+// spoolHealth tracks the spool writes for /readyz: the last sequence
+// number written per tenant and the last failure.
+type spoolHealth struct {
+	mu      sync.Mutex
+	seq     map[string]int64
+	lastOK  time.Time
+	lastErr error
+	errAt   time.Time
+}
+
+func (h *spoolHealth) written(tenantID string, seq int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.seq == nil {
+		h.seq = make(map[string]int64)
+	}
+	h.seq[tenantID] = seq
+	h.lastOK = time.Now()
+}
+
+func (h *spoolHealth) failed(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastErr = err
+	h.errAt = time.Now()
+}
+
+// state returns a copy of the spooled sequences and the pending failure,
+// nil once a later write succeeded.
+func (h *spoolHealth) state() (map[string]int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seq := make(map[string]int64, len(h.seq))
+	for k, v := range h.seq {
+		seq[k] = v
+	}
+	if h.lastErr != nil && !h.lastOK.After(h.errAt) {
+		return seq, h.lastErr
+	}
+	return seq, nil
+}
+
+// dbProgress tracks for /readyz the last sequence the database workers
+// are done with per tenant, stored or dropped as a duplicate.
+type dbProgress struct {
+	mu  sync.Mutex
+	seq map[string]int64
+}
+
+func (p *dbProgress) done(tenantID string, seq int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.seq == nil {
+		p.seq = make(map[string]int64)
+	}
+	p.seq[tenantID] = max(p.seq[tenantID], seq)
+}
+
+func (p *dbProgress) last(tenantID string) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.seq[tenantID]
+}
+
+type readyCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type readyReport struct {
+	Ready  bool             `json:"ready"`
+	Checks []readyCheck     `json:"checks"`
+	DBLag  map[string]int64 `json:"db_lag,omitempty"`
+}
+
+// handleHealthz answers as long as the process serves requests.
+func (s *IngestService) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", r.URL)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports the state of the database, the spool and the
+// queues. It answers 503 when one of them fails.
+func (s *IngestService) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", r.URL)
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	rep := s.readiness(ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if !rep.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(rep)
+}
+
+func (s *IngestService) readiness(ctx context.Context) readyReport {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", ctx)
+
+	rep := readyReport{Ready: true}
+	add := func(c readyCheck) {
+		rep.Checks = append(rep.Checks, c)
+		rep.Ready = rep.Ready && c.OK
+	}
+
+	// database
+	db := readyCheck{Name: "db", OK: true}
+	switch {
+	case s.db == nil && s.conf().AppCfg != nil && s.conf().AppCfg.DB.DSN != "":
+		db.OK, db.Detail = false, "not connected, ingestion is spooled only"
+	case s.db == nil:
+		db.Detail = "not configured"
+	default:
+		if err := s.db.Ping(ctx); err != nil {
+			db.OK, db.Detail = false, err.Error()
+		}
+	}
+	add(db)
+
+	// spool
+	seqs, err := s.spoolHealth.state()
+	sp := readyCheck{Name: "spool", OK: err == nil}
+	if err != nil {
+		sp.Detail = "last write failed: " + err.Error()
+	}
+	add(sp)
+
+	// queues
+	for _, q := range []struct {
+		name     string
+		len, cap int
+	}{
+		{"raw", len(s.rawCh), cap(s.rawCh)},
+		{"spool", len(s.spoolCh), cap(s.spoolCh)},
+		{"db", len(s.dbCh), cap(s.dbCh)},
+	} {
+		c := readyCheck{Name: "queue_" + q.name, OK: true, Detail: fmt.Sprintf("%d/%d", q.len, q.cap)}
+		if q.cap > 0 && float64(q.len) >= queueHighWater*float64(q.cap) {
+			c.OK = false
+			c.Detail += " saturated"
+		}
+		add(c)
+	}
+
+	// per tenant lag between the spool and the database
+	if s.db == nil || !db.OK || len(seqs) == 0 {
+		return rep
+	}
+	maxLag := int64(0)
+	if s.conf().AppCfg != nil {
+		maxLag = s.conf().AppCfg.Globals.ReadyMaxDBLag
+	}
+	rep.DBLag = make(map[string]int64, len(seqs))
+	lag := readyCheck{Name: "db_lag", OK: true}
+	for _, tenantID := range sortedKeys(seqs) {
+		// a seq dropped as a duplicate is never stored, the workers'
+		// progress covers it; MaxSeq covers the rows of a previous run
+		dbSeq, err := s.db.MaxSeq(ctx, tenantID)
+		if err != nil {
+			lag.OK, lag.Detail = false, fmt.Sprintf("tenant %s: %v", tenantID, err)
+			break
+		}
+		dbSeq = max(dbSeq, s.dbProgress.last(tenantID))
+		n := max(seqs[tenantID]-dbSeq, 0)
+		rep.DBLag[tenantID] = n
+		if maxLag > 0 && n > maxLag {
+			lag.OK = false
+			lag.Detail = fmt.Sprintf("tenant %s is %d lines behind (max %d)", tenantID, n, maxLag)
+		}
+	}
+	add(lag)
+	return rep
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shell history tools whose database import reads.
+const (
+	histSourceAtuin = "atuin"
+	histSourceMcfly = "mcfly"
+)
+
+// defaultToolDB is where the tool keeps its database, relative to $HOME.
+var defaultToolDB = map[string]string{
+	histSourceAtuin: ".local/share/atuin/history.db",
+	histSourceMcfly: ".local/share/mcfly/history.db",
+}
+
+// toolSessionID maps the session of a tool to an hc session id, the
+// commands of one tool session stay together.
+func toolSessionID(tool, session string) string {
+	if session == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(tool + "\x00" + session))
+	return hex.EncodeToString(sum[:4])
+}
+
+// sqlHistReader returns the rows of a tool database as entries.
+type sqlHistReader struct {
+	db   *sql.DB
+	rows *sql.Rows
+	scan func(*sql.Rows) (histEntry, error)
+	n    int64
+}
+
+func (r *sqlHistReader) Next() (histEntry, error) {
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return histEntry{}, err
+		}
+		return histEntry{}, io.EOF
+	}
+	r.n++
+	return r.scan(r.rows)
+}
+
+func (r *sqlHistReader) Pos() int64 { return r.n }
+
+func (r *sqlHistReader) Close() error {
+	_ = r.rows.Close()
+	return r.db.Close()
+}
+
+// openToolHistory opens the database of tool read only. An empty path is
+// the tool default location.
+func openToolHistory(ctx context.Context, tool, path string) (*sqlHistReader, string, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %s, %s\n", ctx, tool, path)
+
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, "", err
+		}
+		path = filepath.Join(home, defaultToolDB[tool])
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, path, fmt.Errorf("%s database: %w", tool, err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, path, fmt.Errorf("open %s database: %w", tool, err)
+	}
+
+	r := &sqlHistReader{db: db}
+	switch tool {
+	case histSourceAtuin:
+		r.rows, err = db.QueryContext(ctx, `
+			select id, timestamp, command, cwd, session, hostname
+			from history
+			where deleted_at is null
+			order by timestamp, id`)
+		r.scan = scanAtuin
+	case histSourceMcfly:
+		r.rows, err = db.QueryContext(ctx, `
+			select id, when_run, cmd, coalesce(dir, ''), session_id
+			from commands
+			order by when_run, id`)
+		r.scan = scanMcfly
+	default:
+		err = fmt.Errorf("unknown history tool %q", tool)
+	}
+	if err != nil {
+		_ = db.Close()
+		return nil, path, fmt.Errorf("read %s database: %w", tool, err)
+	}
+	return r, path, nil
+}
+
+// atuin: timestamp in nanoseconds, hostname as "host:user".
+func scanAtuin(rows *sql.Rows) (histEntry, error) {
+	var (
+		id, cmd, cwd, session, host string
+		ns                          int64
+	)
+	if err := rows.Scan(&id, &ns, &cmd, &cwd, &session, &host); err != nil {
+		return histEntry{}, fmt.Errorf("atuin row: %w", err)
+	}
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	ts := time.Unix(0, ns)
+	return histEntry{
+		ID:      "atuin-" + id,
+		TS:      &ts,
+		Cmd:     cmd,
+		Cwd:     cwd,
+		Host:    host,
+		Session: toolSessionID(histSourceAtuin, session),
+	}, nil
+}
+
+// mcfly: when_run in seconds, no host, one database per machine.
+func scanMcfly(rows *sql.Rows) (histEntry, error) {
+	var (
+		id            int64
+		when          int64
+		cmd, dir, sid string
+	)
+	if err := rows.Scan(&id, &when, &cmd, &dir, &sid); err != nil {
+		return histEntry{}, fmt.Errorf("mcfly row: %w", err)
+	}
+	ts := time.Unix(when, 0)
+	return histEntry{
+		ID:      "mcfly-" + sid + "-" + strconv.FormatInt(id, 10),
+		TS:      &ts,
+		Cmd:     cmd,
+		Cwd:     dir,
+		Session: toolSessionID(histSourceMcfly, sid),
+	}, nil
+}
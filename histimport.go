@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const importChunkRows = 500
+
+// History file formats understood by import.
+const (
+	histFormatAuto = "auto"
+	histFormatHC   = "hc"   // hc legacy lines, see ParseIngestLine
+	histFormatBash = "bash" // with or without HISTTIMEFORMAT "#<epoch>" lines
+	histFormatZsh  = "zsh"  // ": <epoch>:<duration>;cmd" extended history
+	histFormatFish = "fish" // fish_history, "- cmd:" / "  when:" records
+)
+
+var (
+	reBashTS     = regexp.MustCompile(`^#(\d{9,11})$`)
+	reBashTSNext = regexp.MustCompile(`^#\d{9,11}\r?(\n|$)`)
+	reZshExt     = regexp.MustCompile(`^: (\d+):(\d+);`)
+	reHCLine     = regexp.MustCompile(`^\d{8}\.\d{6}\s`)
+	reSessID     = regexp.MustCompile(`^[0-9a-f]{8}$`)
+)
+
+// histEntry is one command read from a history source. Empty fields are
+// filled by the import defaults.
+type histEntry struct {
+	ID      string // unique in the source, if it has one
+	TS      *time.Time
+	Cmd     string
+	Cwd     string
+	Host    string
+	Session string
+	Line    string // hc line, parsed by ParseIngestLine instead of the fields
+}
+
+// histReader returns the entries of a history source, io.EOF at the end.
+// Pos is the position after the last entry returned, where a resumed
+// import starts: a byte offset for files, a row count for databases.
+type histReader interface {
+	Next() (histEntry, error)
+	Pos() int64
+}
+
+// lineReader reads the lines of a history file and counts the bytes
+// consumed.
+type lineReader struct {
+	r   *bufio.Reader
+	off int64
+}
+
+func (l *lineReader) readLine() (string, error) {
+	line, err := l.r.ReadString('\n')
+	l.off += int64(len(line))
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// detectHistoryFormat guesses the format from the first lines of r.
+func detectHistoryFormat(r *bufio.Reader) string {
+	head, _ := r.Peek(16 * 1024)
+	for _, line := range strings.Split(string(head), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "- cmd: "):
+			return histFormatFish
+		case reZshExt.MatchString(line):
+			return histFormatZsh
+		case reBashTS.MatchString(line):
+			return histFormatBash
+		case reHCLine.MatchString(line):
+			return histFormatHC
+		}
+		return histFormatBash
+	}
+	return histFormatBash
+}
+
+// newHistReader reads format from r, off is the offset of r in the file.
+func newHistReader(format string, r *bufio.Reader, off int64) (histReader, error) {
+	l := &lineReader{r: r, off: off}
+	switch format {
+	case histFormatHC:
+		return &hcHistReader{r: l}, nil
+	case histFormatBash:
+		return &bashHistReader{r: l}, nil
+	case histFormatZsh:
+		return &zshHistReader{r: l}, nil
+	case histFormatFish:
+		return &fishHistReader{r: l, pos: off}, nil
+	}
+	return nil, fmt.Errorf("unknown history format %q", format)
+}
+
+func epochPtr(s string) *time.Time {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return nil
+	}
+	t := time.Unix(n, 0)
+	return &t
+}
+
+// hcHistReader reads the hc legacy lines, one event per line.
+type hcHistReader struct {
+	r *lineReader
+}
+
+func (h *hcHistReader) Next() (histEntry, error) {
+	for {
+		line, err := h.r.readLine()
+		if err != nil {
+			return histEntry{}, err
+		}
+		if strings.TrimSpace(line) != "" {
+			return histEntry{Line: line}, nil
+		}
+	}
+}
+
+func (h *hcHistReader) Pos() int64 { return h.r.off }
+
+// bashHistReader reads ~/.bash_history. With HISTTIMEFORMAT set every
+// command follows a "#<epoch>" line and may span several lines, without
+// it every line is a command.
+type bashHistReader struct {
+	r       *lineReader
+	pending *time.Time // timestamp line read ahead
+	done    bool
+}
+
+func (b *bashHistReader) Next() (histEntry, error) {
+	for !b.done {
+		line, err := b.r.readLine()
+		if err == io.EOF {
+			b.done = true
+			break
+		}
+		if err != nil {
+			return histEntry{}, err
+		}
+		if m := reBashTS.FindStringSubmatch(line); m != nil {
+			b.pending = epochPtr(m[1])
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		e := histEntry{TS: b.pending, Cmd: line}
+		if b.pending == nil {
+			return e, nil
+		}
+		// lines up to the next timestamp belong to the command
+		b.pending = nil
+		for {
+			next, _ := b.r.r.Peek(14)
+			if len(next) == 0 || reBashTSNext.Match(next) {
+				break
+			}
+			more, err := b.r.readLine()
+			if err != nil {
+				break
+			}
+			e.Cmd += "\n" + more
+		}
+		e.Cmd = strings.TrimRight(e.Cmd, "\n")
+		return e, nil
+	}
+	return histEntry{}, io.EOF
+}
+
+func (b *bashHistReader) Pos() int64 { return b.r.off }
+
+// zshHistReader reads zsh EXTENDED_HISTORY. A line ending with a
+// backslash continues on the next one.
+type zshHistReader struct {
+	r *lineReader
+}
+
+func (z *zshHistReader) Next() (histEntry, error) {
+	for {
+		line, err := z.r.readLine()
+		if err != nil {
+			return histEntry{}, err
+		}
+		for strings.HasSuffix(line, `\`) {
+			more, err := z.r.readLine()
+			if err != nil {
+				break
+			}
+			line = line[:len(line)-1] + "\n" + more
+		}
+		line = unmetafyZsh(line)
+
+		var e histEntry
+		if m := reZshExt.FindStringSubmatch(line); m != nil {
+			e.TS = epochPtr(m[1])
+			e.Cmd = line[len(m[0]):]
+		} else {
+			// plain zsh history
+			e.Cmd = line
+		}
+		if strings.TrimSpace(e.Cmd) == "" {
+			continue
+		}
+		return e, nil
+	}
+}
+
+func (z *zshHistReader) Pos() int64 { return z.r.off }
+
+// unmetafyZsh decodes the bytes zsh escapes in its history file.
+func unmetafyZsh(s string) string {
+	const meta = 0x83
+	if strings.IndexByte(s, meta) < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == meta && i+1 < len(s) {
+			i++
+			b = append(b, s[i]^32)
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// fishHistReader reads fish_history, a YAML like list of records: a
+// "- cmd: <command>" line followed by "  when: <epoch>" and "  paths:".
+type fishHistReader struct {
+	r    *lineReader
+	next *histEntry
+	pos  int64 // start of the record in next
+}
+
+func (f *fishHistReader) Next() (histEntry, error) {
+	for {
+		start := f.r.off
+		line, err := f.r.readLine()
+		if err == io.EOF {
+			f.pos = f.r.off
+			if f.next != nil {
+				e := *f.next
+				f.next = nil
+				return e, nil
+			}
+			return histEntry{}, io.EOF
+		}
+		if err != nil {
+			return histEntry{}, err
+		}
+
+		switch {
+		case strings.HasPrefix(line, "- cmd: "):
+			cur := f.next
+			f.next = &histEntry{Cmd: unescapeFish(strings.TrimPrefix(line, "- cmd: "))}
+			f.pos = start
+			if cur != nil && strings.TrimSpace(cur.Cmd) != "" {
+				return *cur, nil
+			}
+		case strings.HasPrefix(line, "  when: ") && f.next != nil:
+			f.next.TS = epochPtr(strings.TrimSpace(strings.TrimPrefix(line, "  when: ")))
+		}
+	}
+}
+
+// Pos is the start of the record read ahead, it is returned next.
+func (f *fishHistReader) Pos() int64 { return f.pos }
+
+// unescapeFish reverses the escaping of the fish history: "\\" and "\n".
+func unescapeFish(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case 'n':
+				sb.WriteByte('\n')
+				i++
+				continue
+			case '\\':
+				sb.WriteByte('\\')
+				i++
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// importSessionID derives the session of the imported commands from the
+// host and the source path, a re-import gets the same one.
+func importSessionID(host, path string) string {
+	sum := sha256.Sum256([]byte(host + "\x00" + absPath(path)))
+	return hex.EncodeToString(sum[:4])
+}
+
+// importTarget is where and as what the imported commands are stored.
+// Source identifies the imported file, it keys the entries without id
+// nor timestamp.
+type importTarget struct {
+	Tenant  *Tenant
+	Host    string
+	Session string
+	Source  string
+}
+
+// Kinds of the entries without hc line, see the dry run.
+const (
+	histKindTS   = "timestamped"
+	histKindNoTS = "no_timestamp"
+)
+
+// histEvent maps e to the row stored and tells its kind, the regex that
+// parsed an hc line. n numbers the entries of the source, it keys the
+// entries without id nor timestamp for duplicate detection.
+func histEvent(t importTarget, e histEntry, n int) (Event, string) {
+	if e.Line != "" {
+		return hcLineEvent(t, e.Line, n)
+	}
+
+	host, sess := t.Host, t.Session
+	if e.Host != "" && t.Host == "" {
+		host = e.Host
+	}
+	if e.Session != "" && t.Session == "" {
+		sess = e.Session
+	}
+	if host == "" {
+		host = "unknown"
+	}
+
+	cmd := e.Cmd
+	// no SrcIP, the importer has no source address and src_ip is inet on
+	// Postgres
+	ev := Event{
+		TenantID:  t.Tenant.TenantID,
+		TSClient:  e.TS,
+		SessionID: sess,
+		HostFQDN:  host,
+		Cmd:       &cmd,
+		Transport: "import",
+		ParseOK:   true,
+	}
+	if e.Cwd != "" {
+		cwd := e.Cwd
+		ev.CWD = &cwd
+	}
+	ev.RawLine = formatExportLine(nullTime(e.TS), time.Now(),
+		nullString(&sess), nullString(&host), nullString(ev.CWD), nullString(ev.Cmd), cmd)
+
+	// a re-import of the same source skips what is stored already, by
+	// position for crypt tenants, which have no content key
+	eventID := e.ID
+	if eventID == "" && (e.TS == nil || t.Tenant.Crypt) {
+		eventID = importOrdinalID(t, sess, n)
+	}
+	ev.DedupKey = dedupKey(ev, eventID, time.Second)
+	if e.TS == nil {
+		return ev, histKindNoTS
+	}
+	return ev, histKindTS
+}
+
+// hcLineEvent parses an hc legacy line like the ingestion does, the
+// host and session of t replace the ones of the line.
+func hcLineEvent(t importTarget, line string, n int) (Event, string) {
+	line, eventID := extractEventID(line)
+	ev, kind := ParseIngestLine(t.Tenant.TenantID, line)
+	ev.Transport = "import"
+	if t.Host != "" {
+		ev.HostFQDN = t.Host
+	}
+	if t.Session != "" {
+		ev.SessionID = t.Session
+	}
+	if eventID == "" && (ev.TSClient == nil || t.Tenant.Crypt) {
+		eventID = importOrdinalID(t, ev.SessionID, n)
+	}
+	ev.DedupKey = dedupKey(ev, eventID, time.Second)
+	return ev, kind.String()
+}
+
+func importOrdinalID(t importTarget, sess string, n int) string {
+	src := t.Source
+	if src == "" {
+		src = sess
+	}
+	return "import-" + src + "-" + strconv.Itoa(n)
+}
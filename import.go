@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 )
@@ -18,21 +20,98 @@ func doImport(version string, args []string) {
 
 	debugPrint(log.Printf, levelDebug, "check config consistency\n")
 
-	if opts.Cfg.Globals.DefaultTenantID == "" {
+	tenantID := opts.Cfg.Globals.DefaultTenantID
+	if opts.Import.Tenant != "" {
+		tenantID = opts.Import.Tenant
+	}
+	if tenantID == "" {
 		fmt.Fprintln(os.Stderr, "DefaultTenantID is required when using -import")
 		os.Exit(2)
 	}
+	tenant := findTenant(&opts.Cfg, tenantID)
+	if tenant == nil {
+		fmt.Fprintf(os.Stderr, "tenant %s is not configured\n", tenantID)
+		os.Exit(2)
+	}
+	if opts.Import.Session != "" && !reSessID.MatchString(opts.Import.Session) {
+		fmt.Fprintln(os.Stderr, "session must be 8 hex digits")
+		os.Exit(2)
+	}
+	if opts.LegacyHistoryFile == "" && opts.Import.From == "" {
+		fmt.Fprintln(os.Stderr, "history file is required: hc import [flags] <file>")
+		os.Exit(2)
+	}
 
-	if opts.Cfg.DB.DSN == "" {
+	if opts.Cfg.DB.DSN == "" && !opts.Import.DryRun {
 		fmt.Fprintln(os.Stderr, "dsn must be set in config for import")
 		os.Exit(2)
 	}
 
-	debugPrint(log.Printf, levelDebug, "connecting db\n")
-
 	ctx := context.Background()
 
-	db, err := OpenDB(ctx, opts.Cfg.DB.DSN)
+	var cp *importCheckpoint
+	if opts.Import.Checkpoint != "" {
+		if cp, err = loadImportCheckpoint(opts.Import.Checkpoint); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	src, err := openImportSource(ctx, opts, tenantID, cp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer src.close()
+
+	t := importTarget{Tenant: tenant, Host: opts.Import.Host, Session: opts.Import.Session}
+	switch {
+	case opts.Import.From != "":
+		// the tool rows carry their host and session
+		if t.Host == "" && opts.Import.From == histSourceMcfly {
+			t.Host, _ = os.Hostname()
+		}
+	case src.format == histFormatHC:
+		// the hc lines carry their host and session
+		t.Source = importSessionID(t.Host, src.path)
+	default:
+		if t.Host == "" {
+			t.Host, _ = os.Hostname()
+		}
+		t.Source = importSessionID(t.Host, src.path)
+		if t.Session == "" {
+			t.Session = t.Source
+		}
+	}
+
+	im := &importer{
+		target:  t,
+		rd:      src.rd,
+		skipErr: opts.Import.OnError == importOnErrorSkip,
+		total:   src.size,
+	}
+	if cp != nil {
+		im.cp = *cp
+		fmt.Fprintf(os.Stderr, "import: resuming %s after entry %d\n", src.path, cp.Entries)
+	} else {
+		im.cp = importCheckpoint{Source: src.path, Format: src.format, TenantID: tenantID}
+	}
+
+	if opts.Import.DryRun {
+		if err := im.run(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		im.printDryRun(os.Stdout, src.format)
+		return
+	}
+
+	if opts.Cfg.Globals.Chain.Enabled {
+		fmt.Fprintf(os.Stderr, "import: hash chain enabled, imported rows are not chained, hc verify counts them as imported\n")
+	}
+
+	debugPrint(log.Printf, levelDebug, "connecting db\n")
+
+	db, err := OpenDB(ctx, opts.Cfg.DB)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -46,32 +125,39 @@ func doImport(version string, args []string) {
 	}
 
 	debugPrint(log.Printf, levelDebug, "fetch TenantName\n")
-	TenantName, exists, err := db.GetTenantName(ctx, opts.Cfg.Globals.DefaultTenantID)
+	TenantName, exists, err := db.GetTenantName(ctx, tenantID)
 	if err != nil || !exists {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
 	debugPrint(log.Printf, levelDebug, "EnsureTenant\n")
-	if err := db.EnsureTenant(ctx, opts.Cfg.Globals.DefaultTenantID, TenantName); err != nil {
+	if err := db.EnsureTenant(ctx, tenantID, TenantName); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	debugPrint(log.Printf, levelDebug, "populating\n")
-	inserted, skipped, err := db.ImportHistoryFile(
-		ctx,
-		opts.Cfg.Globals.DefaultTenantID,
-		opts.LegacyHistoryFile,
-	)
-	if err != nil {
+	debugPrint(log.Printf, levelDebug, "populating from %s\n", src.path)
+	im.db = db
+	im.cpPath = opts.Import.Checkpoint
+	if err := im.run(ctx); err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		if im.cpPath != "" {
+			fmt.Fprintf(os.Stderr, "import: run again with -checkpoint %s to resume\n", im.cpPath)
+		}
 		os.Exit(1)
 	}
+	if im.cpPath != "" {
+		if err := os.Remove(im.cpPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
 
 	fmt.Printf(
-		"Import completed: inserted=%d skipped=%d\n",
-		inserted,
-		skipped,
+		"Import completed (%s): inserted=%d skipped=%d failed=%d\n",
+		src.format,
+		im.cp.Inserted,
+		im.cp.Skipped,
+		im.cp.Failed,
 	)
 }
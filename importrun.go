@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const importProgressEvery = 5 * time.Second
+
+// What import does with an entry it cannot store.
+const (
+	importOnErrorAbort = "abort"
+	importOnErrorSkip  = "skip"
+)
+
+// importCheckpoint records how far an import got. It is written after
+// every committed chunk, a run with the same checkpoint file resumes after
+// the last one. A checkpoint lost or behind is harmless: the entries
+// stored again are duplicates and skipped.
+type importCheckpoint struct {
+	Source   string `json:"source"`
+	Format   string `json:"format"`
+	TenantID string `json:"tenant_id"`
+	Pos      int64  `json:"pos"`     // byte offset, row count for a tool database
+	Entries  int    `json:"entries"` // entries read up to pos
+	Seq      int64  `json:"seq"`     // last seq used
+	Inserted int    `json:"inserted"`
+	Skipped  int    `json:"skipped"`
+	Failed   int    `json:"failed"`
+}
+
+// loadImportCheckpoint reads path, nil when there is none.
+func loadImportCheckpoint(path string) (*importCheckpoint, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read checkpoint: %w", err)
+	}
+	var cp importCheckpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %w", path, err)
+	}
+	return &cp, nil
+}
+
+func (cp *importCheckpoint) save(path string) error {
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// check refuses to resume cp for another source, format or tenant.
+func (cp *importCheckpoint) check(source, format, tenantID string) error {
+	if cp.Source != source || cp.Format != format || cp.TenantID != tenantID {
+		return fmt.Errorf("checkpoint is for %s (%s) of tenant %s", cp.Source, cp.Format, cp.TenantID)
+	}
+	return nil
+}
+
+// importSource is an opened history file or tool database.
+type importSource struct {
+	rd     histReader
+	close  func() error
+	path   string
+	format string // file format or tool
+	size   int64  // 0 for a database
+}
+
+// openImportSource opens the history of opts, positioned after cp when
+// resuming.
+func openImportSource(ctx context.Context, opts *Options, tenantID string, cp *importCheckpoint) (*importSource, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %s, %v\n", ctx, tenantID, cp)
+
+	if opts.Import.From != "" {
+		rd, path, err := openToolHistory(ctx, opts.Import.From, opts.LegacyHistoryFile)
+		if err != nil {
+			return nil, err
+		}
+		src := &importSource{rd: rd, close: rd.Close, path: absPath(path), format: opts.Import.From}
+		if cp != nil {
+			if err := cp.check(src.path, src.format, tenantID); err != nil {
+				_ = rd.Close()
+				return nil, err
+			}
+			for rd.Pos() < cp.Pos {
+				if _, err := rd.Next(); err != nil {
+					_ = rd.Close()
+					return nil, fmt.Errorf("skip to row %d: %w", cp.Pos, err)
+				}
+			}
+		}
+		return src, nil
+	}
+
+	f, r, format, err := openHistory(opts.LegacyHistoryFile, opts.Import.Format)
+	if err != nil {
+		return nil, err
+	}
+	src := &importSource{close: f.Close, path: absPath(opts.LegacyHistoryFile), format: format}
+	if st, err := f.Stat(); err == nil {
+		src.size = st.Size()
+	}
+	var off int64
+	if cp != nil {
+		err = cp.check(src.path, src.format, tenantID)
+		if err == nil && cp.Pos > src.size {
+			err = fmt.Errorf("history file is shorter than the checkpoint offset %d", cp.Pos)
+		}
+		if err == nil {
+			off, err = f.Seek(cp.Pos, io.SeekStart)
+			r.Reset(f)
+		}
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	if src.rd, err = newHistReader(format, r, off); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// openHistory opens path and resolves format, "auto" is detected.
+func openHistory(path, format string) (*os.File, *bufio.Reader, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("open history file: %w", err)
+	}
+	r := bufio.NewReaderSize(f, 64*1024)
+	if format == "" || format == histFormatAuto {
+		format = detectHistoryFormat(r)
+		debugPrint(log.Printf, levelInfo, "history format of %s: %s\n", path, format)
+	}
+	return f, r, format, nil
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// importRow is an entry waiting for its chunk commit.
+type importRow struct {
+	row    seqEvent
+	n      int   // entry number
+	before int64 // source position before the entry
+}
+
+// importer stores the entries of a history source in chunks of
+// importChunkRows, each committed on its own with the next sequence
+// numbers of the tenant. Without db it only parses, a dry run.
+type importer struct {
+	db      DBInterface
+	target  importTarget
+	rd      histReader
+	skipErr bool
+	cp      importCheckpoint
+	cpPath  string
+	total   int64 // source size for the progress, 0 when unknown
+	entries int
+	kinds   map[string]int
+	last    time.Time
+}
+
+func (im *importer) run(ctx context.Context) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", ctx, im.target)
+
+	seq := im.cp.Seq
+	if im.db != nil {
+		maxSeq, err := im.db.MaxSeq(ctx, im.target.Tenant.TenantID)
+		if err != nil {
+			return fmt.Errorf("cant recover seq (%v)", err)
+		}
+		seq = max(seq, maxSeq)
+	}
+	im.entries = im.cp.Entries
+	im.kinds = make(map[string]int)
+	im.last = time.Now()
+
+	batch := make([]importRow, 0, importChunkRows)
+	for {
+		before := im.rd.Pos()
+		e, err := im.rd.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read history after entry %d: %w", im.entries, err)
+		}
+		im.entries++
+		ev, kind := histEvent(im.target, e, im.entries)
+		im.kinds[kind]++
+		if im.db == nil {
+			im.progress()
+			continue
+		}
+
+		if ev, err = encryptEvent(im.target.Tenant, ev); err != nil {
+			if !im.skipErr {
+				// keep what precedes the entry
+				if ferr := im.flush(ctx, batch, before, im.entries-1); ferr != nil {
+					return ferr
+				}
+				return fmt.Errorf("entry %d: %w", im.entries, err)
+			}
+			im.failed(im.entries, err)
+			continue
+		}
+		seq++
+		batch = append(batch, importRow{row: seqEvent{Ev: ev, Seq: seq}, n: im.entries, before: before})
+		if len(batch) == importChunkRows {
+			if err := im.flush(ctx, batch, im.rd.Pos(), im.entries); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if im.db == nil {
+		return nil
+	}
+	return im.flush(ctx, batch, im.rd.Pos(), im.entries)
+}
+
+// flush commits batch and moves the checkpoint to pos. A failed chunk is
+// stored row by row, so that a bad entry is skipped or aborts the import
+// with the checkpoint just before it.
+func (im *importer) flush(ctx context.Context, batch []importRow, pos int64, entries int) error {
+	if len(batch) > 0 {
+		rows := make([]seqEvent, len(batch))
+		for i, r := range batch {
+			rows[i] = r.row
+		}
+		stored, err := im.db.InsertEventBatch(ctx, rows)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			debugPrint(log.Printf, levelWarning, "import chunk of %d entries failed, storing them one by one (%v)\n", len(rows), err)
+			return im.storeEach(ctx, batch, pos, entries)
+		}
+		im.count(stored)
+		im.cp.Seq = rows[len(rows)-1].Seq
+	}
+	return im.commit(pos, entries)
+}
+
+func (im *importer) storeEach(ctx context.Context, batch []importRow, pos int64, entries int) error {
+	for _, r := range batch {
+		stored, err := im.db.InsertEventBatch(ctx, []seqEvent{r.row})
+		if err != nil {
+			if ctx.Err() != nil || !im.skipErr {
+				if cerr := im.commit(r.before, r.n-1); cerr != nil {
+					debugPrint(log.Printf, levelError, "%v\n", cerr)
+				}
+				return fmt.Errorf("entry %d: %w", r.n, err)
+			}
+			im.failed(r.n, err)
+		} else {
+			im.count(stored)
+		}
+		im.cp.Seq = r.row.Seq
+	}
+	return im.commit(pos, entries)
+}
+
+func (im *importer) commit(pos int64, entries int) error {
+	im.cp.Pos, im.cp.Entries = pos, entries
+	im.progress()
+	if im.cpPath == "" {
+		return nil
+	}
+	if err := im.cp.save(im.cpPath); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (im *importer) count(stored []bool) {
+	for _, ok := range stored {
+		if ok {
+			im.cp.Inserted++
+		} else {
+			im.cp.Skipped++
+		}
+	}
+}
+
+func (im *importer) failed(n int, err error) {
+	im.cp.Failed++
+	debugPrint(log.Printf, levelWarning, "import: entry %d skipped: %v\n", n, err)
+}
+
+// progress reports every importProgressEvery on stderr.
+func (im *importer) progress() {
+	if time.Since(im.last) < importProgressEvery {
+		return
+	}
+	im.last = time.Now()
+	done := ""
+	if im.total > 0 {
+		done = fmt.Sprintf(" %.1f%%,", 100*float64(im.rd.Pos())/float64(im.total))
+	}
+	fmt.Fprintf(os.Stderr, "import:%s %d entries, inserted=%d skipped=%d failed=%d\n",
+		done, im.entries, im.cp.Inserted, im.cp.Skipped, im.cp.Failed)
+}
+
+// printDryRun writes the entries read per kind, for the hc format every
+// regex of ParseIngestLine.
+func (im *importer) printDryRun(w io.Writer, format string) {
+	var names []string
+	for k := reCompl; k <= noMatch; k++ {
+		if format == histFormatHC || im.kinds[k.String()] > 0 {
+			names = append(names, k.String())
+		}
+	}
+	for _, k := range []string{histKindTS, histKindNoTS} {
+		if im.kinds[k] > 0 {
+			names = append(names, k)
+		}
+	}
+
+	total := 0
+	for _, n := range im.kinds {
+		total += n
+	}
+	fmt.Fprintf(w, "Dry run (%s): %d entries\n", format, total)
+	for _, k := range names {
+		fmt.Fprintf(w, "  %-14s %d\n", k, im.kinds[k])
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -74,41 +75,72 @@ type IngestConfig struct {
 	AppCfg       *Config
 	RawCIDRRules map[string][]CIDRTenantRule
 	AuthLst      map[Transport][]AuthMode
+	AutoTags     map[string][]autoTagRule
+	Redact       map[string][]*redactRule
+	Filters      map[string][]*ingestFilter
+
+	// duplicate suppression, DedupCache == 0 means disabled
+	DedupWindow time.Duration
+	DedupCache  time.Duration
+
+	// rate limits, connection caps and quotas
+	Limits       LimitsConfig
+	TenantLimits map[string]tenantLimit
 
 	// spooling
 	SpoolDir        string
 	SpoolSyncEveryN int
 	SpoolSyncEvery  time.Duration
 
+	// hash chain, checkpoints every ChainCheckpoint events when > 0
+	ChainEnabled    bool
+	ChainCheckpoint int
+	ChainSigner     crypto.Signer
+
 	// db
 	DBRequired bool
 }
 
 type IngestService struct {
-	cfg       IngestConfig
+	live      atomic.Pointer[IngestConfig] // swapped on reload, see conf()
 	db        DBInterface
 	authFuncs map[string]authFunc
+	tail      *tailHub
+	dedup     *dedupCache
+	limits    *ingestLimits
 
 	// channels between stages
 	rawCh   chan *RawMsg
 	spoolCh chan ValidatedMsg
 	dbCh    chan SeqMsg
 
-	// cancellation
-	ctx    context.Context
-	cancel context.CancelFunc
-	wg     sync.WaitGroup
+	// cancellation, ctx aborts every stage, see Shutdown for the drain
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	connWg  sync.WaitGroup // accept loops and connections, senders on rawCh
+	validWg sync.WaitGroup // validators, senders on spoolCh
+	dbWg    sync.WaitGroup // spooler and db writers
 
 	// listeners
 	rawLn net.Listener
 	tlsLn net.Listener
 
 	// metrics
-	linesAccepted uint64
-	linesDropped  uint64
-	linesSpooled  uint64
-	linesDBOK     uint64
-	linesDBFail   uint64
+	linesAccepted  uint64
+	linesDropped   uint64
+	linesRedacted  uint64
+	linesFiltered  uint64
+	linesDuplicate uint64
+	linesLimited   uint64
+	linesOverQuota uint64
+	metrics        *ingestMetrics
+	spoolHealth    spoolHealth
+	dbProgress     dbProgress
+	linesSpooled   uint64
+	linesDBOK      uint64
+	linesDBFail    uint64
+	linesDBDone    uint64 // stored or found duplicate
 }
 
 type RawMsg struct {
@@ -124,6 +156,8 @@ type ValidatedMsg struct {
 	PeerIP    netip.Addr
 	Received  time.Time
 	Transport Transport
+	Redacted  bool
+	DedupKey  string
 }
 
 type SeqMsg struct {
@@ -133,6 +167,10 @@ type SeqMsg struct {
 	PeerIP    netip.Addr
 	Received  time.Time
 	Transport Transport
+	Redacted  bool
+	DedupKey  string
+	ChainHash string
+	RawCrypt  string // the line of a chained crypt tenant, encrypted as spooled
 }
 
 func SetupIngestion(parent context.Context, opts *Options) (*IngestService, error) {
@@ -170,19 +208,23 @@ func SetupIngestionWithConfig(parent context.Context, cfg IngestConfig) (*Ingest
 	ctx, cancel := context.WithCancel(parent)
 
 	s := &IngestService{
-		cfg:     cfg,
 		rawCh:   make(chan *RawMsg, cfg.QueueDepth),
 		spoolCh: make(chan ValidatedMsg, cfg.QueueDepth),
 		dbCh:    make(chan SeqMsg, cfg.QueueDepth),
+		tail:    newTailHub(),
 		ctx:     ctx,
 		cancel:  cancel,
+		limits:  newIngestLimits(),
+		metrics: newIngestMetrics(),
 	}
+	s.live.Store(&cfg)
+	s.dedup = newDedupCache(cfg.DedupCache)
 
 	if strings.TrimSpace(cfg.AppCfg.DB.DSN) != "" {
 		dbCtx, dbCancel := context.WithTimeout(ctx, 5*time.Second)
 		defer dbCancel()
 
-		db, err := OpenDB(dbCtx, cfg.AppCfg.DB.DSN)
+		db, err := OpenDB(dbCtx, cfg.AppCfg.DB)
 		if err != nil {
 			if cfg.DBRequired {
 				cancel()
@@ -192,18 +234,24 @@ func SetupIngestionWithConfig(parent context.Context, cfg IngestConfig) (*Ingest
 		} else {
 			s.db = db
 			if ensure := getEnsureSchemaFn(db); ensure != nil {
-				if err := ensure(dbCtx); err != nil {
+				// not bound by the connect timeout, an index build scans the table
+				if err := ensure(ctx); err != nil {
+					_ = db.Close()
 					if cfg.DBRequired {
-						_ = db.Close()
 						cancel()
-						return nil, fmt.Errorf("ensure schema failed (required): %w", err)
+						return nil, fmt.Errorf("schema upgrade failed (required), apply it by hand: %w", err)
 					}
-					debugPrint(log.Printf, levelWarning, "warning: ensure schema failed: %v", err)
+					// every insert would fail on the old schema
+					debugPrint(log.Printf, levelWarning, "warning: schema upgrade failed (ingestion will spool but DB insert disabled): %v", err)
+					s.db = nil
 				}
 			}
 			if err != nil {
 				debugPrint(log.Printf, levelInfo, "warning: database has no max seq")
 			}
+			if s.db != nil {
+				s.seedQuotas(dbCtx)
+			}
 
 		}
 	} else if cfg.DBRequired {
@@ -213,6 +261,7 @@ func SetupIngestionWithConfig(parent context.Context, cfg IngestConfig) (*Ingest
 
 	// Start stages
 	s.startValidators()
+	s.startFilterReporter()
 	s.startSpooler()
 	s.startDBWriters()
 
@@ -233,12 +282,27 @@ func SetupIngestionWithConfig(parent context.Context, cfg IngestConfig) (*Ingest
 	return s, nil
 }
 
+// Stop aborts ingestion without draining the queues and closes the
+// database.
 func (s *IngestService) Stop() {
 	debugPrint(log.Printf, levelCrazy, "Args=none\n")
 
 	s.cancel()
+	_ = s.Shutdown(s.ctx)
+	s.Close()
+}
+
+// Shutdown stops ingestion in pipeline order: listeners, connections in
+// flight, validation, spool (fsynced on close) and database writes. When
+// ctx expires first every stage is aborted, the lines not yet stored stay
+// in the spool only. The database is left open, see Close.
+func (s *IngestService) Shutdown(ctx context.Context) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", ctx)
 
-	// close listeners
+	abort := context.AfterFunc(ctx, s.cancel)
+	defer abort()
+
+	// stop accepting
 	if s.rawLn != nil {
 		_ = s.rawLn.Close()
 	}
@@ -246,34 +310,44 @@ func (s *IngestService) Stop() {
 		_ = s.tlsLn.Close()
 	}
 
-	go func() {
-		debugPrint(log.Printf, levelCrazy, "Args=none\n")
-		time.Sleep(100 * time.Millisecond)
-		s.safeCloseChannels()
-	}()
+	// each channel is closed once its senders are gone
+	s.connWg.Wait()
+	close(s.rawCh)
+	s.validWg.Wait()
+	close(s.spoolCh)
+	s.dbWg.Wait()
 
+	err := ctx.Err()
+	s.cancel()
 	s.wg.Wait()
 
-	if s.db != nil {
-		_ = s.db.Close()
+	spooled := atomic.LoadUint64(&s.linesSpooled)
+	switch {
+	case s.db == nil:
+		log.Printf("ingestion stopped, %d lines spooled, no database", spooled)
+	case spooled > atomic.LoadUint64(&s.linesDBDone):
+		log.Printf("ingestion stopped, %d lines left in the spool only", spooled-atomic.LoadUint64(&s.linesDBDone))
+	default:
+		log.Printf("ingestion stopped, queues drained")
 	}
+	return err
 }
 
-func (s *IngestService) safeCloseChannels() {
-	debugPrint(log.Printf, levelCrazy, "Args=none\n")
-
-	defer func() { _ = recover() }()
-	close(s.rawCh)
+// Close closes the database, once Shutdown returned.
+func (s *IngestService) Close() {
+	if s.db != nil {
+		_ = s.db.Close()
+	}
 }
 
 func (s *IngestService) startValidators() {
 	debugPrint(log.Printf, levelCrazy, "Args=none\n")
-	for i := 0; i < s.cfg.ValidateWorkers; i++ {
-		s.wg.Add(1)
+	for i := 0; i < s.conf().ValidateWorkers; i++ {
+		s.validWg.Add(1)
 		go func(workerID int) {
 			debugPrint(log.Printf, levelCrazy, "Args=%d\n", workerID)
 
-			defer s.wg.Done()
+			defer s.validWg.Done()
 			s.validationWorker(workerID)
 		}(i)
 	}
@@ -296,31 +370,80 @@ func (s *IngestService) validationWorker(workerID int) {
 			return
 		case msg, ok := <-s.rawCh:
 			if !ok {
-				debugPrint(log.Printf, levelWarning, "rawCh closed => stop\n")
+				debugPrint(log.Printf, levelDebug, "rawCh closed => stop\n")
 				return
 			}
 
+			cfg := s.conf()
 			tenantPTR, ok := s.resolveTenant(msg)
 			if !ok {
 				debugPrint(log.Printf, levelWarning, "Not allowed / no tenant mapping\n")
-				atomic.AddUint64(&s.linesDropped, 1)
+				s.dropLine(&s.linesDropped, "auth", "", msg.Transport)
 				continue
 			}
 
-			_, mt := ParseIngestLine(tenantPTR.TenantID, msg.Line)
+			var eventID string
+			msg.Line, eventID = extractEventID(msg.Line)
+
+			ev, mt := ParseIngestLine(tenantPTR.TenantID, msg.Line)
 			if mt != reCompl {
-				atomic.AddUint64(&s.linesDropped, 1)
+				s.dropLine(&s.linesDropped, "parse", tenantPTR.TenantID, msg.Transport)
+				continue
+			}
+
+			if f := filterLine(cfg.Filters[tenantPTR.TenantID], ev, msg.PeerIP); f != nil {
+				debugPrint(log.Printf, levelDebug, "line dropped by filter %s\n", f.name)
+				s.dropLine(&s.linesFiltered, "filtered", tenantPTR.TenantID, msg.Transport)
+				continue
+			}
+
+			// a duplicate does not consume the rate or the quota, and a
+			// line refused by them is not recorded: its retransmission
+			// must get through
+			var key string
+			if cfg.DedupCache > 0 {
+				key = tenantDedupKey(tenantPTR, ev, eventID, cfg.DedupWindow)
+				if key != "" && s.dedup.has(tenantPTR.TenantID, key, msg.Received) {
+					debugPrint(log.Printf, levelDebug, "duplicate line dropped (%s)\n", key)
+					s.dropLine(&s.linesDuplicate, "duplicate", tenantPTR.TenantID, msg.Transport)
+					continue
+				}
+			}
+
+			if err := s.limits.admitLine(cfg.TenantLimits[tenantPTR.TenantID], tenantPTR.TenantID, msg.Received); err != nil {
+				debugPrint(log.Printf, levelDebug, "line dropped (%v)\n", err)
+				if errors.Is(err, errQuotaExceeded) {
+					s.dropLine(&s.linesOverQuota, "quota", tenantPTR.TenantID, msg.Transport)
+				} else {
+					s.dropLine(&s.linesLimited, "rate_limit", tenantPTR.TenantID, msg.Transport)
+				}
 				continue
 			}
 
+			// another worker may have admitted a copy meanwhile
+			if key != "" && s.dedup.check(tenantPTR.TenantID, key, msg.Received) {
+				debugPrint(log.Printf, levelDebug, "duplicate line dropped (%s)\n", key)
+				s.dropLine(&s.linesDuplicate, "duplicate", tenantPTR.TenantID, msg.Transport)
+				continue
+			}
+
+			line, redacted := redactLine(cfg.Redact[tenantPTR.TenantID], msg.Line)
+			if redacted {
+				atomic.AddUint64(&s.linesRedacted, 1)
+				s.metrics.redacted.inc(tenantPTR.TenantID, msg.Transport.String())
+			}
+
 			atomic.AddUint64(&s.linesAccepted, 1)
+			s.metrics.accepted.inc(tenantPTR.TenantID, msg.Transport.String())
 
 			out := ValidatedMsg{
-				Line:      msg.Line,
+				Line:      line,
 				TenantPTR: tenantPTR,
 				PeerIP:    msg.PeerIP,
 				Received:  msg.Received,
 				Transport: msg.Transport,
+				Redacted:  redacted,
+				DedupKey:  key,
 			}
 
 			select {
@@ -397,14 +520,14 @@ func (s *IngestService) resolveTenant(msg *RawMsg) (*Tenant, bool) {
 	switch msg.Transport {
 	case TransportRaw:
 		debugPrint(log.Printf, levelDebug, "Raw TCP: message received.\n")
-		tenantPTR, ok := s.ResolveTenantFromAuthList(msg, s.cfg.AuthLst[msg.Transport])
+		tenantPTR, ok := s.ResolveTenantFromAuthList(msg, s.conf().AuthLst[msg.Transport])
 		if !ok {
 			return nil, false
 		}
 		return tenantPTR, true
 	case TransportTLS:
 		debugPrint(log.Printf, levelDebug, "TLS: message received.\n")
-		tenantPTR, ok := s.ResolveTenantFromAuthList(msg, s.cfg.AuthLst[msg.Transport])
+		tenantPTR, ok := s.ResolveTenantFromAuthList(msg, s.conf().AuthLst[msg.Transport])
 		if !ok {
 			return nil, false
 		}
@@ -420,6 +543,7 @@ type tenantSpool struct {
 	path      string
 	file      *os.File
 	seq       int64
+	chain     *tenantChain // nil when the hash chain is disabled
 
 	// sync control
 	writesSinceSync int
@@ -429,9 +553,9 @@ type tenantSpool struct {
 func (s *IngestService) startSpooler() {
 	debugPrint(log.Printf, levelCrazy, "Args=none\n")
 
-	s.wg.Add(1)
+	s.dbWg.Add(1)
 	go func() {
-		defer s.wg.Done()
+		defer s.dbWg.Done()
 		s.spoolerLoop()
 	}()
 }
@@ -443,9 +567,12 @@ func (s *IngestService) spoolerLoop() {
 
 	defer func() {
 		for _, sp := range spools {
+			_ = sp.file.Sync()
 			_ = sp.file.Close()
+			if sp.chain != nil {
+				s.closeChain(sp.chain)
+			}
 		}
-		defer func() { _ = recover() }()
 		close(s.dbCh)
 	}()
 
@@ -461,20 +588,46 @@ func (s *IngestService) spoolerLoop() {
 			sp, err := s.getOrOpenSpool(spools, msg.TenantPTR)
 			if err != nil {
 				debugPrint(log.Printf, levelWarning, "spool open failed tenant=%s: %v", msg.TenantPTR.TenantID, err)
-				atomic.AddUint64(&s.linesDropped, 1)
+				s.spoolHealth.failed(err)
+				s.dropLine(&s.linesDropped, "spool", msg.TenantPTR.TenantID, msg.Transport)
 				continue
 			}
+
+			// the chain of a crypt tenant covers the ciphertext, spooled
+			// and stored as is: a hash of the clear line would let whoever
+			// reads the table confirm a guessed command
+			spoolLine, rawCrypt := msg.Line, ""
+			if sp.chain != nil && msg.TenantPTR.Crypt {
+				if rawCrypt, err = tenantEncrypt(msg.TenantPTR, msg.Line); err != nil {
+					debugPrint(log.Printf, levelWarning, "spool encryption failed tenant=%s: %v", msg.TenantPTR.TenantID, err)
+					s.dropLine(&s.linesDropped, "spool", msg.TenantPTR.TenantID, msg.Transport)
+					continue
+				}
+				spoolLine = rawCrypt
+			}
+
 			sp.seq++
 			seq := sp.seq
 			debugPrint(log.Printf, levelDebug, "Sequence number assigned (%d)\n", seq)
 
-			record := buildSpoolRecord(seq, msg.Line)
+			var hash string
+			if sp.chain != nil {
+				hash = chainHash(sp.chain.hash, msg.TenantPTR.TenantID, seq, spoolLine)
+			}
+
+			record := buildSpoolRecord(seq, spoolLine)
 			if _, err := sp.file.Write(record); err != nil {
 				debugPrint(log.Printf, levelWarning, "spool write failed tenant=%s: %v", msg.TenantPTR.TenantID, err)
-				atomic.AddUint64(&s.linesDropped, 1)
+				s.spoolHealth.failed(err)
+				s.dropLine(&s.linesDropped, "spool", msg.TenantPTR.TenantID, msg.Transport)
 				continue
 			}
+			if sp.chain != nil {
+				s.chainSpooled(sp, seq, hash)
+			}
 			atomic.AddUint64(&s.linesSpooled, 1)
+			s.spoolHealth.written(msg.TenantPTR.TenantID, seq)
+			s.metrics.spooled.inc(msg.TenantPTR.TenantID, msg.Transport.String())
 
 			s.maybeSyncSpool(sp)
 
@@ -485,6 +638,10 @@ func (s *IngestService) spoolerLoop() {
 				PeerIP:    msg.PeerIP,
 				Received:  msg.Received,
 				Transport: msg.Transport,
+				Redacted:  msg.Redacted,
+				DedupKey:  msg.DedupKey,
+				ChainHash: hash,
+				RawCrypt:  rawCrypt,
 			}
 
 			select {
@@ -504,7 +661,7 @@ func (s *IngestService) getOrOpenSpool(spools map[string]*tenantSpool, tenantPTR
 	}
 
 	filename := tenantPTR.TenantID + ".log"
-	path := filepath.Join(s.cfg.SpoolDir, filename)
+	path := filepath.Join(s.conf().SpoolDir, filename)
 	debugPrint(log.Printf, levelDebug, "tenant spool file %s\n", filename)
 
 	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
@@ -533,6 +690,13 @@ func (s *IngestService) getOrOpenSpool(spools map[string]*tenantSpool, tenantPTR
 		seq:       seq,
 		lastSync:  time.Now(),
 	}
+	if s.conf().ChainEnabled {
+		if sp.chain, err = openTenantChain(s.conf().SpoolDir, tenantPTR.TenantID, path); err != nil {
+			debugPrint(log.Printf, levelWarning, "can't open hash chain\n")
+			_ = f.Close()
+			return nil, err
+		}
+	}
 	spools[tenantPTR.TenantID] = sp
 	return sp, nil
 }
@@ -540,42 +704,53 @@ func (s *IngestService) getOrOpenSpool(spools map[string]*tenantSpool, tenantPTR
 func buildSpoolRecord(seq int64, line string) []byte {
 	debugPrint(log.Printf, levelCrazy, "Args=%d, %s\n", seq, line)
 
+	return []byte(fmt.Sprintf("%d\t%s\n", seq, spoolText(line)))
+}
+
+// spoolText is line as written in the spool, on one line.
+func spoolText(line string) string {
 	line = strings.ReplaceAll(line, "\r", `\r`)
 	line = strings.ReplaceAll(line, "\n", `\n`)
-	line = strings.TrimRight(line, "\r\n")
-
-	return []byte(fmt.Sprintf("%d\t%s\n", seq, line))
+	return strings.TrimRight(line, "\r\n")
 }
 
 func (s *IngestService) maybeSyncSpool(sp *tenantSpool) {
 	debugPrint(log.Printf, levelCrazy, "Args=%v\n", sp)
 
 	now := time.Now()
-	if s.cfg.SpoolSyncEveryN > 0 {
+	if s.conf().SpoolSyncEveryN > 0 {
 		sp.writesSinceSync++
-		if sp.writesSinceSync >= s.cfg.SpoolSyncEveryN {
-			_ = sp.file.Sync()
+		if sp.writesSinceSync >= s.conf().SpoolSyncEveryN {
+			sp.sync()
 			sp.writesSinceSync = 0
 			sp.lastSync = now
 			return
 		}
 	}
-	if s.cfg.SpoolSyncEvery > 0 && now.Sub(sp.lastSync) >= s.cfg.SpoolSyncEvery {
-		_ = sp.file.Sync()
+	if s.conf().SpoolSyncEvery > 0 && now.Sub(sp.lastSync) >= s.conf().SpoolSyncEvery {
+		sp.sync()
 		sp.writesSinceSync = 0
 		sp.lastSync = now
 	}
 }
 
+// sync flushes the spool file and the chain head.
+func (sp *tenantSpool) sync() {
+	_ = sp.file.Sync()
+	if sp.chain != nil {
+		_ = sp.chain.head.Sync()
+	}
+}
+
 func (s *IngestService) startDBWriters() {
 	debugPrint(log.Printf, levelCrazy, "Args=none\n")
 
-	for i := 0; i < s.cfg.DBWorkers; i++ {
-		s.wg.Add(1)
+	for i := 0; i < s.conf().DBWorkers; i++ {
+		s.dbWg.Add(1)
 		go func(workerID int) {
 			debugPrint(log.Printf, levelCrazy, "Args=%d\n", workerID)
 
-			defer s.wg.Done()
+			defer s.dbWg.Done()
 			s.dbWorker(workerID)
 		}(i)
 	}
@@ -589,90 +764,183 @@ func (s *IngestService) dbWorker(workerID int) {
 			select {
 			case <-s.ctx.Done():
 				return
-			case _, ok := <-s.dbCh:
+			case msg, ok := <-s.dbCh:
 				if !ok {
 					debugPrint(log.Printf, levelDebug, "Success (No DB)\n")
 					return
 				}
 				debugPrint(log.Printf, levelWarning, "Can't access db channel (No DB)\n")
 				atomic.AddUint64(&s.linesDBFail, 1)
+				s.metrics.dbInserts.inc(msg.TenantPTR.TenantID, msg.Transport.String(), "no_db")
 			}
 		}
 	}
 
-	backoff := 200 * time.Millisecond
-	maxBackoff := 5 * time.Second
-
+	var batch []SeqMsg
 	for {
-		select {
-		case <-s.ctx.Done():
-			return
-		case msg, ok := <-s.dbCh:
-			if !ok {
-				debugPrint(log.Printf, levelDebug, "Can't access db channel\n")
+		size, wait := dbBatchParams(s.conf().AppCfg.Globals.DBBatch)
+		if size <= 1 {
+			select {
+			case <-s.ctx.Done():
 				return
-			}
-
-			ev, _ := ParseIngestLine(msg.TenantPTR.TenantID, msg.Line)
-			tmp := msg.PeerIP.String()
-			ev.Transport = msg.Transport.String()
-			ev.SrcIP = &tmp
-
-			for {
-				err := s.dbInsertWithSeq(s.ctx, msg, ev)
-				if err == nil {
-					debugPrint(log.Printf, levelDebug, "DB insert Success\n")
-					atomic.AddUint64(&s.linesDBOK, 1)
-					backoff = 200 * time.Millisecond
-					break
-				}
-				debugPrint(log.Printf, levelWarning, "DB insert Failure (%v)\n", err)
-				atomic.AddUint64(&s.linesDBFail, 1)
-
-				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			case msg, ok := <-s.dbCh:
+				if !ok {
+					debugPrint(log.Printf, levelDebug, "Can't access db channel\n")
 					return
 				}
-
-				select {
-				case <-s.ctx.Done():
+				if !s.storeOne(msg) {
 					return
-				case <-time.After(backoff):
-				}
-				backoff *= 2
-				if backoff > maxBackoff {
-					backoff = maxBackoff
 				}
 			}
+			continue
+		}
+
+		var more bool
+		batch, more = s.collectBatch(batch[:0], size, wait)
+		if len(batch) > 0 && !s.storeBatch(batch) {
+			return
+		}
+		if !more {
+			debugPrint(log.Printf, levelDebug, "Can't access db channel\n")
+			return
 		}
 	}
 }
 
-func (s *IngestService) dbInsertWithSeq(ctx context.Context, msg SeqMsg, ev Event) error {
-	debugPrint(log.Printf, levelCrazy, "Args=%v, %v, %v\n", ctx, msg, ev)
+// seqMsgEvent builds the row stored for msg.
+func (s *IngestService) seqMsgEvent(msg SeqMsg) Event {
+	ev, _ := ParseIngestLine(msg.TenantPTR.TenantID, msg.Line)
+	tmp := msg.PeerIP.String()
+	ev.Transport = msg.Transport.String()
+	ev.SrcIP = &tmp
+	ev.DedupKey = msg.DedupKey
+	ev.ChainHash = msg.ChainHash
+	ev.Tags = matchAutoTags(s.conf().AutoTags[msg.TenantPTR.TenantID], ev)
+	if msg.Redacted {
+		ev.Tags = append(ev.Tags, redactedTag)
+	}
+	return ev
+}
 
-	if msg.TenantPTR.Crypt {
-		debugPrint(log.Printf, levelCrazy, "Encryption enabled for payload \"%s\"\n", msg.Line)
-		PubKey, err := base64.StdEncoding.DecodeString(msg.TenantPTR.PubKey)
-		if err != nil {
-			return fmt.Errorf("Error: crypt requested, but not usable password provided. Message dropped.")
+// storeOne inserts msg, retrying with backoff until it is stored. It
+// returns false when the service is stopped.
+func (s *IngestService) storeOne(msg SeqMsg) bool {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", msg)
+
+	backoff := 200 * time.Millisecond
+	maxBackoff := 5 * time.Second
+
+	ev := s.seqMsgEvent(msg)
+	tenantID, tr := msg.TenantPTR.TenantID, msg.Transport.String()
+	for {
+		start := time.Now()
+		err := s.dbInsertWithSeq(s.ctx, msg, ev)
+		s.metrics.dbLatency.observe(time.Since(start).Seconds(), tenantID)
+		if err == nil {
+			debugPrint(log.Printf, levelDebug, "DB insert Success\n")
+			atomic.AddUint64(&s.linesDBOK, 1)
+			s.dbDone(msg)
+			s.metrics.dbInserts.inc(tenantID, tr, "ok")
+			return true
 		}
-		crypt, err := cryptString(ev.RawLine, PubKey)
-		if err != nil {
-			return fmt.Errorf("Error: %v. Message dropped.\n", err)
+		if errors.Is(err, errDuplicateEvent) {
+			debugPrint(log.Printf, levelDebug, "DB insert skipped, duplicate of a stored event\n")
+			s.dbDone(msg)
+			s.metrics.dbInserts.inc(tenantID, tr, "duplicate")
+			s.dropLine(&s.linesDuplicate, "duplicate", tenantID, msg.Transport)
+			return true
 		}
-		debugPrint(log.Printf, levelCrazy, "Crypt success, new line is \"%s\"\n", crypt)
-		ev.RawLine = crypt
-		crypt, err = cryptString(*ev.Cmd, PubKey)
+		debugPrint(log.Printf, levelWarning, "DB insert Failure (%v)\n", err)
+		atomic.AddUint64(&s.linesDBFail, 1)
+		s.metrics.dbInserts.inc(tenantID, tr, "fail")
+
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// dbDone counts msg as handled by the database workers.
+func (s *IngestService) dbDone(msg SeqMsg) {
+	atomic.AddUint64(&s.linesDBDone, 1)
+	s.dbProgress.done(msg.TenantPTR.TenantID, msg.Seq)
+}
+
+func (s *IngestService) dbInsertWithSeq(ctx context.Context, msg SeqMsg, ev Event) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v, %v\n", ctx, msg, ev)
+
+	ev, err := encryptEventLine(msg.TenantPTR, ev, msg.RawCrypt)
+	if err != nil {
+		return err
+	}
+
+	inserter := getInsertEventWithSeqFn(s.db)
+	if inserter == nil {
+		return fmt.Errorf("db insert not implemented: add DB.InsertEventWithSeq")
+	}
+	if err := inserter(ctx, ev, msg.Seq); err != nil {
+		return err
+	}
+	s.tail.Publish(msg.Seq, ev)
+	return nil
+}
+
+// encryptEvent encrypts the line and command of ev for the tenants with
+// crypt enabled.
+func encryptEvent(tenantPTR *Tenant, ev Event) (Event, error) {
+	return encryptEventLine(tenantPTR, ev, "")
+}
+
+// encryptEventLine is encryptEvent with the line already encrypted as
+// rawCrypt when not empty: the spooler encrypts the lines of the chained
+// crypt tenants, the stored ciphertext is the one the chain hash covers.
+func encryptEventLine(tenantPTR *Tenant, ev Event, rawCrypt string) (Event, error) {
+	if !tenantPTR.Crypt {
+		return ev, nil
+	}
+	debugPrint(log.Printf, levelCrazy, "Encryption enabled for payload \"%s\"\n", ev.RawLine)
+	if rawCrypt == "" {
+		crypt, err := tenantEncrypt(tenantPTR, ev.RawLine)
 		if err != nil {
-			return fmt.Errorf("Error: %v. Message dropped.\n", err)
+			return ev, err
 		}
-		ev.Cmd = &crypt
+		rawCrypt = crypt
 	}
+	debugPrint(log.Printf, levelCrazy, "Crypt success, new line is \"%s\"\n", rawCrypt)
+	ev.RawLine = rawCrypt
+	if ev.Cmd == nil {
+		// unparsed line, nothing else to encrypt
+		return ev, nil
+	}
+	crypt, err := tenantEncrypt(tenantPTR, *ev.Cmd)
+	if err != nil {
+		return ev, err
+	}
+	ev.Cmd = &crypt
+	return ev, nil
+}
 
-	if inserter := getInsertEventWithSeqFn(s.db); inserter != nil {
-		return inserter(ctx, ev, msg.Seq)
+// tenantEncrypt encrypts s with the public key of the tenant.
+func tenantEncrypt(tenantPTR *Tenant, s string) (string, error) {
+	PubKey, err := base64.StdEncoding.DecodeString(tenantPTR.PubKey)
+	if err != nil {
+		return "", fmt.Errorf("Error: crypt requested, but not usable password provided. Message dropped.")
 	}
-	return fmt.Errorf("db insert not implemented: add DB.InsertEventWithSeq")
+	crypt, err := cryptString(s, PubKey)
+	if err != nil {
+		return "", fmt.Errorf("Error: %v. Message dropped.\n", err)
+	}
+	return crypt, nil
 }
 
 func (s *IngestService) dbMaxSeq(ctx context.Context, tenantPTR *Tenant) (int64, error) {
@@ -687,16 +955,16 @@ func (s *IngestService) dbMaxSeq(ctx context.Context, tenantPTR *Tenant) (int64,
 func (s *IngestService) startRawListener() error {
 	debugPrint(log.Printf, levelCrazy, "Args=none\n")
 
-	ln, err := net.Listen("tcp", s.cfg.RawAddr)
+	ln, err := net.Listen("tcp", s.conf().RawAddr)
 	if err != nil {
-		return fmt.Errorf("raw listen %s: %w", s.cfg.RawAddr, err)
+		return fmt.Errorf("raw listen %s: %w", s.conf().RawAddr, err)
 	}
 	s.rawLn = ln
 
-	s.wg.Add(1)
+	s.connWg.Add(1)
 	go func() {
-		defer s.wg.Done()
-		debugPrint(log.Printf, levelInfo, "ingest raw listening on %s", s.cfg.RawAddr)
+		defer s.connWg.Done()
+		debugPrint(log.Printf, levelInfo, "ingest raw listening on %s", s.conf().RawAddr)
 		s.acceptLoop(ln, TransportRaw)
 	}()
 	return nil
@@ -705,19 +973,29 @@ func (s *IngestService) startRawListener() error {
 func (s *IngestService) startTLSListener() error {
 	debugPrint(log.Printf, levelCrazy, "Args=none\n")
 
-	if s.cfg.TLSConfig == nil {
+	if s.conf().TLSConfig == nil {
 		return fmt.Errorf("tls enabled but TLSConfig is nil")
 	}
-	ln, err := tls.Listen("tcp", s.cfg.TLSAddr, s.cfg.TLSConfig)
+	// the certificate is looked up per handshake, a reload can replace it
+	tlsCfg := s.conf().TLSConfig.Clone()
+	tlsCfg.Certificates = nil
+	tlsCfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		c := s.conf().TLSConfig
+		if c == nil || len(c.Certificates) == 0 {
+			return nil, fmt.Errorf("no ingestion certificate")
+		}
+		return &c.Certificates[0], nil
+	}
+	ln, err := tls.Listen("tcp", s.conf().TLSAddr, tlsCfg)
 	if err != nil {
-		return fmt.Errorf("tls listen %s: %w", s.cfg.TLSAddr, err)
+		return fmt.Errorf("tls listen %s: %w", s.conf().TLSAddr, err)
 	}
 	s.tlsLn = ln
 
-	s.wg.Add(1)
+	s.connWg.Add(1)
 	go func() {
-		defer s.wg.Done()
-		debugPrint(log.Printf, levelInfo, "ingest tls listening on %s", s.cfg.TLSAddr)
+		defer s.connWg.Done()
+		debugPrint(log.Printf, levelInfo, "ingest tls listening on %s", s.conf().TLSAddr)
 		s.acceptLoop(ln, TransportTLS)
 	}()
 	return nil
@@ -728,6 +1006,9 @@ func (s *IngestService) acceptLoop(ln net.Listener, tr Transport) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			select {
 			case <-s.ctx.Done():
 				return
@@ -737,15 +1018,25 @@ func (s *IngestService) acceptLoop(ln net.Listener, tr Transport) {
 			continue
 		}
 
-		s.wg.Add(1)
+		s.connWg.Add(1)
 		go func(c net.Conn) {
-			defer s.wg.Done()
+			defer s.connWg.Done()
 			defer c.Close()
 
 			peerIP := peerAddrIP(c.RemoteAddr())
 			if !peerIP.IsValid() {
 				return
 			}
+			if err := s.limits.admitConn(s.conf().Limits, peerIP, time.Now()); err != nil {
+				if errors.Is(err, errTooManyConns) {
+					s.metrics.connsRej.inc(tr.String())
+				} else {
+					s.dropLine(&s.linesLimited, "rate_limit", "", tr)
+				}
+				rejectConn(c, err)
+				return
+			}
+			defer s.limits.releaseConn(peerIP)
 
 			s.readConnLines(c, peerIP, tr)
 		}(conn)
@@ -754,7 +1045,7 @@ func (s *IngestService) acceptLoop(ln net.Listener, tr Transport) {
 
 func (s *IngestService) readConnLines(r io.Reader, peerIP netip.Addr, tr Transport) {
 	debugPrint(log.Printf, levelCrazy, "Args=%v,%v, %d\n", r, peerIP, tr)
-	max := s.cfg.MaxLineBytes
+	max := s.conf().MaxLineBytes
 	if max <= 0 {
 		max = 16 * 1024
 	}
@@ -762,19 +1053,20 @@ func (s *IngestService) readConnLines(r io.Reader, peerIP netip.Addr, tr Transpo
 	data, tooBig, err := readAllLimit(r, max+1)
 	if err != nil {
 		debugPrint(log.Printf, levelDebug, "Line dropped due to an error: %w\n", err)
-		atomic.AddUint64(&s.linesDropped, 1)
+		s.dropLine(&s.linesDropped, "read", "", tr)
 		return
 	}
 	debugPrint(log.Printf, levelCrazy, "Received Line = \"%s\"\n", string(data))
 	if tooBig {
 		debugPrint(log.Printf, levelDebug, "Line dropped due to size: too long\n")
-		atomic.AddUint64(&s.linesDropped, 1)
+		s.dropLine(&s.linesDropped, "size", "", tr)
 		return
 	}
 	if len(data) == 0 {
 		debugPrint(log.Printf, levelNotice, "Empty line received\n")
 		return
 	}
+	s.metrics.received.inc(tr.String())
 
 	lfCount := 0
 	for _, b := range data {
@@ -785,13 +1077,13 @@ func (s *IngestService) readConnLines(r io.Reader, peerIP netip.Addr, tr Transpo
 
 	if lfCount != 1 {
 		debugPrint(log.Printf, levelDebug, "Line dropped due to carrige return: only one is allowed, there's more!\n")
-		atomic.AddUint64(&s.linesDropped, 1)
+		s.dropLine(&s.linesDropped, "newline", "", tr)
 		return
 	}
 
 	if data[len(data)-1] != '\n' {
 		debugPrint(log.Printf, levelDebug, "Line dropped due to carrige return: Only one expected at the end\n")
-		atomic.AddUint64(&s.linesDropped, 1)
+		s.dropLine(&s.linesDropped, "newline", "", tr)
 		return
 	}
 
@@ -891,9 +1183,15 @@ type ensureSchemaFn func(context.Context) error
 type insertEventWithSeqFn func(context.Context, Event, int64) error
 type maxSeqFn func(context.Context, string) (int64, error)
 
+// getEnsureSchemaFn returns the schema upgrade run at startup: the tables
+// are created with the schema files, a server only adds what a newer hc
+// writes to them.
 func getEnsureSchemaFn(db DBInterface) ensureSchemaFn {
 	debugPrint(log.Printf, levelCrazy, "Args=%v\n", db)
-	return nil
+	if db == nil {
+		return nil
+	}
+	return db.UpgradeSchema
 }
 
 func getInsertEventWithSeqFn(db DBInterface) insertEventWithSeqFn {
@@ -1001,25 +1299,70 @@ func NewIngestConfigFromOptions(opts *Options) (IngestConfig, error) {
 		return cfg, fmt.Errorf("ingestion: error parsing CIDR (%w)\n", err)
 	}
 
+	cfg.AutoTags, err = compileAutoTags(&opts.Cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("ingestion: error compiling auto tags (%w)\n", err)
+	}
+	cfg.Redact, err = compileRedactRules(&opts.Cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("ingestion: error compiling redact rules (%w)\n", err)
+	}
+	cfg.Filters, err = compileIngestFilters(&opts.Cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("ingestion: error compiling filters (%w)\n", err)
+	}
+
+	cfg.Limits = opts.Cfg.Globals.Limits
+	cfg.TenantLimits = resolveTenantLimits(&opts.Cfg)
+
+	if d := opts.Cfg.Globals.Dedup; d.Enabled {
+		cfg.DedupWindow = dedupDefaultWindow
+		if d.WindowSeconds > 0 {
+			cfg.DedupWindow = time.Duration(d.WindowSeconds) * time.Second
+		}
+		cfg.DedupCache = dedupDefaultCache
+		if d.CacheSeconds > 0 {
+			cfg.DedupCache = time.Duration(d.CacheSeconds) * time.Second
+		}
+	}
+
+	if c := opts.Cfg.Globals.Chain; c.Enabled {
+		cfg.ChainEnabled = true
+		if c.CheckpointEvery > 0 {
+			cfg.ChainCheckpoint = c.CheckpointEvery
+			cfg.ChainSigner, err = chainSigner(opts.Cfg.Globals.Identity.CertFile, opts.Cfg.Globals.Identity.KeyFile)
+			if err != nil {
+				return cfg, fmt.Errorf("ingestion: chain checkpoint key (%w)\n", err)
+			}
+		}
+	}
+
 	if !cfg.RawEnabled && !cfg.TLSEnabled {
 		return cfg, fmt.Errorf("ingestion: no listeners enabled (raw/tls)")
 	}
 	return cfg, nil
 }
 
+// conf returns the running configuration. It is never modified, a reload
+// stores a new one, so the returned pointers stay valid.
+func (s *IngestService) conf() *IngestConfig {
+	return s.live.Load()
+}
+
 func (s *IngestService) getDefaultTenantPTR() *Tenant {
-	for _, t := range s.cfg.AppCfg.Tenants {
-		if t.TenantID == s.cfg.AppCfg.Globals.DefaultTenantID {
-			return &t
-		}
-	}
-	return nil
+	app := s.conf().AppCfg
+	return findTenant(app, app.Globals.DefaultTenantID)
 }
 
 func (s *IngestService) getTenantPTR(tenantID string) *Tenant {
-	for _, t := range s.cfg.AppCfg.Tenants {
-		if t.TenantID == tenantID {
-			return &t
+	return findTenant(s.conf().AppCfg, tenantID)
+}
+
+// findTenant points into cfg.Tenants, not to a copy.
+func findTenant(cfg *Config, tenantID string) *Tenant {
+	for i := range cfg.Tenants {
+		if cfg.Tenants[i].TenantID == tenantID {
+			return &cfg.Tenants[i]
 		}
 	}
 	return nil
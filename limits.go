@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	limitSweepEvery = time.Minute
+	limitLogEvery   = time.Minute
+)
+
+var (
+	errRateLimited   = errors.New("rate limit exceeded")
+	errQuotaExceeded = errors.New("daily quota exceeded")
+	errTooManyConns  = errors.New("too many connections")
+)
+
+// tenantLimit is the effective rate and quota of a tenant, 0 = unlimited.
+type tenantLimit struct {
+	rate  float64
+	burst float64
+	daily int64
+}
+
+func limitBurst(rate float64, burst int) float64 {
+	if burst > 0 {
+		return float64(burst)
+	}
+	return math.Max(1, math.Ceil(rate))
+}
+
+// resolveTenantLimits merges globals.limits with the tenant overrides.
+func resolveTenantLimits(cfg *Config) map[string]tenantLimit {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", cfg)
+
+	g := cfg.Globals.Limits
+	result := make(map[string]tenantLimit, len(cfg.Tenants))
+	for _, t := range cfg.Tenants {
+		rate, burst, daily := g.TenantRate, g.TenantBurst, g.TenantDailyRows
+		switch {
+		case t.Limits.Rate > 0:
+			rate = t.Limits.Rate
+		case t.Limits.Rate < 0:
+			rate = 0
+		}
+		if t.Limits.Burst > 0 {
+			burst = t.Limits.Burst
+		}
+		switch {
+		case t.Limits.DailyRows > 0:
+			daily = t.Limits.DailyRows
+		case t.Limits.DailyRows < 0:
+			daily = 0
+		}
+		tl := tenantLimit{rate: rate, daily: daily}
+		if rate > 0 {
+			tl.burst = limitBurst(rate, burst)
+		}
+		result[t.TenantID] = tl
+	}
+	return result
+}
+
+type tokenBucket struct {
+	tokens float64
+	rate   float64
+	burst  float64
+	last   time.Time
+}
+
+// rateLimiter keeps one token bucket per key.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// allow takes one token from the bucket of key. rate <= 0 is unlimited.
+func (l *rateLimiter) allow(key string, rate, burst float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > limitSweepEvery {
+		// a bucket full again is the same as no bucket
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Seconds()*rate)
+		b.last = now
+	}
+	b.rate, b.burst = rate, burst
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// connLimiter counts the concurrent connections, in total and per source.
+type connLimiter struct {
+	mu       sync.Mutex
+	total    int
+	bySource map[netip.Addr]int
+}
+
+// acquire registers a connection unless it exceeds max or perSource,
+// 0 means no cap.
+func (c *connLimiter) acquire(ip netip.Addr, max, perSource int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if max > 0 && c.total >= max {
+		return false
+	}
+	if perSource > 0 && c.bySource[ip] >= perSource {
+		return false
+	}
+	c.total++
+	c.bySource[ip]++
+	return true
+}
+
+func (c *connLimiter) release(ip netip.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.total--
+	if c.bySource[ip]--; c.bySource[ip] <= 0 {
+		delete(c.bySource, ip)
+	}
+}
+
+// dailyQuota counts the accepted lines per tenant for the current UTC day.
+type dailyQuota struct {
+	mu     sync.Mutex
+	day    string
+	used   map[string]int64
+	warned map[string]bool
+}
+
+func (q *dailyQuota) rollover(now time.Time) {
+	if day := now.UTC().Format("2006-01-02"); day != q.day {
+		q.day = day
+		q.used = make(map[string]int64)
+		q.warned = make(map[string]bool)
+	}
+}
+
+// take accounts one line, first is true the first time the quota is hit.
+func (q *dailyQuota) take(tenantID string, limit int64, now time.Time) (ok bool, first bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(now)
+	if q.used[tenantID] >= limit {
+		first = !q.warned[tenantID]
+		q.warned[tenantID] = true
+		return false, first
+	}
+	q.used[tenantID]++
+	return true, false
+}
+
+// seed sets the usage of tenantID, e.g. the rows already stored today.
+func (q *dailyQuota) seed(tenantID string, used int64, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(now)
+	q.used[tenantID] += used
+}
+
+// ingestLimits holds the state of the rate limits, connection caps and
+// quotas. The limits themselves come from the running configuration.
+type ingestLimits struct {
+	source *rateLimiter
+	tenant *rateLimiter
+	conns  *connLimiter
+	quota  *dailyQuota
+
+	logMu   sync.Mutex
+	lastLog map[string]time.Time
+}
+
+func newIngestLimits() *ingestLimits {
+	return &ingestLimits{
+		source:  newRateLimiter(),
+		tenant:  newRateLimiter(),
+		conns:   &connLimiter{bySource: make(map[netip.Addr]int)},
+		quota:   &dailyQuota{},
+		lastLog: make(map[string]time.Time),
+	}
+}
+
+// logf logs at most once every limitLogEvery per key, a flood must not
+// turn into a log flood.
+func (l *ingestLimits) logf(key string, now time.Time, format string, args ...any) {
+	l.logMu.Lock()
+	last, seen := l.lastLog[key]
+	if seen && now.Sub(last) < limitLogEvery {
+		l.logMu.Unlock()
+		return
+	}
+	l.lastLog[key] = now
+	l.logMu.Unlock()
+	log.Printf(format, args...)
+}
+
+// admitConn checks a new connection against the connection caps and the
+// source rate. The caller must call releaseConn when it returns nil.
+func (l *ingestLimits) admitConn(cfg LimitsConfig, ip netip.Addr, now time.Time) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", cfg, ip)
+
+	if !l.conns.acquire(ip, cfg.MaxConns, cfg.SourceConns) {
+		l.logf("conns/"+ip.String(), now, "limits: too many connections, src=%s rejected", ip)
+		return errTooManyConns
+	}
+	// one line per connection
+	if !l.source.allow(ip.String(), cfg.SourceRate, limitBurst(cfg.SourceRate, cfg.SourceBurst), now) {
+		l.releaseConn(ip)
+		l.logf("rate/"+ip.String(), now, "limits: rate limit exceeded, src=%s rejected", ip)
+		return errRateLimited
+	}
+	return nil
+}
+
+func (l *ingestLimits) releaseConn(ip netip.Addr) {
+	l.conns.release(ip)
+}
+
+// admitLine checks a validated line against the tenant rate and quota.
+func (l *ingestLimits) admitLine(tl tenantLimit, tenantID string, now time.Time) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %s\n", tl, tenantID)
+
+	if !l.tenant.allow(tenantID, tl.rate, tl.burst, now) {
+		l.logf("rate/"+tenantID, now, "limits: rate limit exceeded, tenant=%s lines dropped", tenantID)
+		return errRateLimited
+	}
+	if tl.daily > 0 {
+		if ok, first := l.quota.take(tenantID, tl.daily, now); !ok {
+			if first {
+				log.Printf("limits: daily quota of %d rows reached, tenant=%s lines dropped until 00:00 UTC", tl.daily, tenantID)
+			}
+			return errQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// seedQuotas loads the rows stored today so a restart does not reset the
+// daily quotas.
+func (s *IngestService) seedQuotas(ctx context.Context) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", ctx)
+
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for tenantID, tl := range s.conf().TenantLimits {
+		if tl.daily <= 0 {
+			continue
+		}
+		n, err := s.db.CountEventsSince(ctx, tenantID, midnight)
+		if err != nil {
+			debugPrint(log.Printf, levelWarning, "warning: can't load daily usage tenant=%s: %v", tenantID, err)
+			continue
+		}
+		s.limits.quota.seed(tenantID, n, now)
+	}
+}
+
+// rejectConn tells the sender why its line is refused.
+func rejectConn(c net.Conn, err error) {
+	_ = c.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = io.WriteString(c, "hc: "+err.Error()+"\n")
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Latency buckets, in seconds.
+var (
+	dbLatencyBuckets   = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+	httpLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+)
+
+// metricVec is a counter or histogram family in the Prometheus text
+// format, one series per label values combination.
+type metricVec struct {
+	name    string
+	help    string
+	kind    string // "counter" / "histogram"
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	values []string
+	count  uint64
+	sum    float64
+	bucket []uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "counter", labels: labels, series: make(map[string]*metricSeries)}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+}
+
+func (v *metricVec) get(values []string) *metricSeries {
+	k := strings.Join(values, "\x00")
+	ms, ok := v.series[k]
+	if !ok {
+		ms = &metricSeries{values: append([]string(nil), values...), bucket: make([]uint64, len(v.buckets))}
+		v.series[k] = ms
+	}
+	return ms
+}
+
+func (v *metricVec) inc(values ...string) {
+	v.mu.Lock()
+	v.get(values).count++
+	v.mu.Unlock()
+}
+
+func (v *metricVec) observe(x float64, values ...string) {
+	v.mu.Lock()
+	ms := v.get(values)
+	ms.count++
+	ms.sum += x
+	for i, le := range v.buckets {
+		if x <= le {
+			ms.bucket[i]++
+		}
+	}
+	v.mu.Unlock()
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ms := v.series[k]
+		if v.kind == "counter" {
+			writeSample(w, v.name, v.labels, ms.values, float64(ms.count))
+			continue
+		}
+		labels := append(append([]string(nil), v.labels...), "le")
+		for i, le := range v.buckets {
+			writeSample(w, v.name+"_bucket", labels, append(append([]string(nil), ms.values...), formatFloat(le)), float64(ms.bucket[i]))
+		}
+		writeSample(w, v.name+"_bucket", labels, append(append([]string(nil), ms.values...), "+Inf"), float64(ms.count))
+		writeSample(w, v.name+"_sum", v.labels, ms.values, ms.sum)
+		writeSample(w, v.name+"_count", v.labels, ms.values, float64(ms.count))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w io.Writer, name string, labels, values []string, v float64) {
+	var sb strings.Builder
+	sb.WriteString(name)
+	if len(labels) > 0 {
+		sb.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(l)
+			sb.WriteString(`="`)
+			sb.WriteString(labelEscaper.Replace(values[i]))
+			sb.WriteByte('"')
+		}
+		sb.WriteByte('}')
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(formatFloat(v))
+	sb.WriteByte('\n')
+	io.WriteString(w, sb.String())
+}
+
+func writeFamily(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// ingestMetrics holds the labelled counters of the ingestion pipeline and
+// of the HTTP handlers. Tenants are identified by their id.
+type ingestMetrics struct {
+	received  *metricVec
+	accepted  *metricVec
+	redacted  *metricVec
+	spooled   *metricVec
+	dropped   *metricVec
+	connsRej  *metricVec
+	dbInserts *metricVec
+	dbLatency *metricVec
+
+	httpRequests *metricVec
+	httpLatency  *metricVec
+}
+
+func newIngestMetrics() *ingestMetrics {
+	return &ingestMetrics{
+		received:  newCounterVec("hc_ingest_lines_received_total", "Lines read from ingestion connections.", "transport"),
+		accepted:  newCounterVec("hc_ingest_lines_accepted_total", "Lines validated and queued for spooling.", "tenant", "transport"),
+		redacted:  newCounterVec("hc_ingest_lines_redacted_total", "Accepted lines rewritten by secret redaction.", "tenant", "transport"),
+		spooled:   newCounterVec("hc_ingest_lines_spooled_total", "Lines written to the tenant spool.", "tenant", "transport"),
+		dropped:   newCounterVec("hc_ingest_lines_dropped_total", "Lines discarded, by reason.", "tenant", "transport", "reason"),
+		connsRej:  newCounterVec("hc_ingest_connections_rejected_total", "Connections refused by the connection caps.", "transport"),
+		dbInserts: newCounterVec("hc_ingest_db_inserts_total", "Database insert attempts, by result.", "tenant", "transport", "result"),
+		dbLatency: newHistogramVec("hc_ingest_db_insert_duration_seconds", "Database insert latency.", dbLatencyBuckets, "tenant"),
+
+		httpRequests: newCounterVec("hc_http_requests_total", "HTTP requests, by route and status code.", "handler", "method", "code"),
+		httpLatency:  newHistogramVec("hc_http_request_duration_seconds", "HTTP request latency, by route.", httpLatencyBuckets, "handler"),
+	}
+}
+
+// dropLine accounts a discarded line in c and by reason. tenantID is empty
+// when the line was dropped before tenant resolution.
+func (s *IngestService) dropLine(c *uint64, reason, tenantID string, tr Transport) {
+	atomic.AddUint64(c, 1)
+	s.metrics.dropped.inc(tenantID, tr.String(), reason)
+}
+
+// handleMetrics serves the metrics in the Prometheus text format.
+func (s *IngestService) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", r.URL)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m := s.metrics
+	for _, v := range []*metricVec{m.received, m.accepted, m.redacted, m.spooled, m.dropped, m.connsRej, m.dbInserts, m.dbLatency} {
+		v.write(w)
+	}
+
+	writeFamily(w, "hc_ingest_lines_total", "counter", "Ingestion totals, by stage.")
+	for _, c := range []struct {
+		stage string
+		v     *uint64
+	}{
+		{"accepted", &s.linesAccepted},
+		{"dropped", &s.linesDropped},
+		{"redacted", &s.linesRedacted},
+		{"filtered", &s.linesFiltered},
+		{"duplicate", &s.linesDuplicate},
+		{"rate_limited", &s.linesLimited},
+		{"over_quota", &s.linesOverQuota},
+		{"spooled", &s.linesSpooled},
+		{"db_ok", &s.linesDBOK},
+		{"db_fail", &s.linesDBFail},
+	} {
+		writeSample(w, "hc_ingest_lines_total", []string{"stage"}, []string{c.stage}, float64(atomic.LoadUint64(c.v)))
+	}
+
+	queues := []struct {
+		name     string
+		len, cap int
+	}{
+		{"raw", len(s.rawCh), cap(s.rawCh)},
+		{"spool", len(s.spoolCh), cap(s.spoolCh)},
+		{"db", len(s.dbCh), cap(s.dbCh)},
+	}
+	writeFamily(w, "hc_ingest_queue_length", "gauge", "Messages waiting between pipeline stages.")
+	for _, q := range queues {
+		writeSample(w, "hc_ingest_queue_length", []string{"queue"}, []string{q.name}, float64(q.len))
+	}
+	writeFamily(w, "hc_ingest_queue_capacity", "gauge", "Capacity of the pipeline queues.")
+	for _, q := range queues {
+		writeSample(w, "hc_ingest_queue_capacity", []string{"queue"}, []string{q.name}, float64(q.cap))
+	}
+
+	writeFamily(w, "hc_redact_hits_total", "counter", "Secrets masked, by redaction rule.")
+	seen := make(map[*redactRule]bool)
+	for _, tenantID := range sortedKeys(s.conf().Redact) {
+		for _, rr := range s.conf().Redact[tenantID] {
+			// global rules are shared by all the tenants
+			if seen[rr] {
+				continue
+			}
+			seen[rr] = true
+			writeSample(w, "hc_redact_hits_total", []string{"rule"}, []string{rr.name}, float64(atomic.LoadUint64(&rr.hits)))
+		}
+	}
+
+	writeFamily(w, "hc_filter_lines_total", "counter", "Lines matched and dropped, by ingestion filter.")
+	for _, tenantID := range sortedKeys(s.conf().Filters) {
+		for _, f := range s.conf().Filters[tenantID] {
+			writeSample(w, "hc_filter_lines_total", []string{"tenant", "rule", "result"}, []string{tenantID, f.name, "matched"}, float64(atomic.LoadUint64(&f.matched)))
+			writeSample(w, "hc_filter_lines_total", []string{"tenant", "rule", "result"}, []string{tenantID, f.name, "dropped"}, float64(atomic.LoadUint64(&f.dropped)))
+		}
+	}
+
+	m.httpRequests.write(w)
+	m.httpLatency.write(w)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// statusRecorder keeps the response code. Flush is forwarded for the
+// streaming handlers (export, tail).
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// instrument counts the requests served by mux and their latency, labelled
+// by the matched route pattern.
+func (m *ingestMetrics) instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, r)
+
+		handler := r.Pattern
+		if handler == "" {
+			handler = "none"
+		}
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		default:
+			method = "other"
+		}
+		m.httpRequests.inc(handler, method, strconv.Itoa(rec.code))
+		m.httpLatency.observe(time.Since(start).Seconds(), handler)
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// migrateReport is the copy of one tenant and its check.
+type migrateReport struct {
+	Tenant             tenantRecord
+	Copied             int64
+	SrcCount, DstCount int64
+	SrcMax, DstMax     int64
+}
+
+func (r migrateReport) ok() bool {
+	return r.SrcCount == r.DstCount && r.SrcMax == r.DstMax
+}
+
+// countEvents counts every event of the tenant.
+func countEvents(ctx context.Context, db DBInterface, tenantID string) (int64, error) {
+	return db.CountEventsSince(ctx, tenantID, time.Time{})
+}
+
+// migrateTenant copies the tenant, its users, API keys and events from src
+// to dst. It starts after the last seq dst has, a migration that was
+// interrupted continues where it stopped.
+func migrateTenant(ctx context.Context, src, dst DBInterface, t tenantRecord) (migrateReport, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", ctx, t)
+
+	r := migrateReport{Tenant: t}
+	meta, err := src.ReadTenantMeta(ctx, t.ID)
+	if err != nil {
+		return r, err
+	}
+	if err := dst.WriteTenantMeta(ctx, meta); err != nil {
+		return r, err
+	}
+	after, err := dst.MaxSeq(ctx, t.ID)
+	if err != nil {
+		return r, fmt.Errorf("target max seq: %w", err)
+	}
+	if after > 0 {
+		fmt.Fprintf(os.Stderr, "migrate: tenant %s resumes after seq %d\n", t.Name, after)
+	}
+
+	last := time.Now()
+	batch := make([]eventRecord, 0, copyBatchRows)
+	flush := func() error {
+		if _, err := dst.WriteEventRecords(ctx, t.ID, batch); err != nil {
+			return fmt.Errorf("write seq %d..%d: %w", batch[0].Seq, batch[len(batch)-1].Seq, err)
+		}
+		r.Copied += int64(len(batch))
+		if time.Since(last) >= importProgressEvery {
+			last = time.Now()
+			fmt.Fprintf(os.Stderr, "migrate: tenant %s, %d events copied, seq %d\n", t.Name, r.Copied, batch[len(batch)-1].Seq)
+		}
+		batch = batch[:0]
+		return nil
+	}
+	err = src.ScanEventRecords(ctx, t.ID, after, func(e eventRecord) error {
+		batch = append(batch, e)
+		if len(batch) == copyBatchRows {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+	if err != nil {
+		return r, err
+	}
+
+	for _, c := range []struct {
+		db         DBInterface
+		count, max *int64
+	}{{src, &r.SrcCount, &r.SrcMax}, {dst, &r.DstCount, &r.DstMax}} {
+		if *c.count, err = countEvents(ctx, c.db, t.ID); err != nil {
+			return r, fmt.Errorf("count events: %w", err)
+		}
+		if *c.max, err = c.db.MaxSeq(ctx, t.ID); err != nil {
+			return r, fmt.Errorf("max seq: %w", err)
+		}
+	}
+	return r, nil
+}
+
+func doMigrateData(version string, args []string) {
+	debugPrint(log.Printf, levelCrazy, "Args=%s, %v\n", version, args)
+	opts, err := getRuntimeConf(version, args)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if opts.MigrateFrom == "" || opts.MigrateTo == "" {
+		fmt.Fprintln(os.Stderr, "usage: hc migrate-data -src <dsn> -dst <dsn> [-tenant <uuid>]")
+		os.Exit(2)
+	}
+	if opts.MigrateFrom == opts.MigrateTo {
+		fmt.Fprintln(os.Stderr, "source and target are the same database")
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	debugPrint(log.Printf, levelDebug, "connecting source db\n")
+	src, err := OpenDB(ctx, DBConfig{DSN: opts.MigrateFrom})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer src.Close()
+	debugPrint(log.Printf, levelDebug, "connecting target db\n")
+	dst, err := OpenDB(ctx, DBConfig{DSN: opts.MigrateTo})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer dst.Close()
+
+	tenants, err := src.ListTenants(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// the target schema comes from pg_schema.sql or schema.sqlite3.sql
+	if _, err := dst.ListTenants(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "target: %v, is the schema created?\n", err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, t := range tenants {
+		if opts.Import.Tenant != "" && t.ID != opts.Import.Tenant {
+			continue
+		}
+		r, err := migrateTenant(ctx, src, dst, t)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tenant %s: %v\n", t.ID, err)
+			fmt.Fprintln(os.Stderr, "migrate: run again to resume")
+			os.Exit(1)
+		}
+		status := "ok"
+		if !r.ok() {
+			status = "MISMATCH"
+			failed = true
+		}
+		fmt.Printf("tenant %s (%s): copied=%d events source=%d/%d target=%d/%d (count/max seq) %s\n",
+			t.ID, t.Name, r.Copied, r.SrcCount, r.SrcMax, r.DstCount, r.DstMax, status)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
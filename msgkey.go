@@ -73,7 +73,7 @@ func (s *IngestService) authAPIKeyFromLine(msg *RawMsg) *Tenant {
 
 	debugPrint(log.Printf, levelCrazy, "Key_id exists\n")
 
-	pepper := s.cfg.AppCfg.Globals.Pepper
+	pepper := s.conf().AppCfg.Globals.Pepper
 	if !verifySecretSHA256(secret, pepper, rec.KeyHash) {
 		return nil
 	}
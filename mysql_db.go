@@ -0,0 +1,829 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The innodb_ft_min_token_size and innodb_ft_max_token_size defaults of
+// MySQL and MariaDB, other words are not in the fulltext index.
+const (
+	mysqlFTMinToken = 3
+	mysqlFTMaxToken = 84
+)
+
+type MySQLDB struct {
+	SQL *sql.DB
+}
+
+func init() {
+	registerDBDriver("mysql", func(ctx context.Context, cfg DBConfig) (DBInterface, error) {
+		return OpenMySQLDB(ctx, cfg)
+	}, "mysql", "mariadb")
+}
+
+// mysqlConfig parses the dsn of cfg and sets the session the queries
+// expect: UTC timestamps, "||" concatenation and cwd lists longer than the
+// 1024 bytes group_concat default.
+func mysqlConfig(cfg DBConfig) (*mysql.Config, error) {
+	mc, err := mysql.ParseDSN(cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mysql dsn: %w", err)
+	}
+	mc.ParseTime = true
+	mc.Loc = time.UTC
+	if mc.Params == nil {
+		mc.Params = map[string]string{}
+	}
+	mc.Params["time_zone"] = "'+00:00'"
+	mc.Params["sql_mode"] = "CONCAT(@@sql_mode, ',PIPES_AS_CONCAT')"
+	mc.Params["group_concat_max_len"] = "1048576"
+	return mc, nil
+}
+
+func OpenMySQLDB(ctx context.Context, cfg DBConfig) (*MySQLDB, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", ctx, cfg)
+
+	if strings.TrimSpace(cfg.DSN) == "" {
+		return nil, fmt.Errorf("invalid mysql dsn")
+	}
+	mc, err := mysqlConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := mysql.NewConnector(mc)
+	if err != nil {
+		return nil, fmt.Errorf("sql open: %w", err)
+	}
+	db := sql.OpenDB(conn)
+	configurePool(db, cfg)
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("db ping: %w", err)
+	}
+
+	return &MySQLDB{SQL: db}, nil
+}
+
+func (d *MySQLDB) Ping(ctx context.Context) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", ctx)
+	return d.SQL.PingContext(ctx)
+}
+
+func (d *MySQLDB) Close() error {
+	debugPrint(log.Printf, levelCrazy, "Args=none\n")
+	if d == nil || d.SQL == nil {
+		return nil
+	}
+	return d.SQL.Close()
+}
+
+func (d *MySQLDB) EnsureSchema(ctx context.Context) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", ctx)
+	stmts := []string{
+		// commands are full of stopwords like "from" and "with", the
+		// fulltext index must keep them
+		`set session innodb_ft_enable_stopword = 0;`,
+
+		`create table if not exists tenants (
+			id char(36) not null primary key,
+			name varchar(255) not null unique,
+			created_at datetime(6) not null default current_timestamp(6)
+		) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_bin;`,
+
+		`create table if not exists cmd_events (
+			id bigint not null auto_increment primary key,
+			seq bigint not null,
+			tenant_id char(36) not null,
+
+			ts_client datetime(6),
+			session_id varchar(255) not null,
+			host_fqdn varchar(255) not null,
+			cwd text,
+			cmd text,
+
+			ts_ingested datetime(6) not null default current_timestamp(6),
+			src_ip varchar(64),
+			transport varchar(32) not null default 'import',
+			parse_ok boolean not null default true,
+
+			raw_line mediumtext not null,
+			dedup_key varchar(255),
+			chain_hash char(64),
+
+			unique key cmd_events_tenant_id_seq (tenant_id, seq),
+			unique key cmd_events_tenant_id_dedup_key (tenant_id, dedup_key),
+			key cmd_events_tenant_id_id (tenant_id, id),
+			key cmd_events_tenant_id_session (tenant_id, session_id, host_fqdn),
+			fulltext key cmd_events_raw_ft (raw_line),
+			foreign key (tenant_id) references tenants(id)
+		) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_bin;`,
+
+		`create table if not exists cmd_event_tags (
+			tenant_id char(36) not null,
+			event_id bigint not null,
+			tag varchar(64) not null,
+			primary key (tenant_id, event_id, tag),
+			key cmd_event_tags_tenant_id_tag (tenant_id, tag),
+			foreign key (tenant_id) references tenants(id),
+			foreign key (event_id) references cmd_events(id) on delete cascade
+		) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_bin;`,
+
+		`create table if not exists cmd_event_notes (
+			id bigint not null auto_increment primary key,
+			tenant_id char(36) not null,
+			event_id bigint not null,
+			note text not null,
+			created_at datetime(6) not null default current_timestamp(6),
+			key cmd_event_notes_event_id_idx (event_id),
+			foreign key (tenant_id) references tenants(id),
+			foreign key (event_id) references cmd_events(id) on delete cascade
+		) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_bin;`,
+	}
+
+	// the session variable holds on one connection only
+	conn, err := d.SQL.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, s := range stmts {
+		if _, err := conn.ExecContext(ctx, s); err != nil {
+			return fmt.Errorf("ensure schema failed on %q: %w", shortSQL(s), err)
+		}
+	}
+	return nil
+}
+
+// mysqlSchemaUpgrades are the columns added since schema.mysql.sql was
+// first published.
+var mysqlSchemaUpgrades = []schemaUpgrade{
+	{
+		name: "cmd_events.chain_hash",
+		check: `select count(*) from information_schema.columns
+			where table_schema = database() and table_name = 'cmd_events' and column_name = 'chain_hash'`,
+		apply: []string{`alter table cmd_events add column chain_hash char(64);`},
+	},
+}
+
+func (d *MySQLDB) UpgradeSchema(ctx context.Context) error {
+	return upgradeSchema(ctx, d.SQL, mysqlSchemaUpgrades)
+}
+
+func (d *MySQLDB) EnsureTenant(ctx context.Context, tenantID, name string) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %s, %s\n", ctx, tenantID, name)
+	_, err := d.SQL.ExecContext(ctx,
+		`insert into tenants(id, name) values (?, ?)
+		 on duplicate key update id = id;`,
+		tenantID, name)
+	if err != nil {
+		return fmt.Errorf("ensure tenant: %w", err)
+	}
+	return nil
+}
+
+func (d *MySQLDB) GetTenantName(ctx context.Context, tenantID string) (string, bool, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %s\n", ctx, tenantID)
+	var name string
+	err := d.SQL.QueryRowContext(
+		ctx,
+		`select name from tenants where id = ?`,
+		tenantID,
+	).Scan(&name)
+
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("get tenant: %w", err)
+	}
+	return name, true, nil
+}
+
+func (db *MySQLDB) MaxSeq(ctx context.Context, tenantID string) (int64, error) {
+	var seq sql.NullInt64
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s\n", ctx, tenantID)
+
+	err := db.SQL.QueryRowContext(ctx, `
+		select max(seq) from cmd_events where tenant_id = ?
+	`, tenantID).Scan(&seq)
+	if err != nil {
+		return 0, err
+	}
+	if !seq.Valid {
+		return 0, nil
+	}
+	return seq.Int64, nil
+}
+
+func (db *MySQLDB) CountEventsSince(ctx context.Context, tenantID string, since time.Time) (int64, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v\n", ctx, tenantID, since)
+
+	var n int64
+	err := db.SQL.QueryRowContext(ctx, `
+		select count(*) from cmd_events where tenant_id = ? and ts_ingested >= ?
+	`, tenantID, since.UTC()).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// mysqlEventInsertSQL is eventInsertSQL for MySQL. "on duplicate key
+// update" with an unchanged row affects none, like "on conflict do
+// nothing", and unlike "insert ignore" it does not hide other errors.
+func mysqlEventInsertSQL(withDedupKey bool) string {
+	if !withDedupKey {
+		return `
+		insert into cmd_events
+			(tenant_id, seq, ts_client, session_id, host_fqdn, cwd, cmd, raw_line, src_ip, transport, parse_ok, chain_hash)
+		values
+			(?,?,?,?,?,?,?,?,?,?,?,?)
+		on duplicate key update id = id
+	`
+	}
+	return `
+		insert into cmd_events
+			(tenant_id, seq, ts_client, session_id, host_fqdn, cwd, cmd, raw_line, src_ip, transport, parse_ok, chain_hash, dedup_key)
+		values
+			(?,?,?,?,?,?,?,?,?,?,?,?,?)
+		on duplicate key update id = id
+	`
+}
+
+// insertEvent adds ev in tx and tells whether it was stored.
+func (db *MySQLDB) insertEvent(ctx context.Context, tx *sql.Tx, ev Event, seq int64) (bool, error) {
+	if _, err := uuid.Parse(ev.TenantID); err != nil {
+		return false, err
+	}
+
+	args := []any{
+		ev.TenantID,
+		seq,
+		nullTime(ev.TSClient),
+		ev.SessionID,
+		ev.HostFQDN,
+		nullString(ev.CWD),
+		nullString(ev.Cmd),
+		ev.RawLine,
+		nullString(ev.SrcIP),
+		ev.Transport,
+		ev.ParseOK,
+		chainHashArg(ev.ChainHash),
+	}
+	if ev.DedupKey != "" {
+		args = append(args, ev.DedupKey)
+	}
+	res, err := tx.ExecContext(ctx, mysqlEventInsertSQL(ev.DedupKey != ""), args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+	return true, mysqlInsertEventTags(ctx, tx, ev.TenantID, seq, ev.Tags)
+}
+
+func (db *MySQLDB) InsertEventWithSeq(ctx context.Context, ev Event, seq int64) error {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %v, %d\n", ctx, ev, seq)
+
+	tx, err := db.SQL.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stored, err := db.insertEvent(ctx, tx, ev, seq)
+	if err != nil {
+		return err
+	}
+	if !stored && ev.DedupKey != "" {
+		return errDuplicateEvent
+	}
+	return tx.Commit()
+}
+
+// InsertEventBatch stores the rows one by one in a single transaction:
+// MySQL has no "returning" telling which rows of a multi-row insert were
+// skipped.
+func (db *MySQLDB) InsertEventBatch(ctx context.Context, batch []seqEvent) ([]bool, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %d rows\n", ctx, len(batch))
+
+	tx, err := db.SQL.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	inserted := make([]bool, len(batch))
+	for i, r := range batch {
+		if inserted[i], err = db.insertEvent(ctx, tx, r.Ev, r.Seq); err != nil {
+			return nil, err
+		}
+	}
+	return inserted, tx.Commit()
+}
+
+func (db *MySQLDB) lookupTenantByUsername(username string) (string, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var tenantID string
+
+	err := db.SQL.QueryRowContext(ctx, `
+		select tenant_id
+		from app_users
+		where username = ?
+		limit 1
+	`, username).Scan(&tenantID)
+
+	if err != nil {
+		return "", false
+	}
+
+	return strings.TrimSpace(tenantID), tenantID != ""
+}
+
+func (db *MySQLDB) insertAPIKey(ctx context.Context, id uuid.UUID, tenant uuid.UUID, user *uuid.UUID, keyID, keyHash string) error {
+	debugPrint(log.Printf, levelDebug, "insert into api_keys values ('%s', '%s', '%v', '%s', '%s');\n", id.String(), tenant.String(), user, keyID, keyHash)
+	_, err := db.SQL.ExecContext(ctx, `
+		insert into api_keys (id, tenant_id, user_id, key_id, key_hash)
+		values (?,?,?,?,?)
+	`, id, tenant, user, keyID, keyHash)
+	return err
+}
+
+func (db *MySQLDB) RequireTenantExists(ctx context.Context, tenantID uuid.UUID) error {
+	var tmp string
+	err := db.SQL.QueryRowContext(
+		ctx,
+		`select id from tenants where id = ?`,
+		tenantID.String(),
+	).Scan(&tmp)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("tenant %s not found in tenants table", tenantID.String())
+	}
+	return err
+}
+
+func (db *MySQLDB) GetAPIKeyByKeyID(ctx context.Context, keyID string) (APIKeyRecord, bool, error) {
+	var info APIKeyRecord
+
+	err := db.SQL.QueryRowContext(ctx, `
+		select tenant_id, key_hash, revoked_at
+		from api_keys
+		where key_id = ?
+	`, keyID).Scan(&info.TenantID, &info.KeyHash, &info.Revoked)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKeyRecord{}, false, nil
+	}
+	if err != nil {
+		return APIKeyRecord{}, false, err
+	}
+	return info, true, nil
+}
+
+// mysqlFulltextTerms returns the words every line containing pattern has
+// as whole words, as required terms of a boolean mode fulltext search.
+// Only runs of ASCII letters and digits between blanks qualify: the first
+// and last word of the pattern may be parts of longer ones, and the parser
+// splits on other characters in ways that differ between servers.
+func mysqlFulltextTerms(pattern string) []string {
+	fields := strings.FieldsFunc(pattern, unicode.IsSpace)
+	if len(fields) > 0 && strings.TrimLeftFunc(pattern, unicode.IsSpace) == pattern {
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && strings.TrimRightFunc(pattern, unicode.IsSpace) == pattern {
+		fields = fields[:len(fields)-1]
+	}
+
+	var terms []string
+	for _, f := range fields {
+		if len(f) < mysqlFTMinToken || len(f) > mysqlFTMaxToken {
+			continue
+		}
+		if strings.IndexFunc(f, func(r rune) bool {
+			return r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r))
+		}) >= 0 {
+			continue
+		}
+		terms = append(terms, "+"+f)
+	}
+	return terms
+}
+
+func exportOrderSQLMySQL(order string) (exportSort, error) {
+	const key = `date_format(ts_client, '%Y-%m-%d %H:%i:%s.%f')`
+	switch order {
+	case "ingest_asc":
+		return exportSort{}, nil
+	case "ingest_desc":
+		return exportSort{Desc: true}, nil
+	case "client_asc":
+		return exportSort{KeyCol: "ts_client", KeySelect: key, KeyBind: "%s"}, nil
+	case "client_desc":
+		return exportSort{KeyCol: "ts_client", KeySelect: key, KeyBind: "%s", Desc: true}, nil
+	default:
+		return exportSort{}, fmt.Errorf("invalid order=%q (use ingest_desc|ingest_asc|client_desc|client_asc)", order)
+	}
+}
+
+// mysqlOrderBy is exportSort.orderBy without "nulls first|last", which
+// MySQL lacks: NULLs sort first ascending.
+func mysqlOrderBy(s exportSort) string {
+	dir := "asc"
+	if s.Desc {
+		dir = "desc"
+	}
+	if s.KeyCol == "" {
+		return "id " + dir
+	}
+	nulls := "asc"
+	if s.NullsFirst {
+		nulls = "desc"
+	}
+	return "(" + s.KeyCol + " is null) " + nulls + ", " + s.KeyCol + " " + dir + ", id " + dir
+}
+
+func (db *MySQLDB) ExportLines(ctx context.Context, tenantID string, q exportQuery) (exportPage, error) {
+	sort, err := exportOrderSQLMySQL(q.Order)
+	if err != nil {
+		return exportPage{}, err
+	}
+
+	sb := strings.Builder{}
+	args, bind := newBinder(sqlitePlaceholder)
+
+	sb.WriteString(`select raw_line, id, `)
+	sb.WriteString(sort.keySelect())
+	sb.WriteString(`
+		from cmd_events
+		where tenant_id = `)
+	sb.WriteString(bind(tenantID))
+
+	sort, keyset, reversed, err := exportKeyset(q, sort, bind)
+	if err != nil {
+		return exportPage{}, err
+	}
+	if keyset != "" {
+		sb.WriteString(` and `)
+		sb.WriteString(keyset)
+	}
+
+	if q.Session != "" {
+		sb.WriteString(` and session_id = `)
+		sb.WriteString(bind(q.Session))
+	}
+
+	if q.Host != "" {
+		sb.WriteString(` and host_fqdn = `)
+		sb.WriteString(bind(q.Host))
+	}
+
+	sb.WriteString(tagFilter(q.Tags, bind))
+
+	// Plain substrings and the regexes that mean the same to MySQL and
+	// MariaDB are pushed down, the utf8mb4_bin columns keep them case
+	// sensitive: substrings with instr(), narrowed by the fulltext index
+	// when they hold whole words, regexes with regexp. The other regexes
+	// (\b, \d, (?i)...) are evaluated in Go below.
+	var ftTerms []string
+	var goStages []grepStage
+	for _, t := range q.Greps {
+		if strings.TrimSpace(t.Pattern) == "" {
+			continue
+		}
+		if IsPlainSubstring(t.Pattern) {
+			cmp := " > 0"
+			if t.Negate {
+				cmp = " = 0"
+			} else {
+				ftTerms = append(ftTerms, mysqlFulltextTerms(t.Pattern)...)
+			}
+			sb.WriteString(` and instr(raw_line, ` + bind(t.Pattern) + `)` + cmp)
+			continue
+		}
+		if !IsPortableRegex(t.Pattern) {
+			re, err := regexp.Compile(t.Pattern)
+			if err != nil {
+				return exportPage{}, fmt.Errorf("invalid %s: %w", t.Name, err)
+			}
+			goStages = append(goStages, grepStage{re: re, negate: t.Negate})
+			continue
+		}
+		op := "regexp"
+		if t.Negate {
+			op = "not regexp"
+		}
+		sb.WriteString(` and raw_line ` + op + ` `)
+		sb.WriteString(bind(t.Pattern))
+	}
+	if len(ftTerms) > 0 {
+		sb.WriteString(` and match(raw_line) against (` + bind(strings.Join(ftTerms, " ")) + ` in boolean mode)`)
+	}
+
+	useGoFilter := len(goStages) > 0
+	goPipe := &GrepPipeline{stages: goStages}
+
+	sb.WriteString(` order by `)
+	sb.WriteString(mysqlOrderBy(sort))
+	// the limit counts matching lines, applied below with a Go filter
+	if !useGoFilter {
+		sb.WriteString(` limit `)
+		sb.WriteString(bind(q.Limit))
+	}
+
+	debugPrint(log.Printf, levelDebug, "mysql export sql=%s args=%s\n", sb.String(), safeJSON(*args))
+
+	rows, err := db.SQL.QueryContext(ctx, sb.String(), *args...)
+	if err != nil {
+		return exportPage{}, err
+	}
+	defer rows.Close()
+
+	var page exportPage
+	for rows.Next() {
+		var rawLine string
+		var id int64
+		var key sql.NullString
+		if err := rows.Scan(&rawLine, &id, &key); err != nil {
+			return exportPage{}, err
+		}
+		if useGoFilter && !goPipe.Match(rawLine) {
+			continue
+		}
+		cur := newExportCursor(q.Order, nil, id)
+		if key.Valid {
+			cur.Key = &key.String
+		}
+		if page.First == nil {
+			page.First = cur
+		}
+		page.Last = cur
+		page.Lines = append(page.Lines, rawLine)
+		if useGoFilter && q.Limit > 0 && len(page.Lines) >= q.Limit {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return exportPage{}, err
+	}
+	if reversed {
+		reverseStrings(page.Lines)
+		page.First, page.Last = page.Last, page.First
+	}
+	return page, nil
+}
+
+func (db *MySQLDB) ListSessions(ctx context.Context, tenantID string, q sessionQuery) ([]SessionInfo, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v\n", ctx, tenantID, q)
+
+	var sb strings.Builder
+	args := []any{tenantID}
+
+	sb.WriteString(`
+		select session_id, host_fqdn,
+			min(coalesce(ts_client, ts_ingested)),
+			max(coalesce(ts_client, ts_ingested)),
+			count(*),
+			coalesce(concat('[', group_concat(distinct json_quote(cwd)), ']'), '[]')
+		from cmd_events
+		where tenant_id = ?
+	`)
+	if q.Session != "" {
+		sb.WriteString(` and session_id = ?`)
+		args = append(args, q.Session)
+	}
+	if q.Host != "" {
+		sb.WriteString(` and host_fqdn = ?`)
+		args = append(args, q.Host)
+	}
+	if !q.From.IsZero() {
+		sb.WriteString(` and coalesce(ts_client, ts_ingested) >= ?`)
+		args = append(args, q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		sb.WriteString(` and coalesce(ts_client, ts_ingested) < ?`)
+		args = append(args, q.To.UTC())
+	}
+	sb.WriteString(` group by session_id, host_fqdn order by 4 desc limit ?`)
+	args = append(args, q.Limit)
+
+	rows, err := db.SQL.QueryContext(ctx, sb.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []SessionInfo{}
+	for rows.Next() {
+		var si SessionInfo
+		var cwds string
+		if err := rows.Scan(&si.SessionID, &si.Host, &si.First, &si.Last, &si.Commands, &cwds); err != nil {
+			return nil, err
+		}
+		si.Cwds = parseCwds(cwds)
+		out = append(out, si)
+	}
+	return out, rows.Err()
+}
+
+func (db *MySQLDB) SessionEvents(ctx context.Context, tenantID, sessionID, host string) ([]SessionEvent, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %s, %s\n", ctx, tenantID, sessionID, host)
+
+	rows, err := db.SQL.QueryContext(ctx, `
+		select seq, coalesce(ts_client, ts_ingested), cwd, raw_line
+		from cmd_events
+		where tenant_id = ? and session_id = ? and host_fqdn = ?
+		order by 2, id
+	`, tenantID, sessionID, host)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []SessionEvent{}
+	for rows.Next() {
+		var ev SessionEvent
+		var cwd sql.NullString
+		if err := rows.Scan(&ev.Seq, &ev.Time, &cwd, &ev.RawLine); err != nil {
+			return nil, err
+		}
+		ev.Cwd = cwd.String
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
+
+func (db *MySQLDB) CommandStats(ctx context.Context, tenantID string, q statsQuery) (CmdStats, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v\n", ctx, tenantID, q)
+
+	var sb strings.Builder
+	args := []any{tenantID}
+
+	sb.WriteString(`with ev as (
+		select regexp_replace(trim(coalesce(cmd, '')), '[[:space:]]+', ' ') as cmd,
+			host_fqdn as host, session_id as sess,
+			case when parse_ok then 0 else 1 end as failed,
+			date_format(coalesce(ts_client, ts_ingested), '%H') as hour,
+			date_format(coalesce(ts_client, ts_ingested), '%Y-%m-%d') as day
+		from cmd_events
+		where tenant_id = ?`)
+	if q.Host != "" {
+		sb.WriteString(` and host_fqdn = ?`)
+		args = append(args, q.Host)
+	}
+	if !q.From.IsZero() {
+		sb.WriteString(` and coalesce(ts_client, ts_ingested) >= ?`)
+		args = append(args, q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		sb.WriteString(` and coalesce(ts_client, ts_ingested) < ?`)
+		args = append(args, q.To.UTC())
+	}
+	sb.WriteString(`)`)
+
+	return runCommandStats(ctx, db.SQL, statsSQL{
+		With:  sb.String(),
+		Args:  args,
+		Token: `substring_index(cmd, ' ', 1)`,
+	}, q)
+}
+
+// mysqlInsertEventTags is insertEventTags for MySQL.
+func mysqlInsertEventTags(ctx context.Context, tx *sql.Tx, tenantID string, seq int64, tags []string) error {
+	for _, tag := range tags {
+		_, err := tx.ExecContext(ctx, `insert into cmd_event_tags (tenant_id, event_id, tag)
+			select tenant_id, id, ? from cmd_events
+			where tenant_id = ? and seq = ?
+			on duplicate key update tag = tag`, tag, tenantID, seq)
+		if err != nil {
+			return fmt.Errorf("insert tag %q: %w", tag, err)
+		}
+	}
+	return nil
+}
+
+func (db *MySQLDB) TagEvents(ctx context.Context, tenantID string, t tagTarget, tags []string) (int64, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v, %v\n", ctx, tenantID, t, tags)
+
+	tx, err := db.SQL.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var total int64
+	for _, tag := range tags {
+		args, bind := newBinder(sqlitePlaceholder)
+		q := `insert into cmd_event_tags (tenant_id, event_id, tag)
+			select tenant_id, id, ` + bind(tag) + ` from cmd_events
+			where tenant_id = ` + bind(tenantID) + t.where(bind) + `
+			on duplicate key update tag = tag`
+		res, err := tx.ExecContext(ctx, q, *args...)
+		if err != nil {
+			return 0, fmt.Errorf("tag %q: %w", tag, err)
+		}
+		n, _ := res.RowsAffected()
+		total += n
+	}
+	return total, tx.Commit()
+}
+
+func (db *MySQLDB) UntagEvents(ctx context.Context, tenantID string, t tagTarget, tags []string) (int64, error) {
+	return changeEventTags(ctx, db.SQL, sqlitePlaceholder, tenantID, t, tags, true)
+}
+
+func (db *MySQLDB) ListTags(ctx context.Context, tenantID string) ([]TagCount, error) {
+	return queryTagCounts(ctx, db.SQL, sqlitePlaceholder, tenantID)
+}
+
+func (db *MySQLDB) AddNote(ctx context.Context, tenantID string, seq int64, note string) error {
+	return insertEventNote(ctx, db.SQL, sqlitePlaceholder, tenantID, seq, note)
+}
+
+func (db *MySQLDB) GetEvent(ctx context.Context, tenantID string, seq int64) (EventDetail, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %d\n", ctx, tenantID, seq)
+
+	ev := EventDetail{Seq: seq}
+	var id int64
+	err := db.SQL.QueryRowContext(ctx, `
+		select id, raw_line from cmd_events where tenant_id = ? and seq = ?
+	`, tenantID, seq).Scan(&id, &ev.RawLine)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ev, errEventNotFound
+	}
+	if err != nil {
+		return ev, err
+	}
+
+	if ev.Tags, err = queryEventTags(ctx, db.SQL, sqlitePlaceholder, tenantID, id); err != nil {
+		return ev, err
+	}
+
+	rows, err := db.SQL.QueryContext(ctx, `
+		select created_at, note from cmd_event_notes
+		where tenant_id = ? and event_id = ?
+		order by created_at, id
+	`, tenantID, id)
+	if err != nil {
+		return ev, err
+	}
+	defer rows.Close()
+
+	ev.Notes = []EventNote{}
+	for rows.Next() {
+		var n EventNote
+		if err := rows.Scan(&n.Time, &n.Note); err != nil {
+			return ev, err
+		}
+		ev.Notes = append(ev.Notes, n)
+	}
+	return ev, rows.Err()
+}
+
+func (db *MySQLDB) ScanEventPayloads(ctx context.Context, tenantID string, fn func(eventPayload) error) error {
+	return scanEventPayloads(ctx, db.SQL, sqlitePlaceholder, tenantID, fn)
+}
+
+func (db *MySQLDB) copier() sqlCopy {
+	return sqlCopy{db: db.SQL, ph: sqlitePlaceholder, mysql: true}
+}
+
+func (db *MySQLDB) ListTenants(ctx context.Context) ([]tenantRecord, error) {
+	return db.copier().listTenants(ctx)
+}
+
+func (db *MySQLDB) ReadTenantMeta(ctx context.Context, tenantID string) (tenantMeta, error) {
+	return db.copier().readTenantMeta(ctx, tenantID)
+}
+
+func (db *MySQLDB) WriteTenantMeta(ctx context.Context, m tenantMeta) error {
+	return db.copier().writeTenantMeta(ctx, m)
+}
+
+func (db *MySQLDB) ScanEventRecords(ctx context.Context, tenantID string, afterSeq int64, fn func(eventRecord) error) error {
+	return db.copier().scanEvents(ctx, tenantID, afterSeq, fn)
+}
+
+func (db *MySQLDB) WriteEventRecords(ctx context.Context, tenantID string, recs []eventRecord) (int, error) {
+	return db.copier().writeEvents(ctx, tenantID, recs)
+}
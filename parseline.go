@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -192,3 +193,20 @@ func ParseIngestLine(tenantID, line string) (Event, regexpmatch) {
 
 	return ev, mKind
 }
+
+var regexpmatchNames = [...]string{
+	reCompl:       "reCompl",
+	reSess:        "reSess",
+	reSessLoose:   "reSessLoose",
+	reNoSess:      "reNoSess",
+	reNoSessLoose: "reNoSessLoose",
+	reTSOnly:      "reTSOnly",
+	noMatch:       "noMatch",
+}
+
+func (k regexpmatch) String() string {
+	if int(k) < len(regexpmatchNames) {
+		return regexpmatchNames[k]
+	}
+	return "regexpmatch(" + strconv.Itoa(int(k)) + ")"
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"database/sql"
 	"errors"
@@ -9,7 +8,7 @@ import (
 	"github.com/google/uuid"
 	_ "github.com/lib/pq"
 	"log"
-	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -19,19 +18,23 @@ type PgsqlDB struct {
 	SQL *sql.DB
 }
 
-func OpenPgsqlDB(ctx context.Context, dsn string) (*PgsqlDB, error) {
-	debugPrint(log.Printf, levelCrazy, "Args=%v, %s\n", ctx, dsn)
+func init() {
+	registerDBDriver("postgres", func(ctx context.Context, cfg DBConfig) (DBInterface, error) {
+		return OpenPgsqlDB(ctx, cfg)
+	}, "postgres", "postgresql")
+}
+
+func OpenPgsqlDB(ctx context.Context, cfg DBConfig) (*PgsqlDB, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", ctx, cfg)
 
-	if strings.TrimSpace(dsn) == "" {
+	if strings.TrimSpace(cfg.DSN) == "" {
 		return nil, fmt.Errorf("invalid postgres dsn")
 	}
-	db, err := sql.Open("postgres", dsn)
+	db, err := sql.Open("postgres", cfg.DSN)
 	if err != nil {
 		return nil, fmt.Errorf("sql open: %w", err)
 	}
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(30 * time.Minute)
+	configurePool(db, cfg)
 
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
@@ -43,6 +46,11 @@ func OpenPgsqlDB(ctx context.Context, dsn string) (*PgsqlDB, error) {
 	return &PgsqlDB{SQL: db}, nil
 }
 
+func (d *PgsqlDB) Ping(ctx context.Context) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", ctx)
+	return d.SQL.PingContext(ctx)
+}
+
 func (d *PgsqlDB) Close() error {
 	debugPrint(log.Printf, levelCrazy, "Args=none\n")
 	if d == nil || d.SQL == nil {
@@ -77,9 +85,19 @@ func (d *PgsqlDB) EnsureSchema(ctx context.Context) error {
 			transport text not null default 'import',
 			parse_ok boolean not null default true,
 
-			raw_line text not null
+			raw_line text not null,
+			dedup_key text,
+			chain_hash text
 		);`,
 
+		`alter table cmd_events add column if not exists dedup_key text;`,
+
+		`alter table cmd_events add column if not exists chain_hash text;`,
+
+		`create unique index if not exists cmd_events_tenant_id_dedup_key
+			on cmd_events (tenant_id, dedup_key)
+			where dedup_key is not null;`,
+
 		`create index if not exists cmd_events_tenant_id_id_desc
 			on cmd_events (tenant_id, id desc);`,
 
@@ -88,6 +106,24 @@ func (d *PgsqlDB) EnsureSchema(ctx context.Context) error {
 
 		`create index if not exists cmd_events_cmd_trgm
 			on cmd_events using gin (cmd gin_trgm_ops);`,
+
+		`create table if not exists cmd_event_tags (
+			tenant_id uuid not null references tenants(id),
+			event_id bigint not null references cmd_events(id) on delete cascade,
+			tag text not null,
+			primary key (tenant_id, event_id, tag)
+		);`,
+
+		`create table if not exists cmd_event_notes (
+			id bigserial primary key,
+			tenant_id uuid not null references tenants(id),
+			event_id bigint not null references cmd_events(id) on delete cascade,
+			note text not null,
+			created_at timestamptz not null default now()
+		);`,
+
+		`create index if not exists cmd_event_notes_event_id_idx
+			on cmd_event_notes (event_id);`,
 	}
 
 	for _, s := range stmts {
@@ -98,6 +134,51 @@ func (d *PgsqlDB) EnsureSchema(ctx context.Context) error {
 	return nil
 }
 
+// pgSchemaUpgrades are the columns and tables added since pg_schema.sql
+// was first published.
+var pgSchemaUpgrades = []schemaUpgrade{
+	{
+		name: "cmd_events.dedup_key",
+		check: `select count(*) from information_schema.columns
+			where table_schema = current_schema() and table_name = 'cmd_events' and column_name = 'dedup_key'`,
+		apply: []string{`alter table cmd_events add column if not exists dedup_key text;`},
+	},
+	{
+		name: "index cmd_events_tenant_id_dedup_key",
+		check: `select count(*) from pg_indexes
+			where schemaname = current_schema() and indexname = 'cmd_events_tenant_id_dedup_key'`,
+		apply: []string{`create unique index if not exists cmd_events_tenant_id_dedup_key
+			on cmd_events (tenant_id, dedup_key)
+			where dedup_key is not null;`},
+	},
+	{
+		name: "cmd_events.chain_hash",
+		check: `select count(*) from information_schema.columns
+			where table_schema = current_schema() and table_name = 'cmd_events' and column_name = 'chain_hash'`,
+		apply: []string{`alter table cmd_events add column if not exists chain_hash text;`},
+	},
+	{
+		name: "table cmd_event_notes",
+		check: `select count(*) from information_schema.tables
+			where table_schema = current_schema() and table_name = 'cmd_event_notes'`,
+		apply: []string{
+			`create table if not exists cmd_event_notes (
+				id bigserial primary key,
+				tenant_id uuid not null references tenants(id),
+				event_id bigint not null references cmd_events(id) on delete cascade,
+				note text not null,
+				created_at timestamptz not null default now()
+			);`,
+			`create index if not exists cmd_event_notes_event_id_idx
+				on cmd_event_notes (event_id);`,
+		},
+	},
+}
+
+func (d *PgsqlDB) UpgradeSchema(ctx context.Context) error {
+	return upgradeSchema(ctx, d.SQL, pgSchemaUpgrades)
+}
+
 func (d *PgsqlDB) EnsureTenant(ctx context.Context, tenantID, name string) error {
 	debugPrint(log.Printf, levelCrazy, "Args=%v, %s, %s\n", ctx, tenantID, name)
 	_, err := d.SQL.ExecContext(ctx,
@@ -128,94 +209,6 @@ func (d *PgsqlDB) GetTenantName(ctx context.Context, tenantID string) (string, b
 	return name, true, nil
 }
 
-func (d *PgsqlDB) ImportHistoryFile(ctx context.Context, tenantID, path string) (inserted int, skipped int, err error) {
-	debugPrint(log.Printf, levelCrazy, "Args=%v, %s, %s\n", ctx, tenantID, path)
-	transport := "import"
-	f, err := os.Open(path)
-	if err != nil {
-		return 0, 0, fmt.Errorf("open history file: %w", err)
-	}
-	defer f.Close()
-
-	tx, err := d.SQL.BeginTx(ctx, nil)
-	if err != nil {
-		return 0, 0, fmt.Errorf("begin tx: %w", err)
-	}
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-		}
-	}()
-
-	stmt, err := tx.PrepareContext(ctx, `
-		insert into cmd_events(
-			seq, tenant_id, ts_client, session_id, host_fqdn, cwd, cmd, transport, raw_line, parse_ok
-		) values (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10
-		);
-	`)
-	if err != nil {
-		return 0, 0, fmt.Errorf("prepare insert: %w", err)
-	}
-	defer stmt.Close()
-
-	sc := bufio.NewScanner(f)
-
-	buf := make([]byte, 0, 64*1024)
-	sc.Buffer(buf, 2*1024*1024)
-
-	seq, err := d.MaxSeq(ctx, tenantID)
-	if err != nil {
-		return 0, 0, fmt.Errorf("cant recover seq (%v)", err)
-	}
-
-	for sc.Scan() {
-		seq = seq + 1
-		line := strings.TrimRight(sc.Text(), "\r\n")
-		if strings.TrimSpace(line) == "" {
-			continue
-		}
-
-		ev, _ := ParseIngestLine(tenantID, line)
-		tmp := "unknown"
-		ev.Transport = transport
-		ev.SrcIP = &tmp
-
-		res, e := stmt.ExecContext(ctx,
-			seq,
-			ev.TenantID,
-			ev.TSClient,
-			ev.SessionID,
-			ev.HostFQDN,
-			ev.CWD,
-			ev.Cmd,
-			transport,
-			ev.RawLine,
-			ev.ParseOK,
-		)
-		if e != nil {
-			err = fmt.Errorf("insert line failed: %w", e)
-			return inserted, skipped, err
-		}
-
-		ra, _ := res.RowsAffected()
-		if ra == 1 {
-			inserted++
-		} else {
-			skipped++
-		}
-	}
-	if e := sc.Err(); e != nil {
-		err = fmt.Errorf("scan history file: %w", e)
-		return inserted, skipped, err
-	}
-
-	if err = tx.Commit(); err != nil {
-		return inserted, skipped, fmt.Errorf("commit: %w", err)
-	}
-	return inserted, skipped, nil
-}
-
 func (db *PgsqlDB) MaxSeq(ctx context.Context, tenantID string) (int64, error) {
 	var seq sql.NullInt64
 	debugPrint(log.Printf, levelDebug, "Args: %v, %s\n", ctx, tenantID)
@@ -232,6 +225,19 @@ func (db *PgsqlDB) MaxSeq(ctx context.Context, tenantID string) (int64, error) {
 	return seq.Int64, nil
 }
 
+func (db *PgsqlDB) CountEventsSince(ctx context.Context, tenantID string, since time.Time) (int64, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v\n", ctx, tenantID, since)
+
+	var n int64
+	err := db.SQL.QueryRowContext(ctx, `
+		select count(*) from cmd_events where tenant_id = $1 and ts_ingested >= $2
+	`, tenantID, since).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
 func (db *PgsqlDB) InsertEventWithSeq(ctx context.Context, ev Event, seq int64) error {
 	debugPrint(log.Printf, levelDebug, "Args: %v, %v, %d\n", ctx, ev, seq)
 
@@ -244,13 +250,13 @@ func (db *PgsqlDB) InsertEventWithSeq(ctx context.Context, ev Event, seq int64)
 		return err
 	}
 
-	_, err = db.SQL.ExecContext(ctx, `
-		insert into cmd_events
-			(tenant_id, seq, ts_client, session_id, host_fqdn, cwd, cmd, raw_line, src_ip, transport, parse_ok)
-		values
-			($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)
-		on conflict (tenant_id, seq) do nothing
-	`,
+	tx, err := db.SQL.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	args := []any{
 		u,
 		seq,
 		&TSClient,
@@ -262,8 +268,40 @@ func (db *PgsqlDB) InsertEventWithSeq(ctx context.Context, ev Event, seq int64)
 		&SrcIP,
 		ev.Transport,
 		ev.ParseOK,
-	)
-	return err
+		chainHashArg(ev.ChainHash),
+	}
+	if ev.DedupKey != "" {
+		args = append(args, ev.DedupKey)
+	}
+	res, err := tx.ExecContext(ctx, eventInsertSQL(ev.DedupKey != ""), args...)
+	if err != nil {
+		return err
+	}
+	if err := checkDuplicateInsert(res, ev); err != nil {
+		return err
+	}
+	if err := insertEventTags(ctx, tx, pgPlaceholder, ev.TenantID, seq, ev.Tags); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *PgsqlDB) InsertEventBatch(ctx context.Context, batch []seqEvent) ([]bool, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %d rows\n", ctx, len(batch))
+
+	tx, err := db.SQL.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	inserted, err := insertEventBatch(ctx, tx, pgPlaceholder, func(tenantID string) (any, error) {
+		return uuid.Parse(tenantID)
+	}, batch)
+	if err != nil {
+		return nil, err
+	}
+	return inserted, tx.Commit()
 }
 
 func (db *PgsqlDB) lookupTenantByUsername(username string) (string, bool) {
@@ -327,70 +365,338 @@ func (db *PgsqlDB) GetAPIKeyByKeyID(ctx context.Context, keyID string) (APIKeyRe
 	return info, true, nil
 }
 
-func (db *PgsqlDB) ExportLines(ctx context.Context, tenantID string, q exportQuery) ([]string, error) {
-	orderSQL, err := exportOrderSQL(q.Order)
+func (db *PgsqlDB) ExportLines(ctx context.Context, tenantID string, q exportQuery) (exportPage, error) {
+	sort, err := exportOrderSQL(q.Order)
 	if err != nil {
-		return nil, err
+		return exportPage{}, err
 	}
 
 	sb := strings.Builder{}
 	args := []any{}
-	argN := 1
+	bind := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	sort, keyset, reversed, err := exportKeyset(q, sort, bind)
+	if err != nil {
+		return exportPage{}, err
+	}
 
-	sb.WriteString(`select raw_line
+	sb.WriteString(`select raw_line, id, `)
+	sb.WriteString(sort.keySelect())
+	sb.WriteString(`
 		from cmd_events
-		where tenant_id = $`)
-	sb.WriteString(strconv.Itoa(argN))
-	args = append(args, tenantID)
-	argN++
+		where tenant_id = `)
+	sb.WriteString(bind(tenantID))
+
+	if keyset != "" {
+		sb.WriteString(` and `)
+		sb.WriteString(keyset)
+	}
 
 	if q.Session != "" {
-		sb.WriteString(` and session_id = $`)
-		sb.WriteString(strconv.Itoa(argN))
-		args = append(args, q.Session)
-		argN++
-	}
-
-	g1 := strings.TrimSpace(q.Grep1)
-	if g1 != "" {
-		if IsPlainSubstring(g1) {
-			sb.WriteString(` and (raw_line ilike $`)
-			sb.WriteString(strconv.Itoa(argN))
-			sb.WriteString(` or cmd ilike $`)
-			sb.WriteString(strconv.Itoa(argN))
-			sb.WriteString(`)`)
-			args = append(args, "%"+g1+"%")
-			argN++
-		} else {
-			sb.WriteString(` and raw_line ~* $`)
-			sb.WriteString(strconv.Itoa(argN))
-			args = append(args, g1)
-			argN++
+		sb.WriteString(` and session_id = `)
+		sb.WriteString(bind(q.Session))
+	}
+
+	if q.Host != "" {
+		sb.WriteString(` and host_fqdn = `)
+		sb.WriteString(bind(q.Host))
+	}
+
+	sb.WriteString(tagFilter(q.Tags, bind))
+
+	// Plain substrings use like (trigram index friendly), the regexes
+	// that mean the same to Postgres the posix regex operator, both case
+	// sensitive. The other regexes (\b, \d, (?i)...) are evaluated in Go
+	// below.
+	var goStages []grepStage
+	for _, t := range q.Greps {
+		if strings.TrimSpace(t.Pattern) == "" {
+			continue
 		}
+		op, pat := "~", t.Pattern
+		switch {
+		case IsPlainSubstring(t.Pattern):
+			op, pat = "like", "%"+escapeLike(t.Pattern)+"%"
+		case !IsPortableRegex(t.Pattern):
+			re, err := regexp.Compile(t.Pattern)
+			if err != nil {
+				return exportPage{}, fmt.Errorf("invalid %s: %w", t.Name, err)
+			}
+			goStages = append(goStages, grepStage{re: re, negate: t.Negate})
+			continue
+		}
+		if t.Negate {
+			op = pgNegatedOp(op)
+		}
+		sb.WriteString(` and raw_line ` + op + ` `)
+		sb.WriteString(bind(pat))
 	}
+	useGoFilter := len(goStages) > 0
+	goPipe := &GrepPipeline{stages: goStages}
 
 	sb.WriteString(` order by `)
-	sb.WriteString(orderSQL)
-	sb.WriteString(` limit $`)
-	sb.WriteString(strconv.Itoa(argN))
-	args = append(args, q.Limit)
+	sb.WriteString(sort.orderBy())
+	// the limit counts matching lines, applied below with a Go filter
+	if !useGoFilter {
+		sb.WriteString(` limit `)
+		sb.WriteString(bind(q.Limit))
+	}
 
 	rows, err := db.SQL.QueryContext(ctx, sb.String(), args...)
 	if err != nil {
-		return nil, err
+		return exportPage{}, err
 	}
 	defer rows.Close()
 
-	var out []string
+	var page exportPage
 	for rows.Next() {
 		var rawLine string
-		if err := rows.Scan(&rawLine); err != nil {
-			return nil, err
+		var id int64
+		var key sql.NullString
+		if err := rows.Scan(&rawLine, &id, &key); err != nil {
+			return exportPage{}, err
+		}
+		if useGoFilter && !goPipe.Match(rawLine) {
+			continue
+		}
+		cur := newExportCursor(q.Order, nil, id)
+		if key.Valid {
+			cur.Key = &key.String
+		}
+		if page.First == nil {
+			page.First = cur
+		}
+		page.Last = cur
+		page.Lines = append(page.Lines, rawLine)
+		if useGoFilter && q.Limit > 0 && len(page.Lines) >= q.Limit {
+			break
 		}
-		out = append(out, rawLine)
 	}
 	if err := rows.Err(); err != nil {
+		return exportPage{}, err
+	}
+	if reversed {
+		reverseStrings(page.Lines)
+		page.First, page.Last = page.Last, page.First
+	}
+	return page, nil
+}
+
+func (db *PgsqlDB) ListSessions(ctx context.Context, tenantID string, q sessionQuery) ([]SessionInfo, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v\n", ctx, tenantID, q)
+
+	sb := strings.Builder{}
+	args := []any{}
+	bind := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	sb.WriteString(`select session_id, host_fqdn,
+			min(coalesce(ts_client, ts_ingested)),
+			max(coalesce(ts_client, ts_ingested)),
+			count(*),
+			coalesce(json_agg(distinct cwd) filter (where cwd is not null), '[]')::text
+		from cmd_events
+		where tenant_id = `)
+	sb.WriteString(bind(tenantID))
+	if q.Session != "" {
+		sb.WriteString(` and session_id = `)
+		sb.WriteString(bind(q.Session))
+	}
+	if q.Host != "" {
+		sb.WriteString(` and host_fqdn = `)
+		sb.WriteString(bind(q.Host))
+	}
+	if !q.From.IsZero() {
+		sb.WriteString(` and coalesce(ts_client, ts_ingested) >= `)
+		sb.WriteString(bind(q.From))
+	}
+	if !q.To.IsZero() {
+		sb.WriteString(` and coalesce(ts_client, ts_ingested) < `)
+		sb.WriteString(bind(q.To))
+	}
+	sb.WriteString(` group by session_id, host_fqdn order by 4 desc limit `)
+	sb.WriteString(bind(q.Limit))
+
+	rows, err := db.SQL.QueryContext(ctx, sb.String(), args...)
+	if err != nil {
 		return nil, err
 	}
-	return out, nil
+	defer rows.Close()
+
+	out := []SessionInfo{}
+	for rows.Next() {
+		var si SessionInfo
+		var cwds string
+		if err := rows.Scan(&si.SessionID, &si.Host, &si.First, &si.Last, &si.Commands, &cwds); err != nil {
+			return nil, err
+		}
+		si.Cwds = parseCwds(cwds)
+		out = append(out, si)
+	}
+	return out, rows.Err()
+}
+
+func (db *PgsqlDB) SessionEvents(ctx context.Context, tenantID, sessionID, host string) ([]SessionEvent, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %s, %s\n", ctx, tenantID, sessionID, host)
+
+	rows, err := db.SQL.QueryContext(ctx, `
+		select seq, coalesce(ts_client, ts_ingested), cwd, raw_line
+		from cmd_events
+		where tenant_id = $1 and session_id = $2 and host_fqdn = $3
+		order by 2, id
+	`, tenantID, sessionID, host)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []SessionEvent{}
+	for rows.Next() {
+		var ev SessionEvent
+		var cwd sql.NullString
+		if err := rows.Scan(&ev.Seq, &ev.Time, &cwd, &ev.RawLine); err != nil {
+			return nil, err
+		}
+		ev.Cwd = cwd.String
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
+
+func (db *PgsqlDB) CommandStats(ctx context.Context, tenantID string, q statsQuery) (CmdStats, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v\n", ctx, tenantID, q)
+
+	sb := strings.Builder{}
+	args := []any{}
+	bind := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	sb.WriteString(`with ev as (
+		select regexp_replace(btrim(coalesce(cmd, '')), '[[:space:]]+', ' ', 'g') as cmd,
+			host_fqdn as host, session_id as sess,
+			case when parse_ok then 0 else 1 end as failed,
+			to_char(coalesce(ts_client, ts_ingested) at time zone 'UTC', 'HH24') as hour,
+			to_char(coalesce(ts_client, ts_ingested) at time zone 'UTC', 'YYYY-MM-DD') as day
+		from cmd_events
+		where tenant_id = `)
+	sb.WriteString(bind(tenantID))
+	if q.Host != "" {
+		sb.WriteString(` and host_fqdn = `)
+		sb.WriteString(bind(q.Host))
+	}
+	if !q.From.IsZero() {
+		sb.WriteString(` and coalesce(ts_client, ts_ingested) >= `)
+		sb.WriteString(bind(q.From))
+	}
+	if !q.To.IsZero() {
+		sb.WriteString(` and coalesce(ts_client, ts_ingested) < `)
+		sb.WriteString(bind(q.To))
+	}
+	sb.WriteString(`)`)
+
+	return runCommandStats(ctx, db.SQL, statsSQL{
+		With:  sb.String(),
+		Args:  args,
+		Token: `split_part(cmd, ' ', 1)`,
+	}, q)
+}
+
+func (db *PgsqlDB) TagEvents(ctx context.Context, tenantID string, t tagTarget, tags []string) (int64, error) {
+	return changeEventTags(ctx, db.SQL, pgPlaceholder, tenantID, t, tags, false)
+}
+
+func (db *PgsqlDB) UntagEvents(ctx context.Context, tenantID string, t tagTarget, tags []string) (int64, error) {
+	return changeEventTags(ctx, db.SQL, pgPlaceholder, tenantID, t, tags, true)
+}
+
+func (db *PgsqlDB) ListTags(ctx context.Context, tenantID string) ([]TagCount, error) {
+	return queryTagCounts(ctx, db.SQL, pgPlaceholder, tenantID)
+}
+
+func (db *PgsqlDB) AddNote(ctx context.Context, tenantID string, seq int64, note string) error {
+	return insertEventNote(ctx, db.SQL, pgPlaceholder, tenantID, seq, note)
+}
+
+func (db *PgsqlDB) GetEvent(ctx context.Context, tenantID string, seq int64) (EventDetail, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %d\n", ctx, tenantID, seq)
+
+	ev := EventDetail{Seq: seq}
+	var id int64
+	err := db.SQL.QueryRowContext(ctx, `
+		select id, raw_line from cmd_events where tenant_id = $1 and seq = $2
+	`, tenantID, seq).Scan(&id, &ev.RawLine)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ev, errEventNotFound
+	}
+	if err != nil {
+		return ev, err
+	}
+
+	if ev.Tags, err = queryEventTags(ctx, db.SQL, pgPlaceholder, tenantID, id); err != nil {
+		return ev, err
+	}
+
+	rows, err := db.SQL.QueryContext(ctx, `
+		select created_at, note from cmd_event_notes
+		where tenant_id = $1 and event_id = $2
+		order by created_at, id
+	`, tenantID, id)
+	if err != nil {
+		return ev, err
+	}
+	defer rows.Close()
+
+	ev.Notes = []EventNote{}
+	for rows.Next() {
+		var n EventNote
+		if err := rows.Scan(&n.Time, &n.Note); err != nil {
+			return ev, err
+		}
+		ev.Notes = append(ev.Notes, n)
+	}
+	return ev, rows.Err()
+}
+
+func pgNegatedOp(op string) string {
+	switch op {
+	case "~":
+		return "!~"
+	default:
+		return "not " + op
+	}
+}
+
+func (db *PgsqlDB) ScanEventPayloads(ctx context.Context, tenantID string, fn func(eventPayload) error) error {
+	return scanEventPayloads(ctx, db.SQL, pgPlaceholder, tenantID, fn)
+}
+
+func (db *PgsqlDB) copier() sqlCopy {
+	return sqlCopy{db: db.SQL, ph: pgPlaceholder, pg: true}
+}
+
+func (db *PgsqlDB) ListTenants(ctx context.Context) ([]tenantRecord, error) {
+	return db.copier().listTenants(ctx)
+}
+
+func (db *PgsqlDB) ReadTenantMeta(ctx context.Context, tenantID string) (tenantMeta, error) {
+	return db.copier().readTenantMeta(ctx, tenantID)
+}
+
+func (db *PgsqlDB) WriteTenantMeta(ctx context.Context, m tenantMeta) error {
+	return db.copier().writeTenantMeta(ctx, m)
+}
+
+func (db *PgsqlDB) ScanEventRecords(ctx context.Context, tenantID string, afterSeq int64, fn func(eventRecord) error) error {
+	return db.copier().scanEvents(ctx, tenantID, afterSeq, fn)
+}
+
+func (db *PgsqlDB) WriteEventRecords(ctx context.Context, tenantID string, recs []eventRecord) (int, error) {
+	return db.copier().writeEvents(ctx, tenantID, recs)
 }
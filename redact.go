@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	redactMask = "[REDACTED]"
+	// redactedTag marks the events whose line was rewritten.
+	redactedTag = "redacted"
+)
+
+// Built-in detectors. When a pattern has capture groups only the groups
+// are masked, so the surrounding command stays readable.
+var builtinRedactors = map[string]string{
+	"password_flag":   `(?i)(?:^|\s)--?(?:password|passwd|pass|pwd)(?:=|\s+)("[^"]*"|'[^']*'|\S+)`,
+	"mysql_password":  `\b(?:mysql|mysqldump|mysqladmin|mariadb)\b.*?\s-p([^\s-]\S*)`,
+	"sshpass":         `\bsshpass\s+-p\s*("[^"]*"|'[^']*'|\S+)`,
+	"env_secret":      `(?i)\b[a-z0-9_]*(?:secret|token|passw(?:or)?d|api_?key|access_?key|private_?key)[a-z0-9_]*=("[^"]*"|'[^']*'|\S+)`,
+	"auth_header":     `(?i)\b(?:authorization|proxy-authorization|x-api-key|x-auth-token)\s*:\s*(?:(?:bearer|basic|token)\s+)?([^\s'"]+)`,
+	"url_credentials": `\b[a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]+:([^/\s@]+)@`,
+	"curl_user":       `\s(?:-u|--user)\s+[^:\s]+:("[^"]*"|'[^']*'|\S+)`,
+	"aws_access_key":  `\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`,
+	"github_token":    `\b((?:gh[pousr]_[A-Za-z0-9]{36,})|github_pat_[A-Za-z0-9_]{60,})\b`,
+	"slack_token":     `\b(xox[abprs]-[A-Za-z0-9-]{10,})\b`,
+	"jwt":             `\b(eyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,})`,
+}
+
+type redactRule struct {
+	name string
+	re   *regexp.Regexp
+	hits uint64
+}
+
+func builtinRedactorNames() []string {
+	names := make([]string, 0, len(builtinRedactors))
+	for n := range builtinRedactors {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compileRedactRules returns, per tenant, the global rules followed by the
+// tenant ones. Global rules are shared so their hit counters add up.
+func compileRedactRules(cfg *Config) (map[string][]*redactRule, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", cfg)
+
+	compile := func(rc RedactConfig) ([]*redactRule, error) {
+		var out []*redactRule
+		names := rc.Builtin
+		if len(names) == 1 && names[0] == "all" {
+			names = builtinRedactorNames()
+		}
+		for _, n := range names {
+			expr, ok := builtinRedactors[n]
+			if !ok {
+				return nil, fmt.Errorf("unknown builtin redactor %q", n)
+			}
+			out = append(out, &redactRule{name: n, re: regexp.MustCompile(expr)})
+		}
+		for _, r := range rc.Rules {
+			re, err := regexp.Compile(r.Match)
+			if err != nil {
+				return nil, fmt.Errorf("redact rule %q: %w", r.Name, err)
+			}
+			out = append(out, &redactRule{name: r.Name, re: re})
+		}
+		return out, nil
+	}
+
+	global, err := compile(cfg.Globals.Redact)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]*redactRule, len(cfg.Tenants))
+	for _, t := range cfg.Tenants {
+		own, err := compile(t.Redact)
+		if err != nil {
+			return nil, err
+		}
+		result[t.TenantID] = append(append([]*redactRule{}, global...), own...)
+	}
+	return result, nil
+}
+
+// redactLine masks the secrets found in the command part of an ingestion
+// line. Like the api key stripping, the line header is left untouched.
+func redactLine(rules []*redactRule, line string) (string, bool) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %s\n", rules, line)
+	if len(rules) == 0 {
+		return line, false
+	}
+
+	head, payload := "", line
+	if m := reIngestStrict.FindStringSubmatchIndex(line); m != nil {
+		i := 2 * reIngestStrict.SubexpIndex("payload")
+		head, payload = line[:m[i]], line[m[i]:]
+	}
+
+	redacted := false
+	for _, r := range rules {
+		out, n := redactString(r.re, payload)
+		if n == 0 {
+			continue
+		}
+		atomic.AddUint64(&r.hits, uint64(n))
+		debugPrint(log.Printf, levelDebug, "redact rule %s masked %d secrets\n", r.name, n)
+		payload = out
+		redacted = true
+	}
+	if !redacted {
+		return line, false
+	}
+	return head + payload, true
+}
+
+// redactString masks the capture groups of every match of re in s, or the
+// whole match when re has no groups. It returns the number of masked spans.
+func redactString(re *regexp.Regexp, s string) (string, int) {
+	matches := re.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s, 0
+	}
+
+	var sb strings.Builder
+	n, last := 0, 0
+	for _, m := range matches {
+		spans := [][2]int{{m[0], m[1]}}
+		if len(m) > 2 {
+			spans = spans[:0]
+			for g := 2; g+1 < len(m); g += 2 {
+				if m[g] >= 0 && m[g+1] > m[g] {
+					spans = append(spans, [2]int{m[g], m[g+1]})
+				}
+			}
+		}
+		for _, sp := range spans {
+			if sp[0] < last || s[sp[0]:sp[1]] == redactMask {
+				continue
+			}
+			sb.WriteString(s[last:sp[0]])
+			sb.WriteString(redactMask)
+			last = sp[1]
+			n++
+		}
+	}
+	sb.WriteString(s[last:])
+	return sb.String(), n
+}
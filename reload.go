@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"reflect"
+	"sync/atomic"
+)
+
+// certHolder hands the current certificate to a TLS listener, so that a
+// reload replaces it without restarting the listener.
+type certHolder struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+func (h *certHolder) load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	h.cert.Store(&cert)
+	return nil
+}
+
+func (h *certHolder) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c := h.cert.Load()
+	if c == nil {
+		return nil, fmt.Errorf("no certificate loaded")
+	}
+	return c, nil
+}
+
+// reloadOptions re-reads the configuration file of opts. The result is a
+// new Options, opts is left untouched.
+func reloadOptions(opts *Options) (*Options, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", opts)
+
+	path := opts.ConfigPath
+	if path == "" {
+		path = "hc-config.json"
+	}
+	cfg, err := ReadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	next := *opts
+	next.Cfg = cfg
+	warnRestartOnly(&opts.Cfg, &cfg)
+	return &next, nil
+}
+
+// warnRestartOnly logs the changed settings a reload does not apply.
+func warnRestartOnly(old, cur *Config) {
+	for _, c := range []struct {
+		name     string
+		old, cur any
+	}{
+		{"server.ingest_clear enabled/addr", [2]any{old.Server.IngestClear.Enabled, old.Server.IngestClear.Addr}, [2]any{cur.Server.IngestClear.Enabled, cur.Server.IngestClear.Addr}},
+		{"server.ingest_tls enabled/addr", [2]any{old.Server.IngestTLS.Enabled, old.Server.IngestTLS.Addr}, [2]any{cur.Server.IngestTLS.Enabled, cur.Server.IngestTLS.Addr}},
+		{"server.http", [2]any{old.Server.HTTP.Enabled, old.Server.HTTP.Addr}, [2]any{cur.Server.HTTP.Enabled, cur.Server.HTTP.Addr}},
+		{"server.https", [2]any{old.Server.HTTPS.Enabled, old.Server.HTTPS.Addr}, [2]any{cur.Server.HTTPS.Enabled, cur.Server.HTTPS.Addr}},
+		{"server.metrics", old.Server.Metrics, cur.Server.Metrics},
+		{"db", old.DB, cur.DB},
+		{"globals.client_cert", old.Globals.ClientCert, cur.Globals.ClientCert},
+		{"globals.chain", old.Globals.Chain, cur.Globals.Chain},
+	} {
+		if !reflect.DeepEqual(c.old, c.cur) {
+			log.Printf("reload: %s changed, restart to apply", c.name)
+		}
+	}
+}
+
+// Reload swaps the ingestion configuration: tenants, ACLs, auth lists,
+// auto tags, redaction, filters, limits, dedup and the TLS certificate.
+// Listeners, queues and workers are kept. On error nothing changes.
+func (s *IngestService) Reload(opts *Options) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", opts)
+
+	next, err := NewIngestConfigFromOptions(opts)
+	if err != nil {
+		return err
+	}
+	old := s.conf()
+
+	// fixed at startup
+	next.RawEnabled, next.RawAddr = old.RawEnabled, old.RawAddr
+	next.TLSEnabled, next.TLSAddr = old.TLSEnabled, old.TLSAddr
+	if old.TLSEnabled && next.TLSConfig == nil {
+		next.TLSConfig = old.TLSConfig
+	}
+	next.ValidateWorkers, next.DBWorkers, next.QueueDepth = old.ValidateWorkers, old.DBWorkers, old.QueueDepth
+	next.MaxLineBytes = old.MaxLineBytes
+	next.SpoolDir, next.SpoolSyncEveryN, next.SpoolSyncEvery = old.SpoolDir, old.SpoolSyncEveryN, old.SpoolSyncEvery
+	next.ChainEnabled, next.ChainCheckpoint, next.ChainSigner = old.ChainEnabled, old.ChainCheckpoint, old.ChainSigner
+	next.DBRequired = old.DBRequired
+
+	carryRuleCounters(old, &next)
+	if next.DedupCache > 0 {
+		s.dedup.setTTL(next.DedupCache)
+	}
+
+	s.live.Store(&next)
+	log.Printf("reload: configuration applied, %d tenants", len(next.AppCfg.Tenants))
+	return nil
+}
+
+// carryRuleCounters keeps the redaction and filter counters of the rules
+// that survive a reload, matched by tenant and name.
+func carryRuleCounters(old, next *IngestConfig) {
+	hits := make(map[string]uint64)
+	for tenantID, rules := range old.Redact {
+		for _, r := range rules {
+			hits[tenantID+"/"+r.name] = atomic.LoadUint64(&r.hits)
+		}
+	}
+	for tenantID, rules := range next.Redact {
+		for _, r := range rules {
+			// global rules are shared, keep the highest count
+			if n := hits[tenantID+"/"+r.name]; n > atomic.LoadUint64(&r.hits) {
+				atomic.StoreUint64(&r.hits, n)
+			}
+		}
+	}
+
+	filters := make(map[string]*ingestFilter)
+	for tenantID, fs := range old.Filters {
+		for _, f := range fs {
+			filters[tenantID+"/"+f.name] = f
+		}
+	}
+	for tenantID, fs := range next.Filters {
+		for _, f := range fs {
+			if p, ok := filters[tenantID+"/"+f.name]; ok {
+				atomic.StoreUint64(&f.matched, atomic.LoadUint64(&p.matched))
+				atomic.StoreUint64(&f.dropped, atomic.LoadUint64(&p.dropped))
+				atomic.StoreUint64(&f.reported, atomic.LoadUint64(&p.reported))
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+-- MySQL 8 / MariaDB 10.6 schema. The utf8mb4_bin collation keeps the
+-- grep pushdown case sensitive.
+
+-- Commands are full of stopwords like "from" and "with", the fulltext
+-- index created below must keep them.
+SET SESSION innodb_ft_enable_stopword = 0;
+
+-- -----------------------------------------------------
+-- tenants
+-- -----------------------------------------------------
+CREATE TABLE tenants (
+    id CHAR(36) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    PRIMARY KEY (id),
+    UNIQUE (name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+-- -----------------------------------------------------
+-- app_users
+-- -----------------------------------------------------
+CREATE TABLE app_users (
+    id CHAR(36) NOT NULL,
+    tenant_id CHAR(36) NOT NULL,
+    username VARCHAR(255) NOT NULL,
+    created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    PRIMARY KEY (id),
+    UNIQUE (tenant_id, username),
+    KEY app_users_username_idx (username),
+    FOREIGN KEY (tenant_id) REFERENCES tenants(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+-- -----------------------------------------------------
+-- api_keys
+-- -----------------------------------------------------
+CREATE TABLE api_keys (
+    id CHAR(36) NOT NULL,
+    tenant_id CHAR(36) NOT NULL,
+    user_id CHAR(36),
+    key_id VARCHAR(255) NOT NULL,
+    key_hash VARCHAR(255) NOT NULL,
+    created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    revoked_at DATETIME(6),
+    PRIMARY KEY (id),
+    UNIQUE (tenant_id, key_id),
+    KEY api_keys_key_id_idx (key_id),
+    FOREIGN KEY (tenant_id) REFERENCES tenants(id),
+    FOREIGN KEY (user_id) REFERENCES app_users(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+-- -----------------------------------------------------
+-- cmd_events
+-- -----------------------------------------------------
+CREATE TABLE cmd_events (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    seq BIGINT NOT NULL,
+    tenant_id CHAR(36) NOT NULL,
+    ts_client DATETIME(6),
+    session_id VARCHAR(255) NOT NULL,
+    host_fqdn VARCHAR(255) NOT NULL,
+    cwd TEXT,
+    cmd TEXT,
+    ts_ingested DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    src_ip VARCHAR(64),
+    transport VARCHAR(32) NOT NULL DEFAULT 'tcp-clear',
+    parse_ok BOOLEAN NOT NULL DEFAULT TRUE,
+    raw_line MEDIUMTEXT NOT NULL,
+    dedup_key VARCHAR(255),
+    chain_hash CHAR(64),
+    PRIMARY KEY (id),
+    UNIQUE (tenant_id, seq),
+    FOREIGN KEY (tenant_id) REFERENCES tenants(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+-- -----------------------------------------------------
+-- cmd_event_tags
+-- -----------------------------------------------------
+CREATE TABLE cmd_event_tags (
+    tenant_id CHAR(36) NOT NULL,
+    event_id BIGINT NOT NULL,
+    tag VARCHAR(64) NOT NULL,
+    PRIMARY KEY (tenant_id, event_id, tag),
+    FOREIGN KEY (tenant_id) REFERENCES tenants(id),
+    FOREIGN KEY (event_id) REFERENCES cmd_events(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+-- -----------------------------------------------------
+-- cmd_event_notes
+-- -----------------------------------------------------
+CREATE TABLE cmd_event_notes (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    tenant_id CHAR(36) NOT NULL,
+    event_id BIGINT NOT NULL,
+    note TEXT NOT NULL,
+    created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    PRIMARY KEY (id),
+    FOREIGN KEY (tenant_id) REFERENCES tenants(id),
+    FOREIGN KEY (event_id) REFERENCES cmd_events(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+-- -----------------------------------------------------
+-- indexes
+-- -----------------------------------------------------
+CREATE INDEX cmd_events_tenant_id_id
+    ON cmd_events (tenant_id, id);
+
+CREATE INDEX cmd_events_tenant_id_session
+    ON cmd_events (tenant_id, session_id, host_fqdn);
+
+-- Duplicate suppression, NULL keys never collide
+CREATE UNIQUE INDEX cmd_events_tenant_id_dedup_key
+    ON cmd_events (tenant_id, dedup_key);
+
+-- Narrows the plain substring greps of /export to whole words
+CREATE FULLTEXT INDEX cmd_events_raw_ft
+    ON cmd_events (raw_line);
+
+CREATE INDEX cmd_event_tags_tenant_id_tag
+    ON cmd_event_tags (tenant_id, tag);
+
+CREATE INDEX cmd_event_notes_event_id_idx
+    ON cmd_event_notes (event_id);
@@ -57,6 +57,8 @@ CREATE TABLE cmd_events (
     transport TEXT NOT NULL DEFAULT 'tcp-clear',
     parse_ok INTEGER NOT NULL DEFAULT 1,
     raw_line TEXT NOT NULL,
+    dedup_key TEXT,
+    chain_hash TEXT,
     UNIQUE (tenant_id, seq),
     FOREIGN KEY (tenant_id) REFERENCES tenants(id)
 );
@@ -73,12 +75,29 @@ CREATE TABLE cmd_event_tags (
     FOREIGN KEY (event_id) REFERENCES cmd_events(id) ON DELETE CASCADE
 );
 
+-- -----------------------------------------------------
+-- cmd_event_notes
+-- -----------------------------------------------------
+CREATE TABLE cmd_event_notes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    tenant_id TEXT NOT NULL,
+    event_id INTEGER NOT NULL,
+    note TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (tenant_id) REFERENCES tenants(id),
+    FOREIGN KEY (event_id) REFERENCES cmd_events(id) ON DELETE CASCADE
+);
+
 -- -----------------------------------------------------
 -- indexes
 -- -----------------------------------------------------
 CREATE INDEX cmd_events_tenant_id_id_desc
     ON cmd_events (tenant_id, id DESC);
 
+-- Duplicate suppression, NULL keys never collide
+CREATE UNIQUE INDEX cmd_events_tenant_id_dedup_key
+    ON cmd_events (tenant_id, dedup_key);
+
 -- Optional helper indexes if you query these often
 CREATE INDEX api_keys_tenant_id_idx
     ON api_keys (tenant_id);
@@ -88,3 +107,6 @@ CREATE INDEX app_users_tenant_id_idx
 
 CREATE INDEX cmd_event_tags_event_id_idx
     ON cmd_event_tags (event_id);
+
+CREATE INDEX cmd_event_notes_event_id_idx
+    ON cmd_event_notes (event_id);
@@ -10,9 +10,13 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
+const defaultShutdownTimeout = 10 * time.Second
+
 func doRunServe(version string, args []string) {
 	opts, err := getRuntimeConf(version, args)
 	if err != nil {
@@ -35,17 +39,49 @@ func serve(opts *Options) {
 	if err != nil {
 		log.Fatalf("failed to start ingestion: %v", err)
 	}
-	defer ing.Stop()
+
+	var servers []*http.Server
+
+	// Metrics, own listener
+	metricsCfg := opts.Cfg.Server.Metrics
+	if metricsCfg.Enabled && metricsCfg.Addr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", ing.handleMetrics)
+		mux.HandleFunc("/healthz", ing.handleHealthz)
+		mux.HandleFunc("/readyz", ing.handleReadyz)
+		metricsSrv := &http.Server{
+			Addr:    metricsCfg.Addr,
+			Handler: mux,
+		}
+		servers = append(servers, metricsSrv)
+		go func() {
+			debugPrint(log.Printf, levelInfo, "metrics listening on %s", metricsSrv.Addr)
+			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				debugPrint(log.Printf, levelError, "metrics server error: %v", err)
+				cancel()
+			}
+		}()
+	}
+	onExportMux := metricsCfg.Enabled && metricsCfg.Addr == ""
+
+	var exports []*ExportService
+	var httpsCert *certHolder
 
 	if ing.db != nil {
 		// HTTP
 		if opts.Cfg.Server.HTTP.Enabled {
 			mux := http.NewServeMux()
-			RegisterExportHandlers(mux, opts, ing.db)
+			exports = append(exports, RegisterExportHandlers(mux, opts, ing.db, ing.tail))
+			mux.HandleFunc("/healthz", ing.handleHealthz)
+			mux.HandleFunc("/readyz", ing.handleReadyz)
+			if onExportMux {
+				mux.HandleFunc("/metrics", ing.handleMetrics)
+			}
 			httpSrv := &http.Server{
 				Addr:    opts.Cfg.Server.HTTP.Addr,
-				Handler: mux,
+				Handler: ing.metrics.instrument(mux),
 			}
+			servers = append(servers, httpSrv)
 			go func() {
 				debugPrint(log.Printf, levelInfo, "HTTP export listening on %s", httpSrv.Addr)
 				if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -60,7 +96,12 @@ func serve(opts *Options) {
 			var tlsConfig *tls.Config
 
 			muxHTTPS := http.NewServeMux()
-			RegisterExportHandlers(muxHTTPS, opts, ing.db)
+			exports = append(exports, RegisterExportHandlers(muxHTTPS, opts, ing.db, ing.tail))
+			muxHTTPS.HandleFunc("/healthz", ing.handleHealthz)
+			muxHTTPS.HandleFunc("/readyz", ing.handleReadyz)
+			if onExportMux {
+				muxHTTPS.HandleFunc("/metrics", ing.handleMetrics)
+			}
 
 			debugPrint(log.Printf, levelDebug, "going to use %s to authenticate client certificates", opts.Cfg.Globals.ClientCert)
 			caCert, err := os.ReadFile(opts.Cfg.Globals.ClientCert)
@@ -73,11 +114,13 @@ func serve(opts *Options) {
 					ClientCAs:  caCertPool,
 					ClientAuth: tls.VerifyClientCertIfGiven,
 				}
+			} else {
+				tlsConfig = &tls.Config{}
 			}
 
 			httpsSrv := &http.Server{
 				Addr:      opts.Cfg.Server.HTTPS.Addr,
-				Handler:   muxHTTPS,
+				Handler:   ing.metrics.instrument(muxHTTPS),
 				TLSConfig: tlsConfig,
 			}
 
@@ -85,10 +128,15 @@ func serve(opts *Options) {
 			key := strings.TrimSpace(opts.Cfg.Globals.Identity.KeyFile)
 			if cert == "" || key == "" {
 				debugPrint(log.Printf, levelWarning, "HTTPS enabled but tls.cert_file/key_file not set; HTTPS server not started")
+			} else if holder := new(certHolder); holder.load(cert, key) != nil {
+				debugPrint(log.Printf, levelError, "HTTPS certificate %s can't be loaded; HTTPS server not started", cert)
 			} else {
+				httpsCert = holder
+				tlsConfig.GetCertificate = holder.getCertificate
+				servers = append(servers, httpsSrv)
 				go func() {
 					debugPrint(log.Printf, levelInfo, "HTTPS export listening on %s", httpsSrv.Addr)
-					if err := httpsSrv.ListenAndServeTLS(cert, key); err != nil && err != http.ErrServerClosed {
+					if err := httpsSrv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 						debugPrint(log.Printf, levelError, "HTTPS server error: %v", err)
 						cancel()
 					}
@@ -100,14 +148,87 @@ func serve(opts *Options) {
 		debugPrint(log.Printf, levelWarning, "DB not available. only ingestion service\n")
 	}
 
-	waitForShutdown(cancel)
+	reload := func() {
+		// everything that can fail is checked before anything is applied:
+		// the certificate goes to a scratch holder first
+		next, err := reloadOptions(opts)
+		var cert *certHolder
+		if err == nil && httpsCert != nil {
+			cert = new(certHolder)
+			err = cert.load(next.Cfg.Globals.Identity.CertFile, next.Cfg.Globals.Identity.KeyFile)
+		}
+		if err == nil {
+			err = ing.Reload(next)
+		}
+		if err != nil {
+			log.Printf("reload rejected, running configuration kept: %v", err)
+			return
+		}
+		if cert != nil {
+			httpsCert.cert.Store(cert.cert.Load())
+		}
+		for _, e := range exports {
+			e.SetOptions(next)
+		}
+		opts = next
+	}
+	waitForShutdown(ctx, reload)
+
+	timeout := defaultShutdownTimeout
+	if opts.Cfg.Globals.ShutdownSeconds > 0 {
+		timeout = time.Duration(opts.Cfg.Globals.ShutdownSeconds) * time.Second
+	}
+	shutdown(ing, servers, timeout)
 
 	debugPrint(log.Printf, levelDebug, "exit\n")
 }
 
-func waitForShutdown(cancel context.CancelFunc) {
+// waitForShutdown returns on SIGINT/SIGTERM or when ctx is cancelled by a
+// failed server, SIGHUP reloads the configuration.
+func waitForShutdown(ctx context.Context, reload func()) {
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
-	<-ch
-	cancel()
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-ch:
+			if sig != syscall.SIGHUP {
+				log.Printf("%v received, shutting down", sig)
+				return
+			}
+			log.Printf("SIGHUP received, reloading configuration")
+			reload()
+		}
+	}
+}
+
+// shutdown drains the ingestion, then stops the HTTP servers, both within
+// timeout. The database is closed last, exports may still use it.
+func shutdown(ing *IngestService, servers []*http.Server, timeout time.Duration) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", servers, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := ing.Shutdown(ctx); err != nil {
+		log.Printf("ingestion drain interrupted after %v: %v", timeout, err)
+	}
+
+	ing.tail.Close()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				debugPrint(log.Printf, levelWarning, "server %s shutdown: %v", srv.Addr, err)
+				_ = srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	ing.Close()
 }
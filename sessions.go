@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var reSessionID = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+// Session IDs are only 8 hex chars generated client side, so the same ID
+// can show up on several hosts. A session is therefore identified by the
+// (session_id, host_fqdn) pair.
+type SessionInfo struct {
+	SessionID string    `json:"session_id"`
+	Host      string    `json:"host"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+	Commands  int64     `json:"commands"`
+	Cwds      []string  `json:"cwds"`
+}
+
+type SessionEvent struct {
+	Seq     int64     `json:"seq"`
+	Time    time.Time `json:"time"`
+	Gap     float64   `json:"gap_seconds"`
+	Cwd     string    `json:"cwd,omitempty"`
+	RawLine string    `json:"raw_line"`
+}
+
+type sessionQuery struct {
+	Session string
+	Host    string
+	From    time.Time
+	To      time.Time
+	Limit   int
+}
+
+func (s *ExportService) handleSessions(w http.ResponseWriter, r *http.Request) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", w, r)
+
+	tenantID, ok := s.requestTenant(w, r)
+	if !ok {
+		return
+	}
+
+	q, err := parseSessionQuery(r, s.Opts().Cfg.Globals.MaxRows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	sessions, err := s.DB.ListSessions(ctx, tenantID, q)
+	if err != nil {
+		log.Printf("sessions query failed: %v", err)
+		http.Error(w, "sessions query failed", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, sessions)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	for _, si := range sessions {
+		line := fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%s\n",
+			si.SessionID, si.Host,
+			si.First.Local().Format("20060102.150405"),
+			si.Last.Local().Format("20060102.150405"),
+			si.Commands, strings.Join(si.Cwds, ","))
+		if _, err := io.WriteString(w, line); err != nil {
+			return
+		}
+	}
+}
+
+func (s *ExportService) handleSession(w http.ResponseWriter, r *http.Request) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", w, r)
+
+	tenantID, ok := s.requestTenant(w, r)
+	if !ok {
+		return
+	}
+
+	sid := strings.ToLower(strings.TrimSpace(r.PathValue("id")))
+	if !reSessionID.MatchString(sid) {
+		http.Error(w, fmt.Sprintf("invalid session id %q", sid), http.StatusBadRequest)
+		return
+	}
+	host := strings.TrimSpace(r.URL.Query().Get("host"))
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	matches, err := s.DB.ListSessions(ctx, tenantID, sessionQuery{Session: sid, Host: host, Limit: 100})
+	if err != nil {
+		log.Printf("session lookup failed: %v", err)
+		http.Error(w, "session lookup failed", http.StatusInternalServerError)
+		return
+	}
+	switch len(matches) {
+	case 0:
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	case 1:
+		host = matches[0].Host
+	default:
+		hosts := make([]string, 0, len(matches))
+		for _, m := range matches {
+			hosts = append(hosts, m.Host)
+		}
+		http.Error(w, fmt.Sprintf("session %s exists on several hosts, add host= (one of %s)", sid, strings.Join(hosts, ",")), http.StatusConflict)
+		return
+	}
+
+	events, err := s.DB.SessionEvents(ctx, tenantID, sid, host)
+	if err != nil {
+		log.Printf("session query failed: %v", err)
+		http.Error(w, "session query failed", http.StatusInternalServerError)
+		return
+	}
+
+	var privKey []byte
+	if key := strings.TrimSpace(r.URL.Query().Get("key")); key != "" {
+		privKey, _ = base64.StdEncoding.DecodeString(key)
+	}
+	for i := range events {
+		if i > 0 {
+			events[i].Gap = events[i].Time.Sub(events[i-1].Time).Seconds()
+		}
+		if privKey != nil {
+			if decr, err := decryptString(events[i].RawLine, privKey); err == nil {
+				events[i].RawLine = decr
+			}
+		}
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, events)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	for _, ev := range events {
+		gap := time.Duration(ev.Gap * float64(time.Second)).Round(time.Second)
+		if _, err := fmt.Fprintf(w, "+%s\t%s\n", gap, sanitizeForOneLine(ev.RawLine)); err != nil {
+			return
+		}
+	}
+}
+
+// requestTenant applies the common request checks of the API endpoints
+// and resolves the tenant. Only GET is accepted unless methods are given;
+// the other methods change data and need an API key or a client
+// certificate, the "none" auth mode does not apply to them. On failure the
+// response is already written.
+func (s *ExportService) requestTenant(w http.ResponseWriter, r *http.Request, methods ...string) (string, bool) {
+	if !s.Opts().Cfg.Server.IngestClear.Enabled {
+		http.Error(w, "export disabled", http.StatusNotFound)
+		return "", false
+	}
+
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet}
+	}
+	if !slices.Contains(methods, r.Method) {
+		debugPrint(log.Printf, levelInfo, "not allowed method request form %s\n", getIP(r))
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return "", false
+	}
+
+	cd := connDataFromRequest(r)
+
+	authPipeline := []authFn{
+		func(c connData) authRes { return AuthAllow }, // stub allow-all
+	}
+
+	switch runAuthPipeline(cd, authPipeline) {
+	case AuthAllow:
+		// proceed
+	default:
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return "", false
+	}
+
+	if r.Method != http.MethodGet {
+		tenantID := s.getAuthenticatedTenant(r)
+		if tenantID == "" {
+			debugPrint(log.Printf, levelInfo, "unauthenticated %s request from %s\n", r.Method, getIP(r))
+			http.Error(w, "api key or client certificate required", http.StatusForbidden)
+			return "", false
+		}
+		return tenantID, true
+	}
+
+	tenantID := s.getTenant(r)
+	if tenantID == "" {
+		debugPrint(log.Printf, levelError, "no default tenantID\n")
+		http.Error(w, "no default tenantID", http.StatusInternalServerError)
+		return "", false
+	}
+	return tenantID, true
+}
+
+func (s *ExportService) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	maxSec := s.Opts().Cfg.Globals.MaxSeconds
+	if maxSec <= 0 {
+		maxSec = 30
+	}
+	return context.WithTimeout(r.Context(), time.Duration(maxSec)*time.Second)
+}
+
+func parseSessionQuery(r *http.Request, maxRows int) (sessionQuery, error) {
+	v := r.URL.Query()
+
+	q := sessionQuery{
+		Session: strings.ToLower(strings.TrimSpace(v.Get("session"))),
+		Host:    strings.TrimSpace(v.Get("host")),
+	}
+
+	var err error
+	if s := strings.TrimSpace(v.Get("from")); s != "" {
+		if q.From, err = parseTimeParam(s); err != nil {
+			return sessionQuery{}, fmt.Errorf("invalid from=%q: %w", s, err)
+		}
+	}
+	if s := strings.TrimSpace(v.Get("to")); s != "" {
+		if q.To, err = parseTimeParam(s); err != nil {
+			return sessionQuery{}, fmt.Errorf("invalid to=%q: %w", s, err)
+		}
+	}
+
+	limit := maxRows
+	if limit <= 0 {
+		limit = 200000
+	}
+	if s := strings.TrimSpace(v.Get("limit")); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return sessionQuery{}, fmt.Errorf("invalid limit=%q", s)
+		}
+		if n > limit {
+			n = limit
+		}
+		limit = n
+	}
+	q.Limit = limit
+
+	return q, nil
+}
+
+// parseTimeParam accepts RFC3339, a plain date or the hc line timestamp.
+func parseTimeParam(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, ok := parseTS(s); ok {
+		return t, nil
+	}
+	return time.Time{}, errors.New("use RFC3339, YYYY-MM-DD or YYYYMMDD.HHMMSS")
+}
+
+// parseCwds decodes the json array of distinct cwds aggregated in SQL.
+func parseCwds(s string) []string {
+	cwds := []string{}
+	if s == "" {
+		return cwds
+	}
+	if err := json.Unmarshal([]byte(s), &cwds); err != nil {
+		debugPrint(log.Printf, levelWarning, "bad cwd list %q: %v\n", s, err)
+		return []string{}
+	}
+	sort.Strings(cwds)
+	return cwds
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		debugPrint(log.Printf, levelWarning, "json encode failed: %v\n", err)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"database/sql"
 	"errors"
@@ -9,8 +8,9 @@ import (
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
-	"os"
+	"math"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,16 +19,51 @@ type SQLiteDB struct {
 	SQL *sql.DB
 }
 
-func OpenSQLiteDB(ctx context.Context, path string) (*SQLiteDB, error) {
-	debugPrint(log.Printf, levelCrazy, "Args=%v, %s\n", path)
+func init() {
+	registerDBDriver("sqlite", func(ctx context.Context, cfg DBConfig) (DBInterface, error) {
+		return OpenSQLiteDB(ctx, cfg)
+	}, "sqlite", "sqlite3")
+}
 
-	db, err := sql.Open("sqlite3", path)
+// sqlitePath is the file of a SQLite dsn, "" for a memory database.
+func sqlitePath(dsn string) string {
+	path := strings.TrimPrefix(dsn, "file:")
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if path == ":memory:" || strings.Contains(dsn, "mode=memory") {
+		return ""
+	}
+	return path
+}
+
+// sqliteDSN adds the journal mode and busy timeout of cfg to its dsn.
+func sqliteDSN(cfg DBConfig) string {
+	var params []string
+	if cfg.SQLiteWAL {
+		params = append(params, "_journal_mode=WAL")
+	}
+	if cfg.SQLiteBusyTimeoutMS > 0 {
+		params = append(params, "_busy_timeout="+strconv.Itoa(cfg.SQLiteBusyTimeoutMS))
+	}
+	if len(params) == 0 {
+		return cfg.DSN
+	}
+	sep := "?"
+	if strings.Contains(cfg.DSN, "?") {
+		sep = "&"
+	}
+	return cfg.DSN + sep + strings.Join(params, "&")
+}
+
+func OpenSQLiteDB(ctx context.Context, cfg DBConfig) (*SQLiteDB, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", ctx, cfg)
+
+	db, err := sql.Open("sqlite3", sqliteDSN(cfg))
 	if err != nil {
 		return nil, fmt.Errorf("sql open: %w", err)
 	}
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(30 * time.Minute)
+	configurePool(db, cfg)
 
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
@@ -40,6 +75,11 @@ func OpenSQLiteDB(ctx context.Context, path string) (*SQLiteDB, error) {
 	return &SQLiteDB{SQL: db}, nil
 }
 
+func (d *SQLiteDB) Ping(ctx context.Context) error {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", ctx)
+	return d.SQL.PingContext(ctx)
+}
+
 func (d *SQLiteDB) Close() error {
 	debugPrint(log.Printf, levelCrazy, "Args=none\n")
 	if d == nil || d.SQL == nil {
@@ -72,9 +112,14 @@ func (d *SQLiteDB) EnsureSchema(ctx context.Context) error {
 			transport text not null default 'import',
 			parse_ok boolean not null default true,
 
-			raw_line text not null
+			raw_line text not null,
+			dedup_key text,
+			chain_hash text
 		);`,
 
+		`create unique index if not exists cmd_events_tenant_id_dedup_key
+			on cmd_events (tenant_id, dedup_key);`,
+
 		`create index if not exists cmd_events_tenant_id_id_desc
 			on cmd_events (tenant_id, id desc);`,
 
@@ -83,6 +128,24 @@ func (d *SQLiteDB) EnsureSchema(ctx context.Context) error {
 
 		`create index if not exists cmd_events_cmd_trgm
 			on cmd_events using gin (cmd gin_trgm_ops);`,
+
+		`create table if not exists cmd_event_tags (
+			tenant_id text not null references tenants(id),
+			event_id integer not null references cmd_events(id) on delete cascade,
+			tag text not null,
+			primary key (tenant_id, event_id, tag)
+		);`,
+
+		`create table if not exists cmd_event_notes (
+			id integer primary key autoincrement,
+			tenant_id text not null references tenants(id),
+			event_id integer not null references cmd_events(id) on delete cascade,
+			note text not null,
+			created_at text not null default current_timestamp
+		);`,
+
+		`create index if not exists cmd_event_notes_event_id_idx
+			on cmd_event_notes (event_id);`,
 	}
 
 	for _, s := range stmts {
@@ -93,6 +156,47 @@ func (d *SQLiteDB) EnsureSchema(ctx context.Context) error {
 	return nil
 }
 
+// sqliteSchemaUpgrades are the columns and tables added since
+// schema.sqlite3.sql was first published. SQLite has no "add column if
+// not exists", the checks keep them idempotent.
+var sqliteSchemaUpgrades = []schemaUpgrade{
+	{
+		name:  "cmd_events.dedup_key",
+		check: `select count(*) from pragma_table_info('cmd_events') where name = 'dedup_key'`,
+		apply: []string{`alter table cmd_events add column dedup_key text;`},
+	},
+	{
+		name:  "index cmd_events_tenant_id_dedup_key",
+		check: `select count(*) from sqlite_master where type = 'index' and name = 'cmd_events_tenant_id_dedup_key'`,
+		apply: []string{`create unique index if not exists cmd_events_tenant_id_dedup_key
+			on cmd_events (tenant_id, dedup_key);`},
+	},
+	{
+		name:  "cmd_events.chain_hash",
+		check: `select count(*) from pragma_table_info('cmd_events') where name = 'chain_hash'`,
+		apply: []string{`alter table cmd_events add column chain_hash text;`},
+	},
+	{
+		name:  "table cmd_event_notes",
+		check: `select count(*) from sqlite_master where type = 'table' and name = 'cmd_event_notes'`,
+		apply: []string{
+			`create table if not exists cmd_event_notes (
+				id integer primary key autoincrement,
+				tenant_id text not null references tenants(id),
+				event_id integer not null references cmd_events(id) on delete cascade,
+				note text not null,
+				created_at text not null default current_timestamp
+			);`,
+			`create index if not exists cmd_event_notes_event_id_idx
+				on cmd_event_notes (event_id);`,
+		},
+	},
+}
+
+func (d *SQLiteDB) UpgradeSchema(ctx context.Context) error {
+	return upgradeSchema(ctx, d.SQL, sqliteSchemaUpgrades)
+}
+
 func (d *SQLiteDB) EnsureTenant(ctx context.Context, tenantID, name string) error {
 	debugPrint(log.Printf, levelCrazy, "Args=%v, %s, %s\n", ctx, tenantID, name)
 	_, err := d.SQL.ExecContext(ctx,
@@ -123,93 +227,12 @@ func (d *SQLiteDB) GetTenantName(ctx context.Context, tenantID string) (string,
 	return name, true, nil
 }
 
-func (d *SQLiteDB) ImportHistoryFile(ctx context.Context, tenantID, path string) (inserted int, skipped int, err error) {
-	debugPrint(log.Printf, levelCrazy, "Args=%v, %s, %s\n", ctx, tenantID, path)
-	transport := "import"
-	f, err := os.Open(path)
-	if err != nil {
-		return 0, 0, fmt.Errorf("open history file: %w", err)
-	}
-	defer f.Close()
-
-	tx, err := d.SQL.BeginTx(ctx, nil)
-	if err != nil {
-		return 0, 0, fmt.Errorf("begin tx: %w", err)
-	}
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-		}
-	}()
-
-	stmt, err := tx.PrepareContext(ctx, `
-		insert into cmd_events(
-			tenant_id, ts_client, session_id, host_fqdn, cwd, cmd, transport, raw_line, parse_ok
-		) values (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9
-		);
-	`)
-	if err != nil {
-		return 0, 0, fmt.Errorf("prepare insert: %w", err)
-	}
-	defer stmt.Close()
-
-	sc := bufio.NewScanner(f)
-
-	buf := make([]byte, 0, 64*1024)
-	sc.Buffer(buf, 2*1024*1024)
-
-	for sc.Scan() {
-		line := strings.TrimRight(sc.Text(), "\r\n")
-		if strings.TrimSpace(line) == "" {
-			continue
-		}
-
-		ev, _ := ParseIngestLine(tenantID, line)
-		tmp := "unknown"
-		ev.Transport = transport
-		ev.SrcIP = &tmp
-
-		res, e := stmt.ExecContext(ctx,
-			tenantID,
-			ev.TSClient,
-			ev.SessionID,
-			ev.HostFQDN,
-			ev.CWD,
-			ev.Cmd,
-			transport,
-			ev.RawLine,
-			ev.ParseOK,
-		)
-		if e != nil {
-			err = fmt.Errorf("insert line failed: %w", e)
-			return inserted, skipped, err
-		}
-
-		ra, _ := res.RowsAffected()
-		if ra == 1 {
-			inserted++
-		} else {
-			skipped++
-		}
-	}
-	if e := sc.Err(); e != nil {
-		err = fmt.Errorf("scan history file: %w", e)
-		return inserted, skipped, err
-	}
-
-	if err = tx.Commit(); err != nil {
-		return inserted, skipped, fmt.Errorf("commit: %w", err)
-	}
-	return inserted, skipped, nil
-}
-
 func (d *SQLiteDB) MaxSeq(ctx context.Context, tenantID string) (int64, error) {
 	var seq sql.NullInt64
 	debugPrint(log.Printf, levelDebug, "Args: %v, %s\n", ctx, tenantID)
 
 	err := d.SQL.QueryRowContext(ctx, `
-		select max(id) from cmd_events where tenant_id = $1
+		select max(seq) from cmd_events where tenant_id = $1
 	`, tenantID).Scan(&seq)
 	if err != nil {
 		return 0, err
@@ -220,6 +243,19 @@ func (d *SQLiteDB) MaxSeq(ctx context.Context, tenantID string) (int64, error) {
 	return seq.Int64, nil
 }
 
+func (d *SQLiteDB) CountEventsSince(ctx context.Context, tenantID string, since time.Time) (int64, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v\n", ctx, tenantID, since)
+
+	var n int64
+	err := d.SQL.QueryRowContext(ctx, `
+		select count(*) from cmd_events where tenant_id = $1 and julianday(ts_ingested) >= julianday($2)
+	`, tenantID, sqliteTimeText(since)).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
 func (d *SQLiteDB) InsertEventWithSeq(ctx context.Context, ev Event, seq int64) error {
 	debugPrint(log.Printf, levelDebug, "Args: %v, %v, %d\n", ctx, ev, seq)
 
@@ -233,13 +269,13 @@ func (d *SQLiteDB) InsertEventWithSeq(ctx context.Context, ev Event, seq int64)
 	}
 
 //	debugPrint(log.Printf, levelDebug, "insert into cmd_events (tenant_id, ts_client, session_id, host_fqdn, cwd, cmd, raw_line, src_ip, transport, parse_ok) values (%v. %d, 
-	_, err = d.SQL.ExecContext(ctx, `
-		insert into cmd_events
-			(tenant_id, seq, ts_client, session_id, host_fqdn, cwd, cmd, raw_line, src_ip, transport, parse_ok)
-		values
-			($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)
-		on conflict (tenant_id, seq) do nothing
-	`,
+	tx, err := d.SQL.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	args := []any{
 		ev.TenantID,
 		seq,
 		&TSClient,
@@ -251,8 +287,43 @@ func (d *SQLiteDB) InsertEventWithSeq(ctx context.Context, ev Event, seq int64)
 		&SrcIP,
 		ev.Transport,
 		ev.ParseOK,
-	)
-	return err
+		chainHashArg(ev.ChainHash),
+	}
+	if ev.DedupKey != "" {
+		args = append(args, ev.DedupKey)
+	}
+	res, err := tx.ExecContext(ctx, eventInsertSQL(ev.DedupKey != ""), args...)
+	if err != nil {
+		return err
+	}
+	if err := checkDuplicateInsert(res, ev); err != nil {
+		return err
+	}
+	if err := insertEventTags(ctx, tx, sqlitePlaceholder, ev.TenantID, seq, ev.Tags); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *SQLiteDB) InsertEventBatch(ctx context.Context, batch []seqEvent) ([]bool, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %d rows\n", ctx, len(batch))
+
+	tx, err := d.SQL.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	inserted, err := insertEventBatch(ctx, tx, sqlitePlaceholder, func(tenantID string) (any, error) {
+		if _, err := uuid.Parse(tenantID); err != nil {
+			return nil, err
+		}
+		return tenantID, nil
+	}, batch)
+	if err != nil {
+		return nil, err
+	}
+	return inserted, tx.Commit()
 }
 
 func (d *SQLiteDB) lookupTenantByUsername(username string) (string, bool) {
@@ -327,54 +398,86 @@ func (db *SQLiteDB) GetAPIKeyByKeyID(ctx context.Context, keyID string) (APIKeyR
 	return info, true, nil
 }
 
-func (db *SQLiteDB) ExportLines(ctx context.Context, tenantID string, q exportQuery) ([]string, error) {
-	orderSQL, err := exportOrderSQLSQLite(q.Order)
+func (db *SQLiteDB) ExportLines(ctx context.Context, tenantID string, q exportQuery) (exportPage, error) {
+	sort, err := exportOrderSQLSQLite(q.Order)
 	if err != nil {
-		return nil, err
+		return exportPage{}, err
 	}
 
-	var grep1Re *regexp.Regexp
-	useRegex1 := false
-
-	g1 := strings.TrimSpace(q.Grep1)
-	if g1 != "" && !IsPlainSubstring(g1) {
-		grep1Re, err = regexp.Compile("(?i)" + g1)
+	// Plain substrings are pushed down with instr() (case sensitive, no
+	// wildcard escaping needed). SQLite has no regex operator, so regex
+	// stages are evaluated in Go below.
+	var goStages []grepStage
+	var sqlStages []grepTerm
+	for _, t := range q.Greps {
+		if strings.TrimSpace(t.Pattern) == "" {
+			continue
+		}
+		if IsPlainSubstring(t.Pattern) {
+			sqlStages = append(sqlStages, t)
+			continue
+		}
+		re, err := regexp.Compile(t.Pattern)
 		if err != nil {
-			return nil, err
+			return exportPage{}, fmt.Errorf("invalid %s: %w", t.Name, err)
 		}
-		useRegex1 = true
+		goStages = append(goStages, grepStage{re: re, negate: t.Negate})
 	}
+	useGoFilter := len(goStages) > 0
+	goPipe := &GrepPipeline{stages: goStages}
 
 	var sb strings.Builder
-	args := make([]any, 0, 4)
+	args := make([]any, 0, 8+len(sqlStages))
+	bind := func(v any) string {
+		args = append(args, v)
+		return "?"
+	}
 
-	// Select cmd too, so substring filtering can work on both raw_line and cmd
-	// and regex fallback can still inspect raw_line only.
 	sb.WriteString(`
-		select raw_line, cmd
+		select raw_line, id, `)
+	sb.WriteString(sort.keySelect())
+	sb.WriteString(`
 		from cmd_events
 		where tenant_id = ?
 	`)
 	args = append(args, tenantID)
 
+	sort, keyset, reversed, err := exportKeyset(q, sort, bind)
+	if err != nil {
+		return exportPage{}, err
+	}
+	if keyset != "" {
+		sb.WriteString(` and `)
+		sb.WriteString(keyset)
+	}
+
 	if q.Session != "" {
 		sb.WriteString(` and session_id = ?`)
 		args = append(args, q.Session)
 	}
 
-	// Plain substring grep can be done in SQL.
-	if g1 != "" && !useRegex1 {
-		sb.WriteString(` and (lower(raw_line) like lower(?) or lower(cmd) like lower(?))`)
-		pat := "%" + g1 + "%"
-		args = append(args, pat, pat)
+	if q.Host != "" {
+		sb.WriteString(` and host_fqdn = ?`)
+		args = append(args, q.Host)
+	}
+
+	sb.WriteString(tagFilter(q.Tags, bind))
+
+	for _, t := range sqlStages {
+		if t.Negate {
+			sb.WriteString(` and instr(raw_line, ?) = 0`)
+		} else {
+			sb.WriteString(` and instr(raw_line, ?) > 0`)
+		}
+		args = append(args, t.Pattern)
 	}
 
 	sb.WriteString(` order by `)
-	sb.WriteString(orderSQL)
+	sb.WriteString(sort.orderBy())
 
 	// Only push LIMIT into SQL when all filtering is done there.
 	// If regex filtering happens in Go, applying SQL LIMIT first would change semantics.
-	if !useRegex1 && q.Limit > 0 {
+	if !useGoFilter && q.Limit > 0 {
 		sb.WriteString(` limit ?`)
 		args = append(args, q.Limit)
 	}
@@ -383,57 +486,292 @@ func (db *SQLiteDB) ExportLines(ctx context.Context, tenantID string, q exportQu
 
 	rows, err := db.SQL.QueryContext(ctx, sb.String(), args...)
 	if err != nil {
-		return nil, err
+		return exportPage{}, err
 	}
 	defer rows.Close()
 
-	out := make([]string, 0, minInt(q.Limit, 256))
+	page := exportPage{Lines: make([]string, 0, minInt(q.Limit, 256))}
 	for rows.Next() {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return exportPage{}, ctx.Err()
 		default:
 		}
 
 		var rawLine string
-		var cmd sql.NullString
-
-		if err := rows.Scan(&rawLine, &cmd); err != nil {
-			return nil, err
+		var id int64
+		var key sql.NullString
+		if err := rows.Scan(&rawLine, &id, &key); err != nil {
+			return exportPage{}, err
 		}
 
 		// Regex fallback in Go.
-		if useRegex1 && !grep1Re.MatchString(rawLine) {
+		if useGoFilter && !goPipe.Match(rawLine) {
 			continue
 		}
 
-		out = append(out, rawLine)
+		cur := newExportCursor(q.Order, nil, id)
+		if key.Valid {
+			cur.Key = &key.String
+		}
+		if page.First == nil {
+			page.First = cur
+		}
+		page.Last = cur
+		page.Lines = append(page.Lines, rawLine)
 
 		// When regex filtering is done in Go, enforce the effective limit here.
-		if useRegex1 && q.Limit > 0 && len(out) >= q.Limit {
+		if useGoFilter && q.Limit > 0 && len(page.Lines) >= q.Limit {
 			break
 		}
 	}
 
 	if err := rows.Err(); err != nil {
+		return exportPage{}, err
+	}
+	if reversed {
+		reverseStrings(page.Lines)
+		page.First, page.Last = page.Last, page.First
+	}
+
+	return page, nil
+}
+
+func (db *SQLiteDB) ListSessions(ctx context.Context, tenantID string, q sessionQuery) ([]SessionInfo, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v\n", ctx, tenantID, q)
+
+	// Timestamps are TEXT with mixed offsets, compare them as julian days.
+	var sb strings.Builder
+	args := []any{tenantID}
+
+	sb.WriteString(`
+		select session_id, host_fqdn,
+			min(julianday(coalesce(ts_client, ts_ingested))),
+			max(julianday(coalesce(ts_client, ts_ingested))),
+			count(*),
+			coalesce(json_group_array(distinct cwd) filter (where cwd is not null), '[]')
+		from cmd_events
+		where tenant_id = ?
+	`)
+	if q.Session != "" {
+		sb.WriteString(` and session_id = ?`)
+		args = append(args, q.Session)
+	}
+	if q.Host != "" {
+		sb.WriteString(` and host_fqdn = ?`)
+		args = append(args, q.Host)
+	}
+	if !q.From.IsZero() {
+		sb.WriteString(` and julianday(coalesce(ts_client, ts_ingested)) >= julianday(?)`)
+		args = append(args, sqliteTimeText(q.From))
+	}
+	if !q.To.IsZero() {
+		sb.WriteString(` and julianday(coalesce(ts_client, ts_ingested)) < julianday(?)`)
+		args = append(args, sqliteTimeText(q.To))
+	}
+	sb.WriteString(` group by session_id, host_fqdn order by 4 desc limit ?`)
+	args = append(args, q.Limit)
+
+	rows, err := db.SQL.QueryContext(ctx, sb.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []SessionInfo{}
+	for rows.Next() {
+		var si SessionInfo
+		var first, last sql.NullFloat64
+		var cwds string
+		if err := rows.Scan(&si.SessionID, &si.Host, &first, &last, &si.Commands, &cwds); err != nil {
+			return nil, err
+		}
+		si.First = julianToTime(first.Float64)
+		si.Last = julianToTime(last.Float64)
+		si.Cwds = parseCwds(cwds)
+		out = append(out, si)
+	}
+	return out, rows.Err()
+}
+
+func (db *SQLiteDB) SessionEvents(ctx context.Context, tenantID, sessionID, host string) ([]SessionEvent, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %s, %s\n", ctx, tenantID, sessionID, host)
+
+	rows, err := db.SQL.QueryContext(ctx, `
+		select seq, julianday(coalesce(ts_client, ts_ingested)), cwd, raw_line
+		from cmd_events
+		where tenant_id = ? and session_id = ? and host_fqdn = ?
+		order by 2, id
+	`, tenantID, sessionID, host)
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return out, nil
+	out := []SessionEvent{}
+	for rows.Next() {
+		var ev SessionEvent
+		var jd sql.NullFloat64
+		var cwd sql.NullString
+		if err := rows.Scan(&ev.Seq, &jd, &cwd, &ev.RawLine); err != nil {
+			return nil, err
+		}
+		ev.Time = julianToTime(jd.Float64)
+		ev.Cwd = cwd.String
+		out = append(out, ev)
+	}
+	return out, rows.Err()
 }
 
-func exportOrderSQLSQLite(order string) (string, error) {
+func (db *SQLiteDB) CommandStats(ctx context.Context, tenantID string, q statsQuery) (CmdStats, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v\n", ctx, tenantID, q)
+
+	// No regexp_replace in sqlite: blanks become spaces and runs of up to
+	// 32 spaces are folded by repeated replaces.
+	norm := `replace(replace(replace(coalesce(cmd, ''), char(9), ' '), char(10), ' '), char(13), ' ')`
+	for i := 0; i < 5; i++ {
+		norm = `replace(` + norm + `, '  ', ' ')`
+	}
+
+	var sb strings.Builder
+	args := []any{tenantID}
+
+	sb.WriteString(`with ev as (
+		select trim(` + norm + `) as cmd,
+			host_fqdn as host, session_id as sess,
+			case when parse_ok then 0 else 1 end as failed,
+			strftime('%H', coalesce(ts_client, ts_ingested)) as hour,
+			strftime('%Y-%m-%d', coalesce(ts_client, ts_ingested)) as day
+		from cmd_events
+		where tenant_id = ?`)
+	if q.Host != "" {
+		sb.WriteString(` and host_fqdn = ?`)
+		args = append(args, q.Host)
+	}
+	if !q.From.IsZero() {
+		sb.WriteString(` and julianday(coalesce(ts_client, ts_ingested)) >= julianday(?)`)
+		args = append(args, sqliteTimeText(q.From))
+	}
+	if !q.To.IsZero() {
+		sb.WriteString(` and julianday(coalesce(ts_client, ts_ingested)) < julianday(?)`)
+		args = append(args, sqliteTimeText(q.To))
+	}
+	sb.WriteString(`)`)
+
+	return runCommandStats(ctx, db.SQL, statsSQL{
+		With:  sb.String(),
+		Args:  args,
+		Token: `case when instr(cmd, ' ') > 0 then substr(cmd, 1, instr(cmd, ' ') - 1) else cmd end`,
+	}, q)
+}
+
+func (db *SQLiteDB) TagEvents(ctx context.Context, tenantID string, t tagTarget, tags []string) (int64, error) {
+	return changeEventTags(ctx, db.SQL, sqlitePlaceholder, tenantID, t, tags, false)
+}
+
+func (db *SQLiteDB) UntagEvents(ctx context.Context, tenantID string, t tagTarget, tags []string) (int64, error) {
+	return changeEventTags(ctx, db.SQL, sqlitePlaceholder, tenantID, t, tags, true)
+}
+
+func (db *SQLiteDB) ListTags(ctx context.Context, tenantID string) ([]TagCount, error) {
+	return queryTagCounts(ctx, db.SQL, sqlitePlaceholder, tenantID)
+}
+
+func (db *SQLiteDB) AddNote(ctx context.Context, tenantID string, seq int64, note string) error {
+	return insertEventNote(ctx, db.SQL, sqlitePlaceholder, tenantID, seq, note)
+}
+
+func (db *SQLiteDB) GetEvent(ctx context.Context, tenantID string, seq int64) (EventDetail, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %d\n", ctx, tenantID, seq)
+
+	ev := EventDetail{Seq: seq}
+	var id int64
+	err := db.SQL.QueryRowContext(ctx, `
+		select id, raw_line from cmd_events where tenant_id = ? and seq = ?
+	`, tenantID, seq).Scan(&id, &ev.RawLine)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ev, errEventNotFound
+	}
+	if err != nil {
+		return ev, err
+	}
+
+	if ev.Tags, err = queryEventTags(ctx, db.SQL, sqlitePlaceholder, tenantID, id); err != nil {
+		return ev, err
+	}
+
+	rows, err := db.SQL.QueryContext(ctx, `
+		select julianday(created_at), note from cmd_event_notes
+		where tenant_id = ? and event_id = ?
+		order by 1, id
+	`, tenantID, id)
+	if err != nil {
+		return ev, err
+	}
+	defer rows.Close()
+
+	ev.Notes = []EventNote{}
+	for rows.Next() {
+		var n EventNote
+		var jd sql.NullFloat64
+		if err := rows.Scan(&jd, &n.Note); err != nil {
+			return ev, err
+		}
+		n.Time = julianToTime(jd.Float64)
+		ev.Notes = append(ev.Notes, n)
+	}
+	return ev, rows.Err()
+}
+
+// sqliteTimeText formats t the way sqlite date functions understand it.
+func sqliteTimeText(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func julianToTime(jd float64) time.Time {
+	return time.UnixMilli(int64(math.Round((jd - 2440587.5) * 86400000))).UTC()
+}
+
+func exportOrderSQLSQLite(order string) (exportSort, error) {
 	switch strings.ToLower(strings.TrimSpace(order)) {
 	case "ingest_asc":
-		return "id asc", nil
+		return exportSort{}, nil
 	case "ingest_desc":
-		return "id desc", nil
+		return exportSort{Desc: true}, nil
 	case "client_asc":
-		return "ts_client asc", nil
+		return exportSort{KeyCol: "ts_client", KeySelect: "cast(ts_client as text)", KeyBind: "%s"}, nil
 	case "client_desc":
-		return "ts_client desc", nil
+		return exportSort{KeyCol: "ts_client", KeySelect: "cast(ts_client as text)", KeyBind: "%s", Desc: true}, nil
 
 	default:
-		return "", fmt.Errorf("invalid order %q", order)
+		return exportSort{}, fmt.Errorf("invalid order %q", order)
 	}
 }
+
+func (db *SQLiteDB) ScanEventPayloads(ctx context.Context, tenantID string, fn func(eventPayload) error) error {
+	return scanEventPayloads(ctx, db.SQL, sqlitePlaceholder, tenantID, fn)
+}
+
+func (db *SQLiteDB) copier() sqlCopy {
+	return sqlCopy{db: db.SQL, ph: sqlitePlaceholder, pg: false}
+}
+
+func (db *SQLiteDB) ListTenants(ctx context.Context) ([]tenantRecord, error) {
+	return db.copier().listTenants(ctx)
+}
+
+func (db *SQLiteDB) ReadTenantMeta(ctx context.Context, tenantID string) (tenantMeta, error) {
+	return db.copier().readTenantMeta(ctx, tenantID)
+}
+
+func (db *SQLiteDB) WriteTenantMeta(ctx context.Context, m tenantMeta) error {
+	return db.copier().writeTenantMeta(ctx, m)
+}
+
+func (db *SQLiteDB) ScanEventRecords(ctx context.Context, tenantID string, afterSeq int64, fn func(eventRecord) error) error {
+	return db.copier().scanEvents(ctx, tenantID, afterSeq, fn)
+}
+
+func (db *SQLiteDB) WriteEventRecords(ctx context.Context, tenantID string, recs []eventRecord) (int, error) {
+	return db.copier().writeEvents(ctx, tenantID, recs)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	statsDefaultTop = 10
+	statsMaxTop     = 1000
+)
+
+type statCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// CmdStats is the aggregated view of a tenant's cmd_events. Hours and days
+// are UTC. Command tops are omitted for encrypted tenants, the database
+// only holds ciphertext there.
+type CmdStats struct {
+	Total         int64       `json:"total"`
+	ParseFailed   int64       `json:"parse_failed"`
+	ParseFailRate float64     `json:"parse_fail_rate"`
+	Sessions      int64       `json:"sessions"`
+	TopCommands   []statCount `json:"top_commands,omitempty"`
+	TopFull       []statCount `json:"top_full_commands,omitempty"`
+	TopHosts      []statCount `json:"top_hosts"`
+	TopSessions   []statCount `json:"top_sessions"`
+	PerHour       []statCount `json:"per_hour"`
+	PerDay        []statCount `json:"per_day"`
+}
+
+type statsQuery struct {
+	Host       string
+	From       time.Time
+	To         time.Time
+	Top        int
+	NoCommands bool
+}
+
+// statsSQL is what a backend supplies to runCommandStats: a CTE named ev
+// with columns cmd (normalized, empty when missing), host, sess, failed (0/1),
+// hour and day, plus the expression extracting the first token of cmd.
+type statsSQL struct {
+	With  string
+	Args  []any
+	Token string
+}
+
+func runCommandStats(ctx context.Context, db *sql.DB, sq statsSQL, q statsQuery) (CmdStats, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %v, %v\n", ctx, sq, q)
+
+	var st CmdStats
+	err := db.QueryRowContext(ctx, sq.With+`
+		select count(*), coalesce(sum(failed), 0),
+			(select count(*) from (select distinct sess, host from ev) s)
+		from ev`, sq.Args...).Scan(&st.Total, &st.ParseFailed, &st.Sessions)
+	if err != nil {
+		return st, fmt.Errorf("stats totals: %w", err)
+	}
+	if st.Total > 0 {
+		st.ParseFailRate = float64(st.ParseFailed) / float64(st.Total)
+	}
+
+	top := " order by 2 desc, 1 limit " + strconv.Itoa(q.Top)
+	type section struct {
+		name string
+		dst  *[]statCount
+		sql  string
+	}
+	sections := []section{
+		{"hosts", &st.TopHosts, `select host, count(*) from ev group by host` + top},
+		{"sessions", &st.TopSessions, `select sess || '@' || host, count(*) from ev group by sess, host` + top},
+		{"hours", &st.PerHour, `select hour, count(*) from ev group by hour order by hour`},
+		{"days", &st.PerDay, `select day, count(*) from ev group by day order by day`},
+	}
+	if !q.NoCommands {
+		sections = append(sections,
+			section{"commands", &st.TopCommands, `select ` + sq.Token + `, count(*) from ev where cmd <> '' group by 1` + top},
+			section{"full commands", &st.TopFull, `select cmd, count(*) from ev where cmd <> '' group by cmd` + top},
+		)
+	}
+
+	for _, sec := range sections {
+		counts, err := queryStatCounts(ctx, db, sq.With+sec.sql, sq.Args)
+		if err != nil {
+			return st, fmt.Errorf("stats %s: %w", sec.name, err)
+		}
+		*sec.dst = counts
+	}
+	return st, nil
+}
+
+func queryStatCounts(ctx context.Context, db *sql.DB, query string, args []any) ([]statCount, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []statCount{}
+	for rows.Next() {
+		var c statCount
+		var key sql.NullString
+		if err := rows.Scan(&key, &c.Count); err != nil {
+			return nil, err
+		}
+		c.Key = key.String
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (s *ExportService) handleStats(w http.ResponseWriter, r *http.Request) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", w, r)
+
+	tenantID, ok := s.requestTenant(w, r)
+	if !ok {
+		return
+	}
+
+	q, err := parseStatsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.NoCommands = tenantIsCrypt(s.Opts(), tenantID)
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	st, err := s.DB.CommandStats(ctx, tenantID, q)
+	if err != nil {
+		log.Printf("stats query failed: %v", err)
+		http.Error(w, "stats query failed", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, st)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	writeStatsText(w, st)
+}
+
+func parseStatsQuery(r *http.Request) (statsQuery, error) {
+	v := r.URL.Query()
+
+	q := statsQuery{
+		Host: strings.TrimSpace(v.Get("host")),
+		Top:  statsDefaultTop,
+	}
+
+	var err error
+	if s := strings.TrimSpace(v.Get("from")); s != "" {
+		if q.From, err = parseTimeParam(s); err != nil {
+			return statsQuery{}, fmt.Errorf("invalid from=%q: %w", s, err)
+		}
+	}
+	if s := strings.TrimSpace(v.Get("to")); s != "" {
+		if q.To, err = parseTimeParam(s); err != nil {
+			return statsQuery{}, fmt.Errorf("invalid to=%q: %w", s, err)
+		}
+	}
+	if s := strings.TrimSpace(v.Get("top")); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return statsQuery{}, fmt.Errorf("invalid top=%q", s)
+		}
+		q.Top = min(n, statsMaxTop)
+	}
+	return q, nil
+}
+
+func tenantIsCrypt(opts *Options, tenantID string) bool {
+	for _, t := range opts.Cfg.Tenants {
+		if t.TenantID == tenantID {
+			return t.Crypt
+		}
+	}
+	return false
+}
+
+func writeStatsText(w io.Writer, st CmdStats) {
+	fmt.Fprintf(w, "commands\t%d\n", st.Total)
+	fmt.Fprintf(w, "parse_failed\t%d (%.2f%%)\n", st.ParseFailed, st.ParseFailRate*100)
+	fmt.Fprintf(w, "sessions\t%d\n", st.Sessions)
+
+	list := func(title string, counts []statCount) {
+		if counts == nil {
+			return
+		}
+		fmt.Fprintf(w, "\n%s\n", title)
+		for _, c := range counts {
+			fmt.Fprintf(w, "%8d\t%s\n", c.Count, sanitizeForOneLine(c.Key))
+		}
+	}
+	list("top commands", st.TopCommands)
+	list("top full commands", st.TopFull)
+	list("top hosts", st.TopHosts)
+	list("top sessions", st.TopSessions)
+	list("per hour (UTC)", st.PerHour)
+	list("per day (UTC)", st.PerDay)
+}
+
+func doStats(version string, args []string) {
+	debugPrint(log.Printf, levelCrazy, "Args=%s, %v\n", version, args)
+	opts, err := getRuntimeConf(version, args)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	tenantID := opts.Cfg.Globals.DefaultTenantID
+	q := opts.Stats
+	q.NoCommands = tenantIsCrypt(opts, tenantID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.Cfg.Globals.MaxSeconds)*time.Second)
+	defer cancel()
+
+	debugPrint(log.Printf, levelDebug, "connecting db\n")
+	db, err := OpenDB(ctx, opts.Cfg.DB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	st, err := db.CommandStats(ctx, tenantID, q)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if opts.StatsJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(st)
+		return
+	}
+	writeStatsText(os.Stdout, st)
+}
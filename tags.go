@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxNoteBytes = 4096
+
+var (
+	reTag            = regexp.MustCompile(`^[a-z0-9][a-z0-9._:-]{0,63}$`)
+	errEventNotFound = errors.New("event not found")
+)
+
+// tagTarget selects the events a tag operation applies to: a single event
+// by its tenant sequence number, or a whole session. Host is optional for
+// sessions, without it every host sharing the session id is selected.
+type tagTarget struct {
+	Seq     int64
+	Session string
+	Host    string
+}
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int64  `json:"count"`
+}
+
+type EventNote struct {
+	Time time.Time `json:"time"`
+	Note string    `json:"note"`
+}
+
+type EventDetail struct {
+	Seq     int64       `json:"seq"`
+	RawLine string      `json:"raw_line"`
+	Tags    []string    `json:"tags"`
+	Notes   []EventNote `json:"notes"`
+}
+
+type autoTagRule struct {
+	tag string
+	re  *regexp.Regexp
+}
+
+func (t tagTarget) valid() error {
+	switch {
+	case t.Seq > 0 && t.Session != "":
+		return errors.New("select either an event or a session, not both")
+	case t.Seq > 0:
+		return nil
+	case t.Session != "":
+		if !reSessionID.MatchString(t.Session) {
+			return fmt.Errorf("invalid session id %q", t.Session)
+		}
+		return nil
+	default:
+		return errors.New("no event or session selected")
+	}
+}
+
+// where returns the cmd_events predicate selecting the target.
+func (t tagTarget) where(bind func(any) string) string {
+	if t.Seq > 0 {
+		return " and seq = " + bind(t.Seq)
+	}
+	cond := " and session_id = " + bind(t.Session)
+	if t.Host != "" {
+		cond += " and host_fqdn = " + bind(t.Host)
+	}
+	return cond
+}
+
+// tagFilter returns the predicate keeping the cmd_events rows carrying
+// every tag.
+func tagFilter(tags []string, bind func(any) string) string {
+	var sb strings.Builder
+	for _, tag := range tags {
+		sb.WriteString(` and exists (select 1 from cmd_event_tags t
+			where t.tenant_id = cmd_events.tenant_id and t.event_id = cmd_events.id and t.tag = `)
+		sb.WriteString(bind(tag))
+		sb.WriteString(`)`)
+	}
+	return sb.String()
+}
+
+func normalizeTags(in []string) ([]string, error) {
+	out := make([]string, 0, len(in))
+	for _, t := range in {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if !reTag.MatchString(t) {
+			return nil, fmt.Errorf("invalid tag %q", t)
+		}
+		out = append(out, t)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no tag given")
+	}
+	return out, nil
+}
+
+// compileAutoTags returns, per tenant, the global rules followed by the
+// tenant ones.
+func compileAutoTags(cfg *Config) (map[string][]autoTagRule, error) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", cfg)
+
+	compile := func(rules []AutoTagRule) ([]autoTagRule, error) {
+		out := make([]autoTagRule, 0, len(rules))
+		for _, r := range rules {
+			re, err := regexp.Compile(r.Match)
+			if err != nil {
+				return nil, fmt.Errorf("auto tag %q: %w", r.Tag, err)
+			}
+			out = append(out, autoTagRule{tag: r.Tag, re: re})
+		}
+		return out, nil
+	}
+
+	global, err := compile(cfg.Globals.AutoTags)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]autoTagRule, len(cfg.Tenants))
+	for _, t := range cfg.Tenants {
+		own, err := compile(t.AutoTags)
+		if err != nil {
+			return nil, err
+		}
+		result[t.TenantID] = append(append([]autoTagRule{}, global...), own...)
+	}
+	return result, nil
+}
+
+func matchAutoTags(rules []autoTagRule, ev Event) []string {
+	if len(rules) == 0 || ev.Cmd == nil {
+		return nil
+	}
+	var tags []string
+	for _, r := range rules {
+		if r.re.MatchString(*ev.Cmd) && !slices.Contains(tags, r.tag) {
+			tags = append(tags, r.tag)
+		}
+	}
+	return tags
+}
+
+func hasAllTags(have, want []string) bool {
+	for _, t := range want {
+		if !slices.Contains(have, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// Tag storage is plain SQL shared by the backends, only the placeholder
+// style differs.
+
+func pgPlaceholder(n int) string   { return "$" + strconv.Itoa(n) }
+func sqlitePlaceholder(int) string { return "?" }
+
+func newBinder(ph func(int) string) (*[]any, func(any) string) {
+	args := []any{}
+	return &args, func(v any) string {
+		args = append(args, v)
+		return ph(len(args))
+	}
+}
+
+func insertEventTags(ctx context.Context, tx *sql.Tx, ph func(int) string, tenantID string, seq int64, tags []string) error {
+	for _, tag := range tags {
+		args, bind := newBinder(ph)
+		q := `insert into cmd_event_tags (tenant_id, event_id, tag)
+			select tenant_id, id, ` + bind(tag) + ` from cmd_events
+			where tenant_id = ` + bind(tenantID) + ` and seq = ` + bind(seq) + `
+			on conflict do nothing`
+		if _, err := tx.ExecContext(ctx, q, *args...); err != nil {
+			return fmt.Errorf("insert tag %q: %w", tag, err)
+		}
+	}
+	return nil
+}
+
+func changeEventTags(ctx context.Context, db *sql.DB, ph func(int) string, tenantID string, t tagTarget, tags []string, remove bool) (int64, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %v, %v, %t\n", ctx, tenantID, t, tags, remove)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var total int64
+	for _, tag := range tags {
+		args, bind := newBinder(ph)
+		var q string
+		if remove {
+			q = `delete from cmd_event_tags
+				where tenant_id = ` + bind(tenantID) + ` and tag = ` + bind(tag) + `
+				and event_id in (select id from cmd_events where tenant_id = ` + bind(tenantID) + t.where(bind) + `)`
+		} else {
+			q = `insert into cmd_event_tags (tenant_id, event_id, tag)
+				select tenant_id, id, ` + bind(tag) + ` from cmd_events
+				where tenant_id = ` + bind(tenantID) + t.where(bind) + `
+				on conflict do nothing`
+		}
+		res, err := tx.ExecContext(ctx, q, *args...)
+		if err != nil {
+			return 0, fmt.Errorf("tag %q: %w", tag, err)
+		}
+		n, _ := res.RowsAffected()
+		total += n
+	}
+	return total, tx.Commit()
+}
+
+func insertEventNote(ctx context.Context, db *sql.DB, ph func(int) string, tenantID string, seq int64, note string) error {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s, %d, %s\n", ctx, tenantID, seq, note)
+
+	args, bind := newBinder(ph)
+	q := `insert into cmd_event_notes (tenant_id, event_id, note)
+		select tenant_id, id, ` + bind(note) + ` from cmd_events
+		where tenant_id = ` + bind(tenantID) + ` and seq = ` + bind(seq)
+	res, err := db.ExecContext(ctx, q, *args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errEventNotFound
+	}
+	return nil
+}
+
+func queryTagCounts(ctx context.Context, db *sql.DB, ph func(int) string, tenantID string) ([]TagCount, error) {
+	debugPrint(log.Printf, levelDebug, "Args: %v, %s\n", ctx, tenantID)
+
+	rows, err := db.QueryContext(ctx, `
+		select tag, count(*) from cmd_event_tags
+		where tenant_id = `+ph(1)+`
+		group by tag order by 2 desc, 1`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []TagCount{}
+	for rows.Next() {
+		var tc TagCount
+		if err := rows.Scan(&tc.Tag, &tc.Count); err != nil {
+			return nil, err
+		}
+		out = append(out, tc)
+	}
+	return out, rows.Err()
+}
+
+func queryEventTags(ctx context.Context, db *sql.DB, ph func(int) string, tenantID string, eventID int64) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		select tag from cmd_event_tags
+		where tenant_id = `+ph(1)+` and event_id = `+ph(2)+`
+		order by tag`, tenantID, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		out = append(out, tag)
+	}
+	return out, rows.Err()
+}
+
+func (s *ExportService) handleTags(w http.ResponseWriter, r *http.Request) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", w, r)
+
+	tenantID, ok := s.requestTenant(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	tags, err := s.DB.ListTags(ctx, tenantID)
+	if err != nil {
+		log.Printf("tags query failed: %v", err)
+		http.Error(w, "tags query failed", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, tags)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	for _, tc := range tags {
+		if _, err := fmt.Fprintf(w, "%8d\t%s\n", tc.Count, tc.Tag); err != nil {
+			return
+		}
+	}
+}
+
+func (s *ExportService) handleEvent(w http.ResponseWriter, r *http.Request) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", w, r)
+
+	tenantID, ok := s.requestTenant(w, r)
+	if !ok {
+		return
+	}
+	seq, ok := pathSeq(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	ev, err := s.DB.GetEvent(ctx, tenantID, seq)
+	if errors.Is(err, errEventNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("event query failed: %v", err)
+		http.Error(w, "event query failed", http.StatusInternalServerError)
+		return
+	}
+
+	if key := strings.TrimSpace(r.URL.Query().Get("key")); key != "" {
+		if privKey, err := base64.StdEncoding.DecodeString(key); err == nil {
+			if decr, err := decryptString(ev.RawLine, privKey); err == nil {
+				ev.RawLine = decr
+			}
+		}
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, ev)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	writeEventText(w, ev)
+}
+
+func (s *ExportService) handleEventTags(w http.ResponseWriter, r *http.Request) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", w, r)
+
+	tenantID, ok := s.requestTenant(w, r, http.MethodPost, http.MethodDelete)
+	if !ok {
+		return
+	}
+	seq, ok := pathSeq(w, r)
+	if !ok {
+		return
+	}
+	s.changeTags(w, r, tenantID, tagTarget{Seq: seq})
+}
+
+func (s *ExportService) handleSessionTags(w http.ResponseWriter, r *http.Request) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", w, r)
+
+	tenantID, ok := s.requestTenant(w, r, http.MethodPost, http.MethodDelete)
+	if !ok {
+		return
+	}
+	t := tagTarget{
+		Session: strings.ToLower(strings.TrimSpace(r.PathValue("id"))),
+		Host:    strings.TrimSpace(r.URL.Query().Get("host")),
+	}
+	s.changeTags(w, r, tenantID, t)
+}
+
+func (s *ExportService) changeTags(w http.ResponseWriter, r *http.Request, tenantID string, t tagTarget) {
+	if err := t.valid(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tags, err := normalizeTags(r.URL.Query()["tag"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	remove := r.Method == http.MethodDelete
+	var n int64
+	if remove {
+		n, err = s.DB.UntagEvents(ctx, tenantID, t, tags)
+	} else {
+		n, err = s.DB.TagEvents(ctx, tenantID, t, tags)
+	}
+	if err != nil {
+		log.Printf("tag update failed: %v", err)
+		http.Error(w, "tag update failed", http.StatusInternalServerError)
+		return
+	}
+
+	verb := "added"
+	if remove {
+		verb = "removed"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%s %d tags\n", verb, n)
+}
+
+func (s *ExportService) handleEventNotes(w http.ResponseWriter, r *http.Request) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", w, r)
+
+	tenantID, ok := s.requestTenant(w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	seq, ok := pathSeq(w, r)
+	if !ok {
+		return
+	}
+
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxNoteBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("note too long (max %d bytes)", maxNoteBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	note := strings.TrimSpace(sanitizeUTF8(string(b)))
+	if note == "" {
+		http.Error(w, "empty note", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	err = s.DB.AddNote(ctx, tenantID, seq, note)
+	if errors.Is(err, errEventNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("note insert failed: %v", err)
+		http.Error(w, "note insert failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func pathSeq(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	seq, err := strconv.ParseInt(r.PathValue("seq"), 10, 64)
+	if err != nil || seq <= 0 {
+		http.Error(w, fmt.Sprintf("invalid event %q", r.PathValue("seq")), http.StatusBadRequest)
+		return 0, false
+	}
+	return seq, true
+}
+
+func writeEventText(w io.Writer, ev EventDetail) {
+	fmt.Fprintf(w, "%d\t%s\n", ev.Seq, sanitizeForOneLine(ev.RawLine))
+	if len(ev.Tags) > 0 {
+		fmt.Fprintf(w, "tags\t%s\n", strings.Join(ev.Tags, ","))
+	}
+	for _, n := range ev.Notes {
+		fmt.Fprintf(w, "note\t%s\t%s\n", n.Time.Local().Format("20060102.150405"), sanitizeForOneLine(n.Note))
+	}
+}
+
+func doTag(version string, args []string) {
+	debugPrint(log.Printf, levelCrazy, "Args=%s, %v\n", version, args)
+	opts, err := getRuntimeConf(version, args)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	if err := opts.TagTarget.valid(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	tags, err := normalizeTags(opts.Tags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.Cfg.Globals.MaxSeconds)*time.Second)
+	defer cancel()
+
+	db, err := OpenDB(ctx, opts.Cfg.DB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	tenantID := opts.Cfg.Globals.DefaultTenantID
+	var n int64
+	if opts.TagRemove {
+		n, err = db.UntagEvents(ctx, tenantID, opts.TagTarget, tags)
+	} else {
+		n, err = db.TagEvents(ctx, tenantID, opts.TagTarget, tags)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	verb := "added"
+	if opts.TagRemove {
+		verb = "removed"
+	}
+	fmt.Printf("%s %d tags\n", verb, n)
+}
+
+func doNote(version string, args []string) {
+	debugPrint(log.Printf, levelCrazy, "Args=%s, %v\n", version, args)
+	opts, err := getRuntimeConf(version, args)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	note := strings.TrimSpace(opts.Note)
+	if opts.TagTarget.Seq <= 0 || note == "" {
+		fmt.Fprintln(os.Stderr, "note needs -seq and -note")
+		os.Exit(2)
+	}
+	if len(note) > maxNoteBytes {
+		fmt.Fprintf(os.Stderr, "note too long (max %d bytes)\n", maxNoteBytes)
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.Cfg.Globals.MaxSeconds)*time.Second)
+	defer cancel()
+
+	db, err := OpenDB(ctx, opts.Cfg.DB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	if err := db.AddNote(ctx, opts.Cfg.Globals.DefaultTenantID, opts.TagTarget.Seq, note); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tailSubDepth      = 256
+	tailKeepaliveFreq = 15 * time.Second
+)
+
+type tailEvent struct {
+	Seq int64
+	Ev  Event
+}
+
+type tailSub struct {
+	tenantID string
+	ch       chan tailEvent
+	dropped  uint64
+}
+
+// tailHub fans out freshly stored events to the /tail subscribers of the
+// same tenant. Publishing never blocks ingestion: slow subscribers lose
+// events and are told so.
+type tailHub struct {
+	mu   sync.RWMutex
+	subs map[*tailSub]struct{}
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newTailHub() *tailHub {
+	return &tailHub{subs: make(map[*tailSub]struct{}), done: make(chan struct{})}
+}
+
+// Close ends the /tail streams, they would otherwise hold the HTTP
+// servers at shutdown.
+func (h *tailHub) Close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+func (h *tailHub) Subscribe(tenantID string) *tailSub {
+	debugPrint(log.Printf, levelCrazy, "Args=%s\n", tenantID)
+
+	sub := &tailSub{
+		tenantID: tenantID,
+		ch:       make(chan tailEvent, tailSubDepth),
+	}
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *tailHub) Unsubscribe(sub *tailSub) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v\n", sub)
+
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+func (h *tailHub) Publish(seq int64, ev Event) {
+	if h == nil {
+		return
+	}
+	debugPrint(log.Printf, levelCrazy, "Args=%d, %v\n", seq, ev)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.subs {
+		if sub.tenantID != ev.TenantID {
+			continue
+		}
+		select {
+		case sub.ch <- tailEvent{Seq: seq, Ev: ev}:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+func (s *ExportService) handleTail(w http.ResponseWriter, r *http.Request) {
+	debugPrint(log.Printf, levelCrazy, "Args=%v, %v\n", w, r)
+
+	if s.Tail == nil {
+		http.Error(w, "tail not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	tenantID, ok := s.requestTenant(w, r)
+	if !ok {
+		return
+	}
+
+	q, err := parseExportQuery(r, s.Opts().Cfg.Globals.MaxRows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pipe, err := CompileGrepPipeline(q.Greps, q.Color)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var privKey []byte
+	if q.Key != "" {
+		privKey, _ = base64.StdEncoding.DecodeString(q.Key)
+	}
+
+	sub := s.Tail.Subscribe(tenantID)
+	defer s.Tail.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	debugPrint(log.Printf, levelInfo, "tail started tenant=%s from %s\n", tenantID, getIP(r))
+
+	keepalive := time.NewTicker(tailKeepaliveFreq)
+	defer keepalive.Stop()
+
+	var reported uint64
+	for {
+		select {
+		case <-r.Context().Done():
+			debugPrint(log.Printf, levelInfo, "tail ended tenant=%s from %s\n", tenantID, getIP(r))
+			return
+
+		case <-s.Tail.done:
+			debugPrint(log.Printf, levelInfo, "tail closed by shutdown tenant=%s from %s\n", tenantID, getIP(r))
+			return
+
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case te := <-sub.ch:
+			if dropped := atomic.LoadUint64(&sub.dropped); dropped != reported {
+				if _, err := fmt.Fprintf(w, ": dropped %d events\n\n", dropped-reported); err != nil {
+					return
+				}
+				reported = dropped
+			}
+
+			if q.Session != "" && te.Ev.SessionID != q.Session {
+				continue
+			}
+			if q.Host != "" && te.Ev.HostFQDN != q.Host {
+				continue
+			}
+			if !hasAllTags(te.Ev.Tags, q.Tags) {
+				continue
+			}
+
+			line := strings.TrimRight(te.Ev.RawLine, "\r\n")
+			if !pipe.Match(line) {
+				continue
+			}
+			if privKey != nil {
+				if decr, err := decryptString(line, privKey); err == nil {
+					line = decr
+				}
+			}
+			if pipe.ColorEnabled() {
+				line = pipe.Highlight(line)
+			}
+
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", te.Seq, sanitizeForOneLine(line)); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -12,11 +12,36 @@ import (
 
 type Options struct {
 	Cfg               Config
+	ConfigPath        string
 	LogLevel          DebugLevels
 	LegacyHistoryFile string
 	AKTenantID        uuid.UUID
 	AKUserID          uuid.UUID
 	Verstr            string
+	Stats             statsQuery
+	StatsJSON         bool
+	TagTarget         tagTarget
+	Tags              []string
+	TagRemove         bool
+	Note              string
+	Import            importOptions
+	Args              []string
+	MigrateFrom       string
+	MigrateTo         string
+	VerifyKey         string
+	VerifySpool       string
+}
+
+// importOptions are the import switches, empty means the default.
+type importOptions struct {
+	From       string // tool database instead of a history file
+	Format     string
+	Tenant     string
+	Host       string
+	Session    string
+	DryRun     bool
+	OnError    string
+	Checkpoint string
 }
 
 type Event struct {
@@ -30,6 +55,9 @@ type Event struct {
 	Transport string
 	SrcIP     *string
 	ParseOK   bool
+	Tags      []string
+	DedupKey  string
+	ChainHash string // hex, "" when the chain is disabled
 }
 
 func getRuntimeConf(version string, args []string) (*Options, error) {
@@ -69,9 +97,29 @@ func ResolveOptions(cfg Config, cl CommandLine, verstr string) (*Options, error)
 
 	o.LogLevel = cl.LogLevel
 	o.Verstr = verstr
+	o.ConfigPath = cl.ConfigPath
 	o.LegacyHistoryFile = cl.HistoryFile
 	o.AKUserID = cl.AKUserID
 	o.AKTenantID = cl.AKTenantID
+	o.Stats = cl.Stats
+	o.StatsJSON = cl.StatsJSON
+	o.TagTarget = cl.TagTarget
+	o.Tags = cl.Tags
+	o.TagRemove = cl.TagRemove
+	o.Note = cl.Note
+	o.Args = cl.Args
+	o.MigrateFrom, o.MigrateTo = cl.MigrateFrom, cl.MigrateTo
+	o.VerifyKey, o.VerifySpool = cl.VerifyKey, cl.VerifySpool
+	o.Import = importOptions{
+		From:       cl.ImportFrom,
+		Format:     cl.ImportFormat,
+		Tenant:     cl.ImportTenant,
+		Host:       cl.Stats.Host,
+		Session:    cl.TagTarget.Session,
+		DryRun:     cl.Import.DryRun,
+		OnError:    cl.Import.OnError,
+		Checkpoint: cl.Import.Checkpoint,
+	}
 	return &o, nil
 }
 